@@ -16,7 +16,7 @@ import (
 var username = "sherlock_" + strconv.FormatInt(time.Now().UnixMilli(), 10)
 
 func TestApiCreate_ValidRequest(t *testing.T) {
-	router := setupRouter()
+	router := setupRouter(t)
 
 	payload := ClientJsonRequest{
 		Username: username,
@@ -41,7 +41,7 @@ func TestApiCreate_ValidRequest(t *testing.T) {
 }
 
 func TestApiCreate_InvalidPayload(t *testing.T) {
-	router := setupRouter()
+	router := setupRouter(t)
 
 	// Missing required fields
 	req, _ := http.NewRequest("POST", "/create", bytes.NewBuffer([]byte(`{}`)))
@@ -58,7 +58,7 @@ func TestApiCreate_InvalidPayload(t *testing.T) {
 }
 
 func TestApiLogin_ValidCredentials(t *testing.T) {
-	router := setupRouter()
+	router := setupRouter(t)
 
 	// Pre-store user in DB if needed, or assume test DB state
 	payload := ClientJsonRequest{
@@ -84,7 +84,7 @@ func TestApiLogin_ValidCredentials(t *testing.T) {
 }
 
 func TestApiLogin_MissingFields(t *testing.T) {
-	router := setupRouter()
+	router := setupRouter(t)
 
 	body := []byte(`{"username": ""}`) // missing password
 	req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(body))
@@ -101,7 +101,7 @@ func TestApiLogin_MissingFields(t *testing.T) {
 }
 
 func TestApiLogin_InvalidCredentials(t *testing.T) {
-	router := setupRouter()
+	router := setupRouter(t)
 
 	payload := ClientJsonRequest{
 		Username: "wronguser",
@@ -124,7 +124,8 @@ func TestApiLogin_InvalidCredentials(t *testing.T) {
 }
 
 // Extract router setup to reuse across tests
-func setupRouter() *gin.Engine {
+func setupRouter(t *testing.T) *gin.Engine {
+	useTestStorage(t)
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
 	router.POST("/create", ApiCreate)
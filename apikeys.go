@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// API keys are issued by this server so services don't have to hold the
+// user's Matrix access token, which grants full access to the account.
+const apiKeyPrefix = "smk_"
+
+const (
+	ScopeMessagesSend   = "messages:send"
+	ScopeMessagesRead   = "messages:read"
+	ScopeDevicesManage  = "devices:manage"
+	ScopeWebhooksManage = "webhooks:manage"
+	ScopeBridgesAdmin   = "bridges:admin"
+)
+
+// AllScopes are granted to Matrix access tokens, API keys get the ones they
+// were created with. ScopeBridgesAdmin is not one of them, it acts on any
+// user and only the admin token of bridge_commands carries it.
+var AllScopes = []string{ScopeMessagesSend, ScopeMessagesRead, ScopeDevicesManage, ScopeWebhooksManage}
+
+// ErrOperatorScope is returned when a user asks for a key with the scope of
+// operators.
+var ErrOperatorScope = errors.New("the bridges:admin scope is only granted to operators")
+
+// APIKey represents an issued API key, the key itself is only returned once
+// on creation.
+// @Description Represents an API key issued for a user
+// @name APIKey
+// @type object
+type APIKey struct {
+	ID         int        `json:"id" example:"1"`
+	Username   string     `json:"-"`
+	Name       string     `json:"name" example:"billing-service"`
+	Prefix     string     `json:"prefix" example:"smk_3q2b7wQx"`
+	Key        string     `json:"key,omitempty" example:"smk_3q2b7wQxLk..."`
+	Scopes     []string   `json:"scopes" example:"messages:send"`
+	AllowedIPs []string   `json:"allowed_ips,omitempty" example:"10.0.0.0/8"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func GenerateAPIKey() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if scope == ScopeBridgesAdmin {
+			return ErrOperatorScope
+		}
+		if !slices.Contains(AllScopes, scope) {
+			return fmt.Errorf("unknown scope: %s", scope)
+		}
+	}
+	return nil
+}
+
+// ValidateAllowedIPs checks every entry is an IP address or a CIDR range.
+func ValidateAllowedIPs(allowedIPs []string) error {
+	for _, entry := range allowedIPs {
+		if net.ParseIP(entry) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return fmt.Errorf("invalid IP or CIDR range: %s", entry)
+		}
+	}
+	return nil
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+func (k *APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// AllowsIP reports whether the key may be used from ip. Keys without an
+// allowlist may be used from anywhere.
+func (k *APIKey) AllowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, entry := range k.AllowedIPs {
+		if allowed := net.ParseIP(entry); allowed != nil {
+			if allowed.Equal(parsed) {
+				return true
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinList(values []string) string {
+	return strings.Join(values, ",")
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func nullTimePtr(value sql.NullTime) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Time
+}
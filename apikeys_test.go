@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPIKeyAllowsIP(t *testing.T) {
+	tests := []struct {
+		allowedIPs []string
+		ip         string
+		want       bool
+	}{
+		{nil, "192.0.2.1", true},
+		{[]string{"192.0.2.1"}, "192.0.2.1", true},
+		{[]string{"192.0.2.1"}, "192.0.2.2", false},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{[]string{"10.0.0.0/8", "2001:db8::/32"}, "2001:db8::1", true},
+		{[]string{"10.0.0.0/8"}, "not an ip", false},
+	}
+
+	for _, tt := range tests {
+		key := APIKey{AllowedIPs: tt.allowedIPs}
+		if got := key.AllowsIP(tt.ip); got != tt.want {
+			t.Errorf("AllowsIP(%v) with %v = %v, want %v", tt.ip, tt.allowedIPs, got, tt.want)
+		}
+	}
+}
+
+func TestAPIKeyExpired(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+
+	tests := []struct {
+		expiresAt *time.Time
+		want      bool
+	}{
+		{nil, false},
+		{&past, true},
+		{&now, true},
+		{&future, false},
+	}
+
+	for _, tt := range tests {
+		key := APIKey{ExpiresAt: tt.expiresAt}
+		if got := key.Expired(now); got != tt.want {
+			t.Errorf("Expired() with %v = %v, want %v", tt.expiresAt, got, tt.want)
+		}
+	}
+}
+
+func TestValidateScopes(t *testing.T) {
+	tests := []struct {
+		scopes  []string
+		wantErr bool
+	}{
+		{[]string{ScopeMessagesSend}, false},
+		{AllScopes, false},
+		{nil, true},
+		{[]string{ScopeMessagesSend, "admin"}, true},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateScopes(tt.scopes); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateScopes(%v) error = %v, wantErr %v", tt.scopes, err, tt.wantErr)
+		}
+	}
+}
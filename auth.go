@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"maunium.net/go/mautrix"
+)
+
+const (
+	authUsernameKey    = "auth.username"
+	authAccessTokenKey = "auth.accessToken"
+	authScopesKey      = "auth.scopes"
+	authAPIKeyKey      = "auth.apiKey"
+)
+
+var (
+	ErrAPIKeyInvalid      = errors.New("invalid API key")
+	ErrAPIKeyExpired      = errors.New("API key has expired")
+	ErrAPIKeyIPNotAllowed = errors.New("API key is not allowed from this address")
+	ErrAPIKeyLoggedOut    = errors.New("API key owner is logged out")
+)
+
+// ResolveAPIKey finds the key and the user it was issued to, whose stored
+// Matrix access token the request then acts with.
+func ResolveAPIKey(apiKey string, clientIP string) (*APIKey, Users, error) {
+	key, err := GlobalStorage.Keystore().FetchAPIKeyByHash(AccessTokenHash(apiKey))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, Users{}, ErrAPIKeyInvalid
+		}
+		return nil, Users{}, err
+	}
+
+	if key.Expired(time.Now()) {
+		return nil, Users{}, ErrAPIKeyExpired
+	}
+
+	if !key.AllowsIP(clientIP) {
+		return nil, Users{}, ErrAPIKeyIPNotAllowed
+	}
+
+	user, err := GlobalStorage.Keystore().FetchUser(key.Username)
+	if err != nil {
+		return nil, Users{}, err
+	}
+
+	// Keys act with the user's stored token, which logging out removes.
+	if user.AccessToken == "" {
+		return nil, Users{}, ErrAPIKeyLoggedOut
+	}
+
+	if err := GlobalStorage.Keystore().TouchAPIKey(key.ID); err != nil {
+		log.Println("Failed to update api key last use:", err)
+	}
+
+	return &key, user, nil
+}
+
+// What the homeserver said about access tokens the keystore doesn't know is
+// reused for accessTokenCacheTTL, so requests with such tokens, valid or not,
+// don't each cost a /whoami call.
+const (
+	accessTokenCacheTTL  = 30 * time.Second
+	accessTokenCacheSize = 10000
+)
+
+type resolvedAccessToken struct {
+	// username is empty for tokens that were rejected.
+	username  string
+	expiresAt time.Time
+}
+
+// AccessTokenCache holds the users access tokens resolved to, keyed by the
+// hash of the token.
+type AccessTokenCache struct {
+	mutex  sync.Mutex
+	tokens map[string]resolvedAccessToken
+}
+
+var GlobalAccessTokenCache = NewAccessTokenCache()
+
+func NewAccessTokenCache() *AccessTokenCache {
+	return &AccessTokenCache{tokens: make(map[string]resolvedAccessToken)}
+}
+
+// Lookup returns the user the token was resolved to, empty when it was
+// rejected, and false when it was not resolved lately.
+func (tc *AccessTokenCache) Lookup(tokenHash string, now time.Time) (string, bool) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	resolved, ok := tc.tokens[tokenHash]
+	if !ok || !now.Before(resolved.expiresAt) {
+		return "", false
+	}
+	return resolved.username, true
+}
+
+// Store remembers the user the token resolved to, empty when it was
+// rejected. Nothing is stored while the cache is full of live entries.
+func (tc *AccessTokenCache) Store(tokenHash, username string, now time.Time) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	if len(tc.tokens) >= accessTokenCacheSize {
+		for key, resolved := range tc.tokens {
+			if !now.Before(resolved.expiresAt) {
+				delete(tc.tokens, key)
+			}
+		}
+		if len(tc.tokens) >= accessTokenCacheSize {
+			return
+		}
+	}
+	tc.tokens[tokenHash] = resolvedAccessToken{username: username, expiresAt: now.Add(accessTokenCacheTTL)}
+}
+
+// ForgetUser drops the tokens resolved to username, once it logs out.
+func (tc *AccessTokenCache) ForgetUser(username string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	for key, resolved := range tc.tokens {
+		if resolved.username == username {
+			delete(tc.tokens, key)
+		}
+	}
+}
+
+// ResolveAccessToken finds the user an access token belongs to. Tokens the
+// keystore knows are resolved locally, anything else is asked to the
+// homeserver, which must report a user of ours that the keystore knows. The
+// answer is cached for a short while, rejections included.
+func ResolveAccessToken(ctx context.Context, accessToken string) (string, error) {
+	user, err := GlobalStorage.Keystore().FetchUserByAccessToken(accessToken)
+	if err == nil {
+		return user.Username, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	tokenHash := AccessTokenHash(accessToken)
+	if username, ok := GlobalAccessTokenCache.Lookup(tokenHash, time.Now()); ok {
+		if username == "" {
+			return "", mautrix.MUnknownToken
+		}
+		return username, nil
+	}
+
+	username, err := whoami(ctx, accessToken)
+	if err == nil || errors.Is(err, mautrix.MUnknownToken) {
+		GlobalAccessTokenCache.Store(tokenHash, username, time.Now())
+	}
+	return username, err
+}
+
+// whoami asks the homeserver who the access token belongs to.
+func whoami(ctx context.Context, accessToken string) (string, error) {
+	client, err := mautrix.NewClient(cfg().HomeServer, "", accessToken)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Whoami(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.UserID.Homeserver() != cfg().HomeServerDomain {
+		return "", mautrix.MUnknownToken
+	}
+
+	username := resp.UserID.Localpart()
+	if _, err := GlobalStorage.Keystore().FetchUser(username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", mautrix.MUnknownToken
+		}
+		return "", err
+	}
+
+	return username, nil
+}
+
+// AuthMiddleware resolves the bearer token, a Matrix access token or an API
+// key, to the user it was issued to and makes that user available to the
+// handlers through AuthenticatedUsername.
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		accessToken, err := extractBearerToken(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		if IsAPIKey(accessToken) {
+			key, user, err := ResolveAPIKey(accessToken, c.ClientIP())
+			switch {
+			case errors.Is(err, ErrAPIKeyInvalid), errors.Is(err, ErrAPIKeyExpired), errors.Is(err, ErrAPIKeyLoggedOut):
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			case errors.Is(err, ErrAPIKeyIPNotAllowed):
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			case err != nil:
+				log.Printf("Failed to resolve api key: %v", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+				return
+			}
+
+			c.Set(authUsernameKey, user.Username)
+			c.Set(authAccessTokenKey, user.AccessToken)
+			c.Set(authScopesKey, key.Scopes)
+			c.Set(authAPIKeyKey, key)
+			c.Next()
+			return
+		}
+
+		username, err := ResolveAccessToken(c.Request.Context(), accessToken)
+		if err != nil {
+			if errors.Is(err, mautrix.MUnknownToken) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid access token"})
+				return
+			}
+			log.Printf("Failed to resolve access token: %v", err)
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "Could not verify access token"})
+			return
+		}
+
+		c.Set(authUsernameKey, username)
+		c.Set(authAccessTokenKey, accessToken)
+		c.Set(authScopesKey, AllScopes)
+		c.Next()
+	}
+}
+
+// RequireScope lets requests through whose token was granted scope, which
+// Matrix access tokens always are.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !slices.Contains(AuthenticatedScopes(c), scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": fmt.Sprintf("API key is missing the %s scope", scope),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireAccessToken only lets Matrix access tokens through, for endpoints
+// API keys must not reach such as issuing more API keys.
+func RequireAccessToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if AuthenticatedAPIKey(c) != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This endpoint requires a Matrix access token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireAdminToken only lets requests through that carry the admin token of
+// bridge_commands, which operators act on any user with. Matrix access tokens
+// and API keys are refused, as is everything while no admin token is set.
+func RequireAdminToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := extractBearerToken(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		adminToken := cfg().BridgeCommands.AdminToken
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This endpoint requires the admin token"})
+			return
+		}
+
+		c.Set(authScopesKey, []string{ScopeBridgesAdmin})
+		c.Next()
+	}
+}
+
+func AuthenticatedUsername(c *gin.Context) string {
+	return c.GetString(authUsernameKey)
+}
+
+// AuthenticatedAccessToken is the Matrix access token to act with, the
+// user's stored one when the request came with an API key.
+func AuthenticatedAccessToken(c *gin.Context) string {
+	return c.GetString(authAccessTokenKey)
+}
+
+func AuthenticatedScopes(c *gin.Context) []string {
+	return c.GetStringSlice(authScopesKey)
+}
+
+// AuthenticatedAPIKey is the API key the request came with, nil for Matrix
+// access tokens.
+func AuthenticatedAPIKey(c *gin.Context) *APIKey {
+	if key, ok := c.Get(authAPIKeyKey); ok {
+		return key.(*APIKey)
+	}
+	return nil
+}
+
+// checkBodyUsername rejects requests whose body names a user other than the
+// one the token belongs to. The field is optional and only kept for older
+// clients.
+func checkBodyUsername(c *gin.Context, username string) bool {
+	if username != "" && username != AuthenticatedUsername(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Username does not match access token"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"maunium.net/go/mautrix"
+)
+
+func newTestAPIKey(t *testing.T, key APIKey) string {
+	t.Helper()
+	secret, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Name = "test"
+	key.Prefix = secret[:len(apiKeyPrefix)+8]
+	if err := GlobalStorage.Keystore().CreateAPIKey(&key, AccessTokenHash(secret)); err != nil {
+		t.Fatalf("CreateAPIKey() error = %v", err)
+	}
+	return secret
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	storage := newTestSQLiteStorage(t)
+	useTestMasterKeys(t)
+	if err := storage.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	previous := GlobalStorage
+	GlobalStorage = storage
+	t.Cleanup(func() { GlobalStorage = previous })
+
+	if err := storage.Keystore().CreateUser("alice", "syt_alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	sendKey := newTestAPIKey(t, APIKey{Username: "alice", Scopes: []string{ScopeMessagesSend}})
+	past := time.Now().Add(-time.Hour)
+	expiredKey := newTestAPIKey(t, APIKey{Username: "alice", Scopes: AllScopes, ExpiresAt: &past})
+	allowlistedKey := newTestAPIKey(t, APIKey{Username: "alice", Scopes: AllScopes, AllowedIPs: []string{"10.0.0.0/8"}})
+
+	if err := storage.Keystore().CreateUser("bob", "syt_bob"); err != nil {
+		t.Fatal(err)
+	}
+	loggedOutKey := newTestAPIKey(t, APIKey{Username: "bob", Scopes: AllScopes})
+	if err := storage.Keystore().RemoveAccessToken("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.POST("/whoami", AuthMiddleware(), func(c *gin.Context) {
+		var req ClientBridgeJsonRequest
+		if !bindOptionalJSON(c, &req) || !checkBodyUsername(c, req.Username) {
+			return
+		}
+		c.String(http.StatusOK, AuthenticatedUsername(c)+" "+AuthenticatedAccessToken(c))
+	})
+	router.POST("/devices", AuthMiddleware(), RequireScope(ScopeDevicesManage), func(c *gin.Context) {
+		c.String(http.StatusOK, AuthenticatedUsername(c))
+	})
+	router.POST("/api-keys", AuthMiddleware(), RequireAccessToken(), func(c *gin.Context) {
+		c.String(http.StatusOK, AuthenticatedUsername(c))
+	})
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		body          string
+		wantStatus    int
+		wantBody      string
+	}{
+		{"missing token", "/whoami", "", "", http.StatusUnauthorized, ""},
+		{"not a bearer token", "/whoami", "Basic YWxpY2U=", "", http.StatusUnauthorized, ""},
+		{"known token", "/whoami", "Bearer syt_alice", "", http.StatusOK, "alice syt_alice"},
+		{"matching body username", "/whoami", "Bearer syt_alice", `{"username":"alice"}`, http.StatusOK, "alice syt_alice"},
+		{"other body username", "/whoami", "Bearer syt_alice", `{"username":"mallory"}`, http.StatusForbidden, ""},
+		{"api key acts with the stored token", "/whoami", "Bearer " + sendKey, "", http.StatusOK, "alice syt_alice"},
+		{"unknown api key", "/whoami", "Bearer smk_unknown", "", http.StatusUnauthorized, ""},
+		{"expired api key", "/whoami", "Bearer " + expiredKey, "", http.StatusUnauthorized, ""},
+		{"api key from outside its allowlist", "/whoami", "Bearer " + allowlistedKey, "", http.StatusForbidden, ""},
+		{"api key of a logged out user", "/whoami", "Bearer " + loggedOutKey, "", http.StatusUnauthorized, ""},
+		{"api key without the scope", "/devices", "Bearer " + sendKey, "", http.StatusForbidden, ""},
+		{"access token has every scope", "/devices", "Bearer syt_alice", "", http.StatusOK, "alice"},
+		{"api key issuing api keys", "/api-keys", "Bearer " + sendKey, "", http.StatusForbidden, ""},
+		{"access token issuing api keys", "/api-keys", "Bearer syt_alice", "", http.StatusOK, "alice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", recorder.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && recorder.Body.String() != tt.wantBody {
+				t.Errorf("body = %v, want %v", recorder.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useTestStorage(t)
+	if err := GlobalStorage.Keystore().CreateUser("alice", "syt_alice"); err != nil {
+		t.Fatal(err)
+	}
+	allowlistedKey := newTestAPIKey(t, APIKey{Username: "alice", Scopes: AllScopes, AllowedIPs: []string{"10.0.0.0/8"}})
+
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		remoteAddr     string
+		forwardedFor   string
+		wantStatus     int
+	}{
+		{"forged X-Forwarded-For", nil, "203.0.113.7:4711", "10.0.0.1", http.StatusForbidden},
+		{"X-Forwarded-For from an untrusted proxy", []string{"192.0.2.1"}, "203.0.113.7:4711", "10.0.0.1", http.StatusForbidden},
+		{"X-Forwarded-For from a trusted proxy", []string{"192.0.2.0/24"}, "192.0.2.1:4711", "10.0.0.1", http.StatusOK},
+		{"allowlisted address", nil, "10.0.0.1:4711", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, &Conf{TrustedProxies: tt.trustedProxies})
+			router, err := newRouter()
+			if err != nil {
+				t.Fatalf("newRouter() error = %v", err)
+			}
+			router.GET("/whoami", AuthMiddleware(), func(c *gin.Context) {
+				c.String(http.StatusOK, AuthenticatedUsername(c))
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("Authorization", "Bearer "+allowlistedKey)
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", recorder.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestBridgeCommandAdminToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useTestStorage(t)
+	if err := GlobalStorage.Keystore().CreateUser("alice", "syt_alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := GlobalStorage.Keystore().CreateUser("bob", "syt_bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := GlobalStorage.Keystore().RemoveAccessToken("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	adminToken := strings.Repeat("a", minAdminTokenLen)
+	conf := Conf{
+		HomeServerDomain: "example.org",
+		Bridges:          []map[string]BridgeConfig{{"wa": {BotName: "@whatsappbot:example.org"}}},
+		BridgeCommands:   BridgeCommands{AdminToken: adminToken},
+	}
+	useTestConfig(t, &conf)
+
+	router := gin.New()
+	router.POST("/:platform/command", RequireAdminToken(), ApiBridgeCommand)
+	authorized := router.Group("/", AuthMiddleware())
+	authorized.POST("/api-keys", RequireAccessToken(), ApiCreateAPIKey)
+
+	post := func(path, authorization, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Authorization", authorization)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Users can't issue themselves the scope of operators.
+	if recorder := post("/api-keys", "Bearer syt_alice", `{"name":"ops","scopes":["bridges:admin"]}`); recorder.Code != http.StatusForbidden {
+		t.Errorf("issuing a bridges:admin key: status = %v, want %v", recorder.Code, http.StatusForbidden)
+	}
+	recorder := post("/api-keys", "Bearer syt_alice", `{"name":"ops","scopes":["messages:send","messages:read","devices:manage","webhooks:manage"]}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("issuing an API key: status = %v, want %v: %s", recorder.Code, http.StatusCreated, recorder.Body)
+	}
+	var selfIssued APIKey
+	if err := json.Unmarshal(recorder.Body.Bytes(), &selfIssued); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		body          string
+		wantStatus    int
+	}{
+		{"missing token", adminToken, "", `{"username":"alice","command":"!wa sync"}`, http.StatusUnauthorized},
+		{"user access token", adminToken, "Bearer syt_alice", `{"username":"alice","command":"!wa sync"}`, http.StatusForbidden},
+		{"self-issued api key", adminToken, "Bearer " + selfIssued.Key, `{"username":"alice","command":"!wa sync"}`, http.StatusForbidden},
+		{"wrong admin token", adminToken, "Bearer " + strings.Repeat("b", minAdminTokenLen), `{"username":"alice","command":"!wa sync"}`, http.StatusForbidden},
+		{"no admin token configured", "", "Bearer syt_alice", `{"username":"alice","command":"!wa sync"}`, http.StatusForbidden},
+		{"missing username", adminToken, "Bearer " + adminToken, `{"command":"!wa sync"}`, http.StatusBadRequest},
+		{"unknown user", adminToken, "Bearer " + adminToken, `{"username":"mallory","command":"!wa sync"}`, http.StatusNotFound},
+		{"logged out user", adminToken, "Bearer " + adminToken, `{"username":"bob","command":"!wa sync"}`, http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := conf
+			conf.BridgeCommands.AdminToken = tt.adminToken
+			useTestConfig(t, &conf)
+
+			if recorder := post("/wa/command", tt.authorization, tt.body); recorder.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v: %s", recorder.Code, tt.wantStatus, recorder.Body)
+			}
+		})
+	}
+}
+
+func TestResolveAccessTokenCache(t *testing.T) {
+	useTestStorage(t)
+	if err := GlobalStorage.Keystore().CreateUser("alice", "syt_alice"); err != nil {
+		t.Fatal(err)
+	}
+	previous := GlobalAccessTokenCache
+	GlobalAccessTokenCache = NewAccessTokenCache()
+	t.Cleanup(func() { GlobalAccessTokenCache = previous })
+
+	// The homeserver knows another token of alice.
+	var calls atomic.Int32
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer syt_alice_phone" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Unknown access token"}`))
+			return
+		}
+		w.Write([]byte(`{"user_id":"@alice:example.org"}`))
+	}))
+	defer homeserver.Close()
+	useTestConfig(t, &Conf{HomeServer: homeserver.URL, HomeServerDomain: "example.org"})
+
+	for i := 0; i < 3; i++ {
+		if username, err := ResolveAccessToken(context.Background(), "syt_alice_phone"); err != nil || username != "alice" {
+			t.Errorf("ResolveAccessToken() = %q, %v, want alice", username, err)
+		}
+		if _, err := ResolveAccessToken(context.Background(), "syt_forged"); !errors.Is(err, mautrix.MUnknownToken) {
+			t.Errorf("ResolveAccessToken() of an unknown token error = %v, want %v", err, mautrix.MUnknownToken)
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("homeserver asked %d times, want once per token", got)
+	}
+
+	GlobalAccessTokenCache.ForgetUser("alice")
+	if _, err := ResolveAccessToken(context.Background(), "syt_alice_phone"); err != nil {
+		t.Fatal(err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("homeserver asked %d times, want again after alice logged out", got)
+	}
+}
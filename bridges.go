@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"maunium.net/go/mautrix"
@@ -20,132 +23,182 @@ type Bridges struct {
 	Client     *mautrix.Client
 }
 
-func (b *Bridges) ProcessIncomingLoginDaemon(bridgeCfg *BridgeConfig) {
-	log.Println("Processing incoming login daemon for:", b.Name)
-	var clientDb = ClientDB{
-		username: b.Client.UserID.Localpart(),
-		filepath: "db/" + b.Client.UserID.Localpart() + ".db",
-	}
+const (
+	LoginMethodQR    = "qr"
+	LoginMethodPhone = "phone"
+)
 
-	if err := clientDb.Init(); err != nil {
-		log.Println("Error initializing client db:", err)
-		return
+// DeviceLogin is how a device gets linked, by scanning a QR code or by
+// entering the pairing code the bridge sends for PhoneNumber on the phone.
+type DeviceLogin struct {
+	Method      string
+	PhoneNumber string
+}
+
+const (
+	LoginUpdateQR          = "qr"
+	LoginUpdatePairingCode = "pairing_code"
+	LoginUpdateStatus      = "status"
+	LoginUpdateScanned     = "scanned"
+	LoginUpdateInput       = "input"
+	LoginUpdateSuccess     = "success"
+	LoginUpdateFailed      = "failed"
+	LoginUpdateTimeout     = "timeout"
+	LoginUpdateCancelled   = "cancelled"
+	// LoginUpdateRejected is only sent to the websocket whose input frame
+	// was rejected.
+	LoginUpdateRejected = "rejected"
+)
+
+// LoginUpdate is what a device login hands its websockets, sent to them as a
+// JSON frame. Success, failed, timeout and cancelled updates end the login.
+type LoginUpdate struct {
+	Type        string `json:"type"`
+	State       string `json:"state,omitempty"`        // State of the login after the update
+	Image       []byte `json:"image,omitempty"`        // QR code PNG, base64 in JSON
+	QRCode      string `json:"qr,omitempty"`           // Text the QR code encodes
+	PairingCode string `json:"pairing_code,omitempty"` // Code to enter on the phone
+	Message     string `json:"message,omitempty"`      // Status notice of the bridge
+	PhoneNumber string `json:"phone_number,omitempty"` // Number the device was linked to
+	Input       string `json:"input,omitempty"`        // Input of the login step the bridge asks for
+	Secret      bool   `json:"secret,omitempty"`       // Whether the input is a secret, like a password
+	Reason      string `json:"reason,omitempty"`       // Why the login failed, timed out or was cancelled
+}
+
+// LoginInput is what clients send on the websocket of a login, answering
+// the login step the bridge asked for.
+type LoginInput struct {
+	Type  string `json:"type"`  // Always input
+	Input string `json:"input"` // Input of the login step, e.g. code
+	Value string `json:"value"`
+}
+
+func (u LoginUpdate) Ended() bool {
+	switch u.Type {
+	case LoginUpdateSuccess, LoginUpdateFailed, LoginUpdateTimeout, LoginUpdateCancelled:
+		return true
 	}
+	return false
+}
+
+// loginSubscriberName names the event subscriber of the device login loginID,
+// unique so concurrent logins of a platform each get their own.
+func loginSubscriberName(username, platformName, loginID string) string {
+	return ReverseAliasForEventSubscriber(username, platformName, cfg().HomeServerDomain) + "+login:" + loginID
+}
+
+// processIncomingLoginMessages hands what the bridge sends during the login
+// to ch, QR codes, pairing codes and status notices until it succeeded, failed
+// or timed out, until done is closed.
+func (b *Bridges) processIncomingLoginMessages(ch chan<- LoginUpdate, done <-chan struct{}, loginID string, login DeviceLogin) {
+	since := time.Now().UTC().Add(-2 * time.Minute)
 
-	eventSubName := ReverseAliasForEventSubscriber(b.Client.UserID.Localpart(), b.Name, cfg.HomeServerDomain) + "+loginDaemon"
+	eventSubName := loginSubscriberName(b.Client.UserID.Localpart(), b.Name, loginID)
 	eventSubscriber := EventSubscriber{
 		Name:    eventSubName,
 		MsgType: nil,
 		ExcludeMsgTypes: []event.MessageType{
 			event.MsgText,
 		},
+		Since:  &since,
 		RoomID: b.RoomID,
 		Callback: func(evt *event.Event) {
-			log.Println("Received event in login:", evt.RoomID, evt.Sender, evt.Timestamp, evt.Type)
-			if evt.Sender != b.Client.UserID && evt.Type == event.EventMessage {
-				failedCmd := bridgeCfg.Cmd["failed"]
+			log.Println("New message for login", evt.RoomID, evt.Sender, evt.Timestamp, evt.Type)
+			if evt.Sender == b.Client.UserID || evt.Type != event.EventMessage {
+				return
+			}
 
-				matchesSuccess, err := cfg.CheckSuccessPattern(b.Name, evt.Content.AsMessage().Body)
+			msg := evt.Content.AsMessage()
+			// Refreshed QR codes are edits of the first one.
+			if msg.NewContent != nil {
+				msg = msg.NewContent
+			}
 
+			if msg.MsgType.IsMedia() {
+				image, err := DownloadMedia(b.Client, msg)
 				if err != nil {
-					clientDb.RemoveActiveSessions(b.Client.UserID.Localpart())
-				}
-
-				if evt.Content.Raw["msgtype"] == "m.notice" {
-					if strings.Contains(evt.Content.AsMessage().Body, failedCmd) || matchesSuccess {
-						clientDb.RemoveActiveSessions(b.Client.UserID.Localpart())
-					}
-				}
-
-				if evt.Content.AsMessage().MsgType.IsMedia() {
-					url := evt.Content.AsMessage().URL
-					file, err := ParseImage(b.Client, string(url))
-					if err != nil {
-						log.Println("Error parsing image:", err)
-						clientDb.RemoveActiveSessions(b.Client.UserID.Localpart())
-					}
-
-					// return file, nil
-					clientDb.StoreActiveSessions(b.Client.UserID.Localpart(), file)
+					log.Println("Error parsing image:", err)
+					return
 				}
+				sendLoginData(ch, done, LoginUpdate{Type: LoginUpdateQR, Image: image, QRCode: msg.Body})
+				return
 			}
 
-			// defer func() {
-			// 	for index, subscriber := range EventSubscribers {
-			// 		if subscriber.Name == eventSubName {
-			// 			EventSubscribers = append(EventSubscribers[:index], EventSubscribers[index+1:]...)
-			// 			break
-			// 		}
-			// 	}
-			// }()
+			if msg.MsgType == event.MsgNotice {
+				sendLoginData(ch, done, b.parseLoginNotice(msg.Body, login))
+			}
 		},
 	}
-	EventSubscribers = append(EventSubscribers, eventSubscriber)
+	if !AddEventSubscriber(eventSubscriber) {
+		log.Println("Event subscriber already exists for:", eventSubName)
+		return
+	}
+	log.Println("Added event subscriber for:", eventSubscriber)
 }
 
-func (b *Bridges) processIncomingLoginMessages(ch *chan []byte) {
-	since := time.Now().UTC().Add(-2 * time.Minute)
+// parseLoginNotice turns a notice of the bridge during a login into the
+// update for its websockets, answering the bridge when it asks for the phone
+// number.
+func (b *Bridges) parseLoginNotice(body string, login DeviceLogin) LoginUpdate {
+	if matchesSuccess, phoneNumber, _ := cfg().MatchSuccessPattern(b.Name, body); matchesSuccess {
+		log.Println("Login succeeded for:", b.Name, body)
+		return LoginUpdate{Type: LoginUpdateSuccess, PhoneNumber: phoneNumber}
+	}
 
-	var clientDb = ClientDB{
-		username: b.Client.UserID.Localpart(),
-		filepath: "db/" + b.Client.UserID.Localpart() + ".db",
+	// Timeouts are checked first, bridges report them as failures.
+	if matchesTimeout, _ := cfg().CheckTimeoutPattern(b.Name, body); matchesTimeout {
+		log.Println("Login timed out for:", b.Name, body)
+		return LoginUpdate{Type: LoginUpdateTimeout, Reason: body}
 	}
 
-	if err := clientDb.Init(); err != nil {
-		log.Println("Error initializing client db:", err)
-		return
+	failedCmd := ""
+	if bridgeCfg, ok := cfg().GetBridgeConfig(b.Name); ok {
+		failedCmd = bridgeCfg.Cmd["failed"]
+	}
+	if failedCmd != "" && strings.Contains(body, failedCmd) {
+		log.Println("Login failed for:", b.Name, body)
+		return LoginUpdate{Type: LoginUpdateFailed, Reason: body}
 	}
 
-	eventSubName := ReverseAliasForEventSubscriber(b.Client.UserID.Localpart(), b.Name, cfg.HomeServerDomain) + "+login"
-	eventSubscriber := EventSubscriber{}
-	for _, subscriber := range EventSubscribers {
-		if subscriber.Name == eventSubName {
-			// eventSubscriber = subscriber
-			log.Println("Event subscriber already exists for:", eventSubName)
-			return
-		}
+	if matchesScanned, _ := cfg().CheckScannedPattern(b.Name, body); matchesScanned {
+		return LoginUpdate{Type: LoginUpdateScanned, Message: body}
 	}
 
-	noticeType := event.MsgNotice
-	eventSubscriber = EventSubscriber{
-		Name:    eventSubName,
-		MsgType: &noticeType,
-		Since:   &since,
-		RoomID:  b.RoomID,
-		Callback: func(evt *event.Event) {
-			log.Println("New notice for login", evt.RoomID, evt.Sender, evt.Timestamp, evt.Type)
-			if evt.Sender != b.Client.UserID && evt.Type == event.EventMessage {
-				matchesOngoing, err := cfg.CheckOngoingPattern(b.Name, evt.Content.AsMessage().Body)
+	if login.Method == LoginMethodPhone {
+		if code, _ := cfg().MatchPairingCode(b.Name, body); code != "" {
+			return LoginUpdate{Type: LoginUpdatePairingCode, PairingCode: code}
+		}
 
-				if err != nil {
-					log.Println("Error checking ongoing pattern:", err)
-					*ch <- nil
-				}
+		// Bridges that ask for the number after the login command
+		// get it as a reply.
+		if matchesPrompt, _ := cfg().CheckPhonePromptPattern(b.Name, body); matchesPrompt {
+			if err := b.startNewSession(login.PhoneNumber); err != nil {
+				log.Println("Error sending phone number:", err)
+				return LoginUpdate{Type: LoginUpdateFailed, Reason: "could not send the phone number to the bridge"}
+			}
+		}
+	}
 
-				if matchesOngoing {
-					time.Sleep(3 * time.Second)
-					sessions, _, err := clientDb.FetchActiveSessions(b.Client.UserID.Localpart())
-					if err != nil {
-						log.Println("Error fetching ongoing sessions:", err)
-						*ch <- nil
-					}
+	// The client is asked for what the bridge wants, answering with an
+	// input frame on the websocket, see WebsocketUnit.Answer.
+	if step, err := cfg().MatchLoginStep(b.Name, body); err != nil {
+		log.Println("Error matching login steps:", err)
+	} else if step != nil {
+		return LoginUpdate{Type: LoginUpdateInput, Input: step.Input, Secret: step.Secret, Message: body}
+	}
 
-					*ch <- sessions
-				}
-			}
+	return LoginUpdate{Type: LoginUpdateStatus, Message: body}
+}
 
-			// defer func() {
-			// 	for index, subscriber := range EventSubscribers {
-			// 		if subscriber.Name == eventSubName {
-			// 			EventSubscribers = append(EventSubscribers[:index], EventSubscribers[index+1:]...)
-			// 			break
-			// 		}
-			// 	}
-			// }()
-		},
+// sendLoginData hands data to the websocket waiting on ch, giving up when the
+// login is over or the process is shutting down so event processing can
+// drain.
+func sendLoginData(ch chan<- LoginUpdate, done <-chan struct{}, update LoginUpdate) {
+	select {
+	case ch <- update:
+	case <-done:
+	case <-GlobalShutdown.Context().Done():
 	}
-	EventSubscribers = append(EventSubscribers, eventSubscriber)
-	log.Println("Added event subscriber for:", eventSubscriber)
 }
 
 func (b *Bridges) startNewSession(cmd string) error {
@@ -163,70 +216,108 @@ func (b *Bridges) startNewSession(cmd string) error {
 	return nil
 }
 
-func (b *Bridges) checkActiveSessions() (bool, error) {
-	var clientDb = ClientDB{
-		username: b.Client.UserID.Localpart(),
-		filepath: "db/" + b.Client.UserID.Localpart() + ".db",
+// SendLoginInput answers the login step of the login running in the room of
+// b with input. Answers, codes included, are kept out of the logs, only the
+// input they answer is logged.
+func (b *Bridges) SendLoginInput(step *LoginStep, input string) error {
+	cmd, err := step.Render(input)
+	if err != nil {
+		return err
 	}
 
-	if err := clientDb.Init(); err != nil {
-		return false, err
+	log.Printf("[+] %sBridge| Sending %s to %v\n", b.Name, step.Input, b.RoomID)
+	if _, err := b.Client.SendText(context.Background(), b.RoomID, cmd); err != nil {
+		log.Println("Error sending message:", err)
+		return err
 	}
+	return nil
+}
 
-	activeSessions, _, err := clientDb.FetchActiveSessions(b.Client.UserID.Localpart())
-	if err != nil {
-		return false, err
+// CancelLogin tells the bridge to stop the login running in the room of b.
+func (b *Bridges) CancelLogin() error {
+	bridgeCfg, ok := cfg().GetBridgeConfig(b.Name)
+	if !ok {
+		return fmt.Errorf("bridge config not found for: %s", b.Name)
 	}
 
-	if len(activeSessions) == 0 {
-		return false, nil
+	cancelCmd, exists := bridgeCfg.Cmd["cancel"]
+	if !exists {
+		return fmt.Errorf("cancel command not found for: %s", b.Name)
 	}
 
-	return true, nil
+	return b.startNewSession(cancelCmd)
 }
 
-func (b *Bridges) AddDevice(ch *chan []byte) error {
+// AddDevice starts the device login loginID in the room of b, handing what
+// the bridge sends for it to ch until done is closed.
+func (b *Bridges) AddDevice(ch chan<- LoginUpdate, done <-chan struct{}, loginID string, login DeviceLogin) error {
 	log.Println("Getting configs for:", b.Name, b.RoomID)
-	bridgeCfg, ok := cfg.GetBridgeConfig(b.Name)
+	bridgeCfg, ok := cfg().GetBridgeConfig(b.Name)
 
 	if !ok {
 		return fmt.Errorf("bridge config not found for: %s", b.Name)
 	}
 
-	var clientDb = ClientDB{
-		username: b.Client.UserID.Localpart(),
-		filepath: "db/" + b.Client.UserID.Localpart() + ".db",
-	}
-
-	if err := clientDb.Init(); err != nil {
-		return err
-	}
-
 	loginCmd, exists := bridgeCfg.Cmd["login"]
+	if login.Method == LoginMethodPhone {
+		loginCmd, exists = bridgeCfg.Cmd["login_phone"]
+		if strings.Contains(loginCmd, "%s") {
+			loginCmd = fmt.Sprintf(loginCmd, login.PhoneNumber)
+		}
+	}
 	if !exists {
 		return fmt.Errorf("login command not found for: %s", b.Name)
 	}
 
-	b.processIncomingLoginMessages(ch)
+	b.processIncomingLoginMessages(ch, done, loginID, login)
 	log.Println("Processed incoming login messages for:", b.Name)
 
-	activeSessions, err := b.checkActiveSessions()
-	if err != nil {
-		log.Println("Failed checking active sessions", err)
+	if err := b.startNewSession(loginCmd); err != nil {
+		log.Println("Failed starting new session", err)
 		return err
 	}
 
-	if !activeSessions {
-		log.Println("No active sessions found, removing active sessions")
-		clientDb.RemoveActiveSessions(b.Client.UserID.Localpart())
-		err := b.startNewSession(loginCmd)
-		if err != nil {
-			log.Println("Failed starting new session", err)
-			return err
-		}
+	return nil
+}
+
+// loginRoomJoinTimeout bounds how long CreateLoginRoom waits for the bridge
+// bot to join.
+const loginRoomJoinTimeout = 30 * time.Second
+
+// CreateLoginRoom creates another direct room with the bridge bot for a login
+// to run in while the management room is busy with another one, returning
+// once the bot joined it.
+func (b *Bridges) CreateLoginRoom(ctx context.Context) (id.RoomID, error) {
+	log.Println("[+] Creating login room for:", b.BotName)
+	resp, err := b.Client.CreateRoom(ctx, &mautrix.ReqCreateRoom{
+		Invite:     []id.UserID{id.UserID(b.BotName)},
+		IsDirect:   true,
+		Preset:     "trusted_private_chat",
+		Visibility: "private",
+	})
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	ctx, cancel := context.WithTimeout(ctx, loginRoomJoinTimeout)
+	defer cancel()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		members, err := b.Client.JoinedMembers(ctx, resp.RoomID)
+		if err == nil {
+			if _, ok := members.Joined[id.UserID(b.BotName)]; ok {
+				return resp.RoomID, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("bridge bot did not join login room %s: %w", resp.RoomID, ctx.Err())
+		case <-ticker.C:
+		}
+	}
 }
 
 func (b *Bridges) JoinManagementRooms() error {
@@ -237,11 +328,11 @@ func (b *Bridges) JoinManagementRooms() error {
 		return err
 	}
 
-	var clientDb = ClientDB{
-		username: b.Client.UserID.Localpart(),
-		filepath: "db/" + b.Client.UserID.Localpart() + ".db",
+	clientDb, err := GlobalStorage.OpenClient(b.Client.UserID.Localpart())
+	if err != nil {
+		return err
 	}
-	clientDb.Init()
+	defer clientDb.Close()
 
 	for _, room := range joinedRooms.JoinedRooms {
 		room := Rooms{
@@ -283,10 +374,21 @@ func (b *Bridges) JoinManagementRooms() error {
 	return nil
 }
 
-func (b *Bridges) ListDevices() ([]string, error) {
-	log.Println("Listing devices for:", b.Name, b.RoomID)
-	ch := make(chan []string)
-	eventSubName := ReverseAliasForEventSubscriber(b.Client.UserID.Localpart(), b.Name, cfg.HomeServerDomain) + "+devices"
+// botRequests numbers the requests sent to the bridge bots, each waiting for
+// the reply on its own event subscriber.
+var botRequests atomic.Uint64
+
+// ErrDeviceListTimeout is returned when the bridge bot doesn't reply to the
+// devices command in time.
+var ErrDeviceListTimeout = errors.New("the bridge did not list the devices in time")
+
+// ask sends cmd into the management room and returns the first notice of the
+// bridge bot after it that reply accepts, waiting until ctx is done. reply may
+// be called concurrently and must not keep state.
+func (b *Bridges) ask(ctx context.Context, name, cmd string, reply func(evt *event.Event) bool) (*event.Event, error) {
+	ch := make(chan *event.Event, 1)
+	eventSubName := fmt.Sprintf("%s+%s:%d",
+		ReverseAliasForEventSubscriber(b.Client.UserID.Localpart(), b.Name, cfg().HomeServerDomain), name, botRequests.Add(1))
 	eventType := event.MsgNotice
 	eventSince := time.Now().UTC()
 	eventSubscriber := EventSubscriber{
@@ -294,63 +396,164 @@ func (b *Bridges) ListDevices() ([]string, error) {
 		MsgType: &eventType,
 		Since:   &eventSince,
 		RoomID:  b.RoomID,
-		Callback: func(event *event.Event) {
-			devicesRaw := strings.Split(event.Content.AsMessage().Body, "\n")
-			devices := make([]string, 0)
-			for _, device := range devicesRaw {
-				deviceName, err := ExtractBracketContent(device)
-				if err != nil {
-					log.Println("Failed extracting device name", err, device)
-					continue
-				}
-				devices = append(devices, deviceName)
+		Callback: func(evt *event.Event) {
+			// Other notices of the bot in the room are skipped.
+			if b.BotName != "" && evt.Sender != id.UserID(b.BotName) {
+				return
+			}
+			if !reply(evt) {
+				return
 			}
-			ch <- devices
+			select {
+			case ch <- evt:
+			default:
+			}
+		},
+	}
 
-			defer func() {
-				for index, subscriber := range EventSubscribers {
-					if subscriber.Name == eventSubName {
-						EventSubscribers = append(EventSubscribers[:index], EventSubscribers[index+1:]...)
-						break
-					}
-				}
-			}()
+	AddEventSubscriber(eventSubscriber)
+	defer RemoveEventSubscriber(eventSubName)
+	log.Println("Event subscriber name:", eventSubName)
+
+	if _, err := b.Client.SendText(ctx, b.RoomID, cmd); err != nil {
+		return nil, err
+	}
+
+	select {
+	case evt := <-ch:
+		return evt, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+const (
+	defaultBridgeCommandQuietPeriod = 3 * time.Second
+	defaultBridgeCommandTimeout     = 30 * time.Second
+)
+
+// BridgeReply is a notice the bridge bot sent in reply to a command.
+// @Description A notice of the bridge bot replying to a command
+// @name BridgeReply
+// @type object
+type BridgeReply struct {
+	EventID string    `json:"event_id" example:"$1234567890abcdef"`
+	Body    string    `json:"body" example:"Synced 12 chats"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// RunCommand sends cmd into the management room and collects the notices of
+// the bridge bot after it, until the bot stayed quiet for the quiet period
+// after its first reply or the timeout passed, which is reported. Replies are
+// seen through the sync loop of the user.
+func (b *Bridges) RunCommand(ctx context.Context, cmd string) ([]BridgeReply, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg().BridgeCommands.GetTimeout())
+	defer cancel()
+
+	ch := make(chan BridgeReply)
+	eventSubName := fmt.Sprintf("%s+command:%d",
+		ReverseAliasForEventSubscriber(b.Client.UserID.Localpart(), b.Name, cfg().HomeServerDomain), botRequests.Add(1))
+	eventType := event.MsgNotice
+	eventSince := time.Now().UTC()
+	eventSubscriber := EventSubscriber{
+		Name:    eventSubName,
+		MsgType: &eventType,
+		Since:   &eventSince,
+		RoomID:  b.RoomID,
+		Callback: func(evt *event.Event) {
+			if evt.Sender != id.UserID(b.BotName) {
+				return
+			}
+			reply := BridgeReply{
+				EventID: evt.ID.String(),
+				Body:    evt.Content.AsMessage().Body,
+				SentAt:  time.UnixMilli(evt.Timestamp).UTC(),
+			}
+			select {
+			case ch <- reply:
+			case <-ctx.Done():
+			}
 		},
 	}
 
-	EventSubscribers = append(EventSubscribers, eventSubscriber)
+	AddEventSubscriber(eventSubscriber)
+	defer RemoveEventSubscriber(eventSubName)
+
+	if _, err := b.Client.SendText(ctx, b.RoomID, cmd); err != nil {
+		return nil, false, err
+	}
 
-	bridgeCfg, ok := cfg.GetBridgeConfig(b.Name)
+	replies := make([]BridgeReply, 0)
+	// Armed by the first reply, the bot may take a while to start.
+	var quiet <-chan time.Time
+	for {
+		select {
+		case reply := <-ch:
+			replies = append(replies, reply)
+			quiet = time.After(cfg().BridgeCommands.GetQuietPeriod())
+		case <-quiet:
+			return sortBridgeReplies(replies), false, nil
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return sortBridgeReplies(replies), true, nil
+			}
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// sortBridgeReplies orders replies as the bot sent them, they are handed over
+// concurrently.
+func sortBridgeReplies(replies []BridgeReply) []BridgeReply {
+	slices.SortStableFunc(replies, func(a, b BridgeReply) int {
+		return a.SentAt.Compare(b.SentAt)
+	})
+	return replies
+}
+
+// ListDevices asks the bridge for the devices the user linked, waiting for the
+// reply until ctx is done or the timeout configured for the bridge passed. A
+// user without logins gets an empty list.
+func (b *Bridges) ListDevices(ctx context.Context) ([]Device, error) {
+	log.Println("Listing devices for:", b.Name, b.RoomID)
+	bridgeCfg, ok := cfg().GetBridgeConfig(b.Name)
 	if !ok {
 		return nil, fmt.Errorf("bridge config not found for: %s", b.Name)
 	}
-	log.Println("Event subscriber name:", eventSubName)
 
-	_, err := b.Client.SendText(
-		context.Background(),
-		b.RoomID,
-		bridgeCfg.Cmd["devices"],
-	)
+	devicesCmd, exists := bridgeCfg.Cmd["devices"]
+	if !exists {
+		return nil, fmt.Errorf("devices command not found for: %s", b.Name)
+	}
+	// A broken pattern would never match the reply.
+	if _, _, err := cfg().ParseDeviceList(b.Name, ""); err != nil {
+		return nil, err
+	}
 
+	ctx, cancel := context.WithTimeout(ctx, bridgeCfg.DeviceList.GetTimeout())
+	defer cancel()
+
+	// The reply is the first device list the bridge bot sends after the
+	// command.
+	evt, err := b.ask(ctx, "devices", devicesCmd, func(evt *event.Event) bool {
+		_, ok, err := cfg().ParseDeviceList(b.Name, evt.Content.AsMessage().Body)
+		return err == nil && ok
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrDeviceListTimeout
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	devices := <-ch
-
-	return devices, nil
+	devices, _, err := cfg().ParseDeviceList(b.Name, evt.Content.AsMessage().Body)
+	return devices, err
 }
 
 func (b *Bridges) CreateContactRooms() error {
 	log.Println("Joining member rooms for:", b.Name)
 
-	clientDb := ClientDB{
-		username: b.Client.UserID.Localpart(),
-		filepath: "db/" + b.Client.UserID.Localpart() + ".db",
-	}
-	clientDb.Init()
-
-	eventSubName := ReverseAliasForEventSubscriber(b.Client.UserID.Localpart(), b.Name, cfg.HomeServerDomain)
+	eventSubName := ReverseAliasForEventSubscriber(b.Client.UserID.Localpart(), b.Name, cfg().HomeServerDomain)
 	eventSubName = eventSubName + "+join"
 
 	processedRooms := make(map[id.RoomID]bool)
@@ -409,7 +612,7 @@ func (b *Bridges) CreateContactRooms() error {
 
 					for _, member := range members {
 						log.Println("Checking member:", member.String())
-						matched, err := cfg.CheckUsernameTemplate(b.Name, member.String())
+						matched, err := cfg().CheckUsernameTemplate(b.Name, member.String())
 						if err != nil {
 							log.Println("Failed checking username template", err)
 							return
@@ -418,13 +621,23 @@ func (b *Bridges) CreateContactRooms() error {
 							continue
 						}
 
-						devices := ClientDevices[b.Client.UserID.Localpart()][b.Name]
+						clientDb, err := GlobalStorage.OpenClient(b.Client.UserID.Localpart())
+						if err != nil {
+							log.Println("Error opening client db:", err)
+							return
+						}
+						devices, err := clientDb.FetchDevices(b.Name)
+						clientDb.Close()
+						if err != nil {
+							log.Println("Failed fetching devices", err)
+							return
+						}
 						log.Println("Devices:", devices)
 
 						for _, device := range devices {
-							formattedUsername, err := cfg.FormatUsername(b.Name, device)
+							formattedUsername, err := cfg().FormatUsername(b.Name, device.Handle)
 							if err != nil {
-								log.Println("Failed formatting username", err, device)
+								log.Println("Failed formatting username", err, device.Handle)
 								continue
 							}
 							if member.String() == formattedUsername {
@@ -444,6 +657,13 @@ func (b *Bridges) CreateContactRooms() error {
 					}
 
 					if foundDevice && len(foundMembers) > 0 {
+						clientDb, err := GlobalStorage.OpenClient(b.Client.UserID.Localpart())
+						if err != nil {
+							log.Println("Error opening client db:", err)
+							return
+						}
+						defer clientDb.Close()
+
 						for _, fMember := range foundMembers {
 							clientDb.StoreRooms(evt.RoomID.String(), b.Name, foundDeviceUserName, fMember, false)
 							// log.Println("Stored room:", event.RoomID.String(), b.Name, fMember, false, foundDeviceUserName)
@@ -454,7 +674,7 @@ func (b *Bridges) CreateContactRooms() error {
 		},
 	}
 
-	EventSubscribers = append(EventSubscribers, eventSubscriber)
+	AddEventSubscriber(eventSubscriber)
 
 	return nil
 }
@@ -462,9 +682,10 @@ func (b *Bridges) CreateContactRooms() error {
 func (b *Bridges) GetRoomInvitesDaemon() error {
 	log.Println("Getting room invites for:", b.Name, b.RoomID)
 
-	resp, err := b.Client.SyncRequest(context.Background(), 30000, "", "", true, event.PresenceOnline)
+	resp, err := b.Client.SyncRequest(GlobalShutdown.Context(), 30000, "", "", true, event.PresenceOnline)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Failed fetching room invites", err)
+		return err
 	}
 
 	for roomID := range resp.Rooms.Invite {
@@ -475,7 +696,7 @@ func (b *Bridges) GetRoomInvitesDaemon() error {
 		}
 	}
 
-	eventSubName := ReverseAliasForEventSubscriber(b.Client.UserID.Localpart(), b.Name, cfg.HomeServerDomain) + "+invites"
+	eventSubName := ReverseAliasForEventSubscriber(b.Client.UserID.Localpart(), b.Name, cfg().HomeServerDomain) + "+invites"
 	eventSubscriber := EventSubscriber{
 		Name:    eventSubName,
 		MsgType: nil,
@@ -489,7 +710,7 @@ func (b *Bridges) GetRoomInvitesDaemon() error {
 		},
 	}
 
-	EventSubscribers = append(EventSubscribers, eventSubscriber)
+	AddEventSubscriber(eventSubscriber)
 
 	return nil
 }
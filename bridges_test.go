@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestBridgeRunCommand(t *testing.T) {
+	useTestConfig(t, &Conf{
+		HomeServerDomain: "example.org",
+		BridgeCommands:   BridgeCommands{QuietPeriod: 100 * time.Millisecond, Timeout: time.Second},
+	})
+
+	room := id.RoomID("!management:example.org")
+	bot := id.UserID("@whatsappbot:example.org")
+	now := time.Now().Add(time.Second)
+	notice := func(sender id.UserID, body string, at time.Time) *event.Event {
+		return &event.Event{
+			ID:        id.EventID("$" + body),
+			Sender:    sender,
+			RoomID:    room,
+			Type:      event.EventMessage,
+			Timestamp: at.UnixMilli(),
+			Content:   event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgNotice, Body: body}},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		replies      []*event.Event
+		want         []string
+		wantTimedOut bool
+	}{
+		{
+			"Replies until quiet",
+			[]*event.Event{
+				notice("@alice:example.org", "not the bot", now),
+				notice(bot, "second", now.Add(time.Second)),
+				notice(bot, "first", now),
+			},
+			[]string{"first", "second"},
+			false,
+		},
+		{"No reply", nil, []string{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The bot replies once the command reached the homeserver.
+			homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				go func() {
+					for _, reply := range tt.replies {
+						(&MatrixClient{}).processIncomingEvents(reply)
+					}
+				}()
+				w.Write([]byte(`{"event_id":"$command"}`))
+			}))
+			defer homeserver.Close()
+
+			client, err := mautrix.NewClient(homeserver.URL, id.NewUserID("alice", "example.org"), "token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bridge := &Bridges{Name: "wa", BotName: bot.String(), RoomID: room, Client: client}
+
+			replies, timedOut, err := bridge.RunCommand(context.Background(), "!wa sync")
+			if err != nil {
+				t.Fatalf("RunCommand() error = %v", err)
+			}
+			bodies := []string{}
+			for _, reply := range replies {
+				bodies = append(bodies, reply.Body)
+			}
+			if !reflect.DeepEqual(bodies, tt.want) || timedOut != tt.wantTimedOut {
+				t.Errorf("RunCommand() = %v, %v, want %v, %v", bodies, timedOut, tt.want, tt.wantTimedOut)
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configFilepath = "conf.yaml"
+	// configPollInterval is how often the configuration file is checked for
+	// changes.
+	configPollInterval = 2 * time.Second
+)
+
+// restartOnlySettings are read once at startup, a reload keeps the values
+// the process runs with and logs that they need a restart.
+var restartOnlySettings = []string{
+	"server", "keystore_filepath", "homeserver", "homeserver_domain", "user",
+	"encryption", "secrets", "database", "rate_limits", "trusted_proxies",
+}
+
+// minAdminTokenLen is the shortest admin token of bridge_commands accepted.
+const minAdminTokenLen = 32
+
+// redactedSettings are logged without their values.
+var redactedSettings = []string{"password", "access_token", "pickle_key", "dsn", "admin_token"}
+
+// ConfigManager holds the configuration loaded from conf.yaml, swapped
+// atomically when the file changes or the process receives SIGHUP.
+type ConfigManager struct {
+	path    string
+	current atomic.Pointer[Conf]
+
+	// reloadMutex serializes reloads.
+	reloadMutex sync.Mutex
+	modTime     time.Time
+	size        int64
+	// loaded is the file as last loaded, before the restart-only settings
+	// are kept, so a change to them is only reported by the reload that
+	// reads it.
+	loaded *Conf
+}
+
+var GlobalConfig, cfgError = LoadConfig(configFilepath)
+
+// cfg is the configuration in effect, read it again rather than holding on to
+// it so reloads apply.
+func cfg() *Conf {
+	return GlobalConfig.Current()
+}
+
+// LoadConfig loads the configuration at path. The manager is returned with an
+// empty configuration along with the error when it can't be loaded.
+func LoadConfig(path string) (*ConfigManager, error) {
+	m := &ConfigManager{path: path}
+	m.current.Store(&Conf{})
+	m.loaded = &Conf{}
+
+	conf, err := m.read()
+	if err != nil {
+		return m, err
+	}
+	if err := conf.Validate(); err != nil {
+		return m, err
+	}
+	m.current.Store(conf)
+	m.loaded = conf
+	return m, nil
+}
+
+func (m *ConfigManager) Current() *Conf {
+	return m.current.Load()
+}
+
+// read parses the file, remembering its version for Watch.
+func (m *ConfigManager) read() (*Conf, error) {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return nil, err
+	}
+	yamlFile, err := os.ReadFile(m.path)
+	if err != nil {
+		return nil, err
+	}
+	m.modTime, m.size = info.ModTime(), info.Size()
+
+	conf := &Conf{}
+	if err := yaml.Unmarshal(yamlFile, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// Reload loads the file again and swaps it in once it is valid, keeping the
+// running configuration otherwise. Bridges it adds are followed for every
+// syncing user right away and the ones it removes stop being followed.
+func (m *ConfigManager) Reload() error {
+	m.reloadMutex.Lock()
+	defer m.reloadMutex.Unlock()
+
+	loaded, err := m.read()
+	if err != nil {
+		return err
+	}
+	if err := loaded.Validate(); err != nil {
+		return err
+	}
+
+	changes := DiffConfig(m.loaded, loaded)
+	if len(changes) == 0 {
+		log.Println("[+] Configuration reloaded, nothing changed")
+		return nil
+	}
+	m.loaded = loaded
+
+	running := m.Current()
+	conf := *loaded
+	keepRestartOnlySettings(&conf, running)
+	m.current.Store(&conf)
+	log.Println("[+] Configuration reloaded:")
+	for _, change := range changes {
+		log.Println("   ", change)
+	}
+
+	followChangedBridges(running, &conf)
+	return nil
+}
+
+// Watch reloads the configuration when its file changes or the process
+// receives SIGHUP, until ctx is done.
+func (m *ConfigManager) Watch(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			log.Println("[+] Received SIGHUP, reloading configuration")
+		case <-ticker.C:
+			if !m.changed() {
+				continue
+			}
+			log.Println("[+] Configuration file changed, reloading")
+		}
+
+		if err := m.Reload(); err != nil {
+			log.Println("Error reloading configuration, keeping the running one:", err)
+		}
+	}
+}
+
+func (m *ConfigManager) changed() bool {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return false
+	}
+
+	m.reloadMutex.Lock()
+	defer m.reloadMutex.Unlock()
+	return !info.ModTime().Equal(m.modTime) || info.Size() != m.size
+}
+
+// keepRestartOnlySettings copies the settings read once at startup from
+// running into conf.
+func keepRestartOnlySettings(conf, running *Conf) {
+	conf.Server = running.Server
+	conf.KeystoreFilepath = running.KeystoreFilepath
+	conf.HomeServer = running.HomeServer
+	conf.HomeServerDomain = running.HomeServerDomain
+	conf.User = running.User
+	conf.Encryption = running.Encryption
+	conf.Secrets = running.Secrets
+	conf.Database = running.Database
+	conf.RateLimits = running.RateLimits
+	conf.TrustedProxies = running.TrustedProxies
+}
+
+// followChangedBridges joins the management rooms of the bridges conf adds to
+// running for every syncing user and follows them like the sync loop does,
+// and stops following the ones it removes.
+func followChangedBridges(running, conf *Conf) {
+	added := bridgesMissingFrom(conf, running)
+	removed := bridgesMissingFrom(running, conf)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	syncLoopsMutex.Lock()
+	loops := make([]*syncLoop, 0, len(syncLoops))
+	for _, loop := range syncLoops {
+		loops = append(loops, loop)
+	}
+	syncLoopsMutex.Unlock()
+
+	for _, loop := range loops {
+		for _, name := range removed {
+			log.Println("[+] Unfollowing removed bridge:", name, loop.client.UserID)
+			loop.unfollow(name)
+		}
+		for _, name := range added {
+			bridgeCfg, _ := conf.GetBridgeConfig(name)
+			bridge := &Bridges{
+				Name:    name,
+				Client:  loop.client,
+				BotName: bridgeCfg.BotName,
+			}
+			GlobalShutdown.Go(func() {
+				if err := bridge.JoinManagementRooms(); err != nil {
+					log.Println("Error joining management room of added bridge:", err, name)
+					return
+				}
+				log.Println("[+] Following added bridge:", name, loop.client.UserID)
+				loop.follow(bridge)
+			})
+		}
+	}
+}
+
+// bridgesMissingFrom lists the bridges of conf that other doesn't configure.
+func bridgesMissingFrom(conf, other *Conf) []string {
+	var missing []string
+	for _, entry := range conf.Bridges {
+		for name := range entry {
+			if _, ok := other.GetBridgeConfig(name); !ok {
+				missing = append(missing, name)
+			}
+		}
+	}
+	return missing
+}
+
+// Validate checks every bridge is named like a platform, has a bot and that
+// its patterns, login steps and templates compile. The patterns are kept
+// compiled for the matchers to reuse.
+func (c *Conf) Validate() error {
+	c.patterns = &patternCache{}
+
+	var errs []error
+	seen := make(map[string]bool)
+	for _, entry := range c.Bridges {
+		for name, config := range entry {
+			if seen[name] {
+				errs = append(errs, fmt.Errorf("bridge %s is configured twice", name))
+				continue
+			}
+			seen[name] = true
+			if err := c.validateBridge(name, config); err != nil {
+				errs = append(errs, fmt.Errorf("bridge %s: %w", name, err))
+			}
+		}
+	}
+
+	if token := c.BridgeCommands.AdminToken; token != "" && len(token) < minAdminTokenLen {
+		errs = append(errs, fmt.Errorf("bridge_commands admin_token must be at least %d characters", minAdminTokenLen))
+	}
+
+	for _, webhook := range c.BridgeHealth.Webhooks {
+		if parsed, err := url.Parse(webhook.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("bridge_health webhook %q must be an http or https URL", webhook.URL))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Conf) validateBridge(name string, config BridgeConfig) error {
+	if platform, err := sanitizePlatform(name); err != nil || platform != name {
+		return fmt.Errorf("name must be 2-20 lowercase letters and numbers")
+	}
+	if config.BotName == "" {
+		return fmt.Errorf("botname is required")
+	}
+
+	// The cmd entries read as patterns, checked against an empty notice.
+	patterns := map[string]func() error{
+		"success":      func() error { _, _, err := c.MatchSuccessPattern(name, ""); return err },
+		"pairing_code": func() error { _, err := c.MatchPairingCode(name, ""); return err },
+		"timeout":      func() error { _, err := c.CheckTimeoutPattern(name, ""); return err },
+		"scanned":      func() error { _, err := c.CheckScannedPattern(name, ""); return err },
+		"phone_prompt": func() error { _, err := c.CheckPhonePromptPattern(name, ""); return err },
+		"ping_reply":   func() error { _, err := c.CheckPingReplyPattern(name, ""); return err },
+	}
+	for _, key := range sortedKeys(patterns) {
+		if _, ok := config.Cmd[key]; !ok {
+			continue
+		}
+		if err := patterns[key](); err != nil {
+			return fmt.Errorf("cmd %s: %w", key, err)
+		}
+	}
+
+	if _, _, err := c.ParseDeviceList(name, ""); err != nil {
+		return err
+	}
+	if _, _, _, err := c.MatchStateNotice(name, ""); err != nil {
+		return err
+	}
+	if config.UsernameTemplate != "" {
+		if _, err := c.CheckUsernameTemplate(name, ""); err != nil {
+			return err
+		}
+	}
+	for _, step := range config.LoginSteps {
+		if step.Input == "" {
+			return fmt.Errorf("login step %q has no input", step.Prompt)
+		}
+		if _, err := c.compilePattern(step.Prompt); err != nil {
+			return fmt.Errorf("error compiling pattern of login step %s: %w", step.Input, err)
+		}
+		if _, err := step.Render(""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiffConfig lists the settings that differ between running and conf, one
+// "path: old -> new" line each, noting the ones that need a restart.
+func DiffConfig(running, conf *Conf) []string {
+	before := make(map[string]string)
+	after := make(map[string]string)
+	flattenConfig("", reflect.ValueOf(*running), before)
+	flattenConfig("", reflect.ValueOf(*conf), after)
+
+	paths := sortedKeys(before)
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var changes []string
+	for _, path := range paths {
+		old, hadOld := before[path]
+		value, hasValue := after[path]
+		if hadOld && hasValue && old == value {
+			continue
+		}
+		if slices.ContainsFunc(redactedSettings, func(setting string) bool { return strings.HasSuffix(path, "."+setting) }) {
+			old, value = "<redacted>", "<redacted>"
+		}
+
+		var change string
+		switch {
+		case !hadOld:
+			change = fmt.Sprintf("%s: added %s", path, value)
+		case !hasValue:
+			change = fmt.Sprintf("%s: removed %s", path, old)
+		default:
+			change = fmt.Sprintf("%s: %s -> %s", path, old, value)
+		}
+		if slices.ContainsFunc(restartOnlySettings, func(setting string) bool {
+			return path == setting || strings.HasPrefix(path, setting+".")
+		}) {
+			change += " (needs a restart)"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// flattenConfig records every setting under v by its yaml path, bridges by
+// their name rather than their position in the list. Settings left unset are
+// skipped.
+func flattenConfig(path string, v reflect.Value, out map[string]string) {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+
+	if duration, ok := v.Interface().(time.Duration); ok {
+		if duration != 0 {
+			out[path] = duration.String()
+		}
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			flattenConfig(join(name), v.Field(i), out)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			flattenConfig(join(key.String()), v.MapIndex(key), out)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if v.Index(i).Kind() == reflect.Map {
+				flattenConfig(path, v.Index(i), out)
+				continue
+			}
+			flattenConfig(fmt.Sprintf("%s[%d]", path, i), v.Index(i), out)
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			flattenConfig(path, v.Elem(), out)
+		}
+	default:
+		if !v.IsZero() {
+			out[path] = fmt.Sprintf("%q", fmt.Sprint(v.Interface()))
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+// useTestConfig runs the test with conf as the configuration in effect.
+func useTestConfig(t *testing.T, conf *Conf) {
+	t.Helper()
+	previous := GlobalConfig.Current()
+	GlobalConfig.current.Store(conf)
+	t.Cleanup(func() { GlobalConfig.current.Store(previous) })
+}
+
+func TestConfigValidate(t *testing.T) {
+	bridge := func(config BridgeConfig) *Conf {
+		if config.BotName == "" {
+			config.BotName = "@whatsappbot:example.org"
+		}
+		return &Conf{Bridges: []map[string]BridgeConfig{{"wa": config}}}
+	}
+
+	tests := []struct {
+		name        string
+		conf        *Conf
+		expectError bool
+	}{
+		{"Empty", &Conf{}, false},
+		{"Valid bridge", bridge(BridgeConfig{Cmd: map[string]string{"login": "login", "success": "^Logged in as %s", "ping_reply": "^pong"}}), false},
+		{"Invalid name", &Conf{Bridges: []map[string]BridgeConfig{{"What's App": {BotName: "@whatsappbot:example.org"}}}}, true},
+		{"Duplicate bridge", &Conf{Bridges: []map[string]BridgeConfig{{"wa": {BotName: "@a:example.org"}}, {"wa": {BotName: "@b:example.org"}}}}, true},
+		{"No bot", &Conf{Bridges: []map[string]BridgeConfig{{"wa": {}}}}, true},
+		{"Broken pattern", bridge(BridgeConfig{Cmd: map[string]string{"scanned": "("}}), true},
+		{"Broken device pattern", bridge(BridgeConfig{DeviceList: DeviceList{Pattern: "("}}), true},
+		{"Login step without input", bridge(BridgeConfig{LoginSteps: []LoginStep{{Prompt: "^code"}}}), true},
+		{"Broken login step prompt", bridge(BridgeConfig{LoginSteps: []LoginStep{{Prompt: "^code", Input: "code"}, {Prompt: "(", Input: "password"}}}), true},
+		{"Broken login step command", bridge(BridgeConfig{LoginSteps: []LoginStep{{Prompt: "^code", Input: "code", Command: "{{"}}}), true},
+		{"Webhook without scheme", &Conf{BridgeHealth: BridgeHealthConfig{Webhooks: []AlertWebhook{{URL: "alerts.example.org"}}}}, true},
+		{"Short admin token", &Conf{BridgeCommands: BridgeCommands{AdminToken: "secret"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.conf.Validate(); (err != nil) != tt.expectError {
+				t.Errorf("Validate() error = %v, expectError %v", err, tt.expectError)
+			}
+		})
+	}
+}
+
+func TestConfigValidateCompilesPatterns(t *testing.T) {
+	conf := &Conf{Bridges: []map[string]BridgeConfig{{"wa": {
+		BotName:    "@whatsappbot:example.org",
+		Cmd:        map[string]string{"ping_reply": "^pong", "success": "^Logged in as %s"},
+		LoginSteps: []LoginStep{{Prompt: "^Please enter the code", Input: "code"}},
+	}}}}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	for _, expr := range []string{"^pong", `^Logged in as (\S+)`, "^Please enter the code", defaultDeviceListPattern, defaultDeviceListEmpty} {
+		compiled, ok := conf.patterns.compiled.Load(expr)
+		if !ok {
+			t.Errorf("pattern %q was not compiled by Validate()", expr)
+			continue
+		}
+		if pattern, _ := conf.compilePattern(expr); pattern != compiled {
+			t.Errorf("pattern %q was compiled again", expr)
+		}
+	}
+
+	if matched, err := conf.CheckPingReplyPattern("wa", "pong"); err != nil || !matched {
+		t.Errorf("CheckPingReplyPattern() = %v, %v, want a match", matched, err)
+	}
+}
+
+func TestConfigManagerReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conf.yaml")
+	write := func(yaml string) {
+		if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`
+server:
+  host: 127.0.0.1
+user:
+  password: hunter2
+bridges:
+  - wa:
+      botname: "@whatsappbot:example.org"
+      cmd:
+        login: login qr
+`)
+	manager, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	updated := `
+server:
+  host: 0.0.0.0
+user:
+  password: hunter3
+bridge_health:
+  interval: 30s
+bridges:
+  - wa:
+      botname: "@whatsappbot:example.org"
+      cmd:
+        login: login phone
+  - signal:
+      botname: "@signalbot:example.org"
+`
+	wantChanges := []string{
+		`bridge_health.interval: added 30s`,
+		`bridges.signal.botname: added "@signalbot:example.org"`,
+		`bridges.wa.cmd.login: "login qr" -> "login phone"`,
+		`server.host: "127.0.0.1" -> "0.0.0.0" (needs a restart)`,
+		`user.password: <redacted> -> <redacted> (needs a restart)`,
+	}
+	running := manager.Current()
+	write(updated)
+	conf, err := manager.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := DiffConfig(running, conf); !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("DiffConfig() = %q, want %q", changes, wantChanges)
+	}
+
+	if err := manager.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	current := manager.Current()
+	if _, ok := current.GetBridgeConfig("signal"); !ok {
+		t.Error("added bridge is not configured")
+	}
+	if bridgeCfg, _ := current.GetBridgeConfig("wa"); bridgeCfg.Cmd["login"] != "login phone" {
+		t.Errorf("login command = %q, want %q", bridgeCfg.Cmd["login"], "login phone")
+	}
+	if current.BridgeHealth.Interval != 30*time.Second {
+		t.Errorf("bridge health interval = %v, want 30s", current.BridgeHealth.Interval)
+	}
+	if current.Server.Host != "127.0.0.1" || current.User.Password != "hunter2" {
+		t.Errorf("restart only settings changed to %+v, %+v", current.Server, current.User)
+	}
+
+	// Later reloads are compared with the file, so the restart-only changes
+	// it already had are not reported again.
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	write(strings.Replace(updated, "interval: 30s", "interval: 1m", 1))
+	if err := manager.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	log.SetOutput(os.Stderr)
+	if !strings.Contains(logged.String(), "bridge_health.interval: 30s -> 1m0s") || strings.Contains(logged.String(), "needs a restart") {
+		t.Errorf("second Reload() logged %q, want only the interval change", logged.String())
+	}
+	current = manager.Current()
+	if current.Server.Host != "127.0.0.1" {
+		t.Errorf("restart only setting changed to %q by a later reload", current.Server.Host)
+	}
+
+	write(`
+bridges:
+  - wa:
+      cmd:
+        login: login qr
+`)
+	if err := manager.Reload(); err == nil {
+		t.Error("Reload() of an invalid configuration succeeded")
+	}
+	if manager.Current() != current {
+		t.Error("invalid configuration was swapped in")
+	}
+}
+
+func TestFollowChangedBridges(t *testing.T) {
+	running := &Conf{HomeServerDomain: "example.org", Bridges: []map[string]BridgeConfig{
+		{"wa": {BotName: "@whatsappbot:example.org"}},
+		{"signal": {BotName: "@signalbot:example.org"}},
+	}}
+	conf := *running
+	conf.Bridges = running.Bridges[:1]
+	useTestConfig(t, &conf)
+
+	client, err := mautrix.NewClient("http://localhost", "@erin:example.org", "syt_erin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loop := newSyncLoop(ctx, cancel, client)
+	waCtx, waCancel := context.WithCancel(ctx)
+	signalCtx, signalCancel := context.WithCancel(ctx)
+	loop.bridges["wa"] = waCancel
+	loop.bridges["signal"] = signalCancel
+
+	syncLoopsMutex.Lock()
+	syncLoops["erin"] = loop
+	syncLoopsMutex.Unlock()
+	defer StopSync("erin")
+
+	for _, name := range []string{"wa", "signal"} {
+		AddEventSubscriber(EventSubscriber{Name: ReverseAliasForEventSubscriber("erin", name, "example.org") + "+invites"})
+	}
+
+	followChangedBridges(running, &conf)
+
+	if signalCtx.Err() == nil {
+		t.Error("the removed bridge is still followed")
+	}
+	if waCtx.Err() != nil {
+		t.Error("the kept bridge stopped being followed")
+	}
+	var names []string
+	for _, subscriber := range eventSubscribers() {
+		if strings.HasPrefix(subscriber.Name, "@erin:") {
+			names = append(names, subscriber.Name)
+		}
+	}
+	if want := []string{"@erin:wa:example.org+invites"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("subscribers = %q, want %q", names, want)
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,8 +16,89 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
-var syncingUsers = make(map[string][]string)
-var ClientDevices = make(map[string]map[string][]string)
+// syncingUsers holds the bridges followed for each user that syncs.
+var (
+	syncingUsersMutex sync.Mutex
+	syncingUsers      = make(map[string][]string)
+)
+
+// claimSyncingUser marks username as syncing, false when it already follows
+// bridges.
+func claimSyncingUser(username string) bool {
+	syncingUsersMutex.Lock()
+	defer syncingUsersMutex.Unlock()
+
+	if len(syncingUsers[username]) > 0 {
+		return false
+	}
+	syncingUsers[username] = []string{}
+	return true
+}
+
+func addSyncingBridge(username, bridgeName string) {
+	syncingUsersMutex.Lock()
+	defer syncingUsersMutex.Unlock()
+	syncingUsers[username] = append(syncingUsers[username], bridgeName)
+}
+
+func forgetSyncingUser(username string) {
+	syncingUsersMutex.Lock()
+	defer syncingUsersMutex.Unlock()
+	delete(syncingUsers, username)
+}
+
+// syncLoop is the sync loop of a user, what stops it and the client bridges
+// added to the configuration are followed with.
+type syncLoop struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	client *mautrix.Client
+
+	// bridges stops following each bridge, when the configuration removes
+	// it.
+	bridgesMutex sync.Mutex
+	bridges      map[string]context.CancelFunc
+}
+
+func newSyncLoop(ctx context.Context, cancel context.CancelFunc, client *mautrix.Client) *syncLoop {
+	return &syncLoop{ctx: ctx, cancel: cancel, client: client, bridges: make(map[string]context.CancelFunc)}
+}
+
+// follow follows bridge until the loop stops or unfollow is called for it.
+func (loop *syncLoop) follow(bridge *Bridges) {
+	ctx, cancel := context.WithCancel(loop.ctx)
+
+	loop.bridgesMutex.Lock()
+	if previous, ok := loop.bridges[bridge.Name]; ok {
+		previous()
+	}
+	loop.bridges[bridge.Name] = cancel
+	loop.bridgesMutex.Unlock()
+
+	followBridge(ctx, bridge)
+}
+
+// unfollow stops the daemons following the bridge and drops its event
+// subscribers.
+func (loop *syncLoop) unfollow(name string) {
+	loop.bridgesMutex.Lock()
+	if cancel, ok := loop.bridges[name]; ok {
+		cancel()
+		delete(loop.bridges, name)
+	}
+	loop.bridgesMutex.Unlock()
+
+	prefix := ReverseAliasForEventSubscriber(loop.client.UserID.Localpart(), name, cfg().HomeServerDomain)
+	removeEventSubscribers(func(subscriber EventSubscriber) bool {
+		return strings.HasPrefix(subscriber.Name, prefix)
+	})
+}
+
+// syncLoops holds the sync loop of each user, see StopSync.
+var (
+	syncLoopsMutex sync.Mutex
+	syncLoops      = make(map[string]*syncLoop)
+)
 
 type EventSubscriber struct {
 	Name            string
@@ -25,7 +110,56 @@ type EventSubscriber struct {
 	RoomID          id.RoomID
 }
 
-var EventSubscribers = make([]EventSubscriber, 0)
+// EventSubscribers is replaced rather than modified, under
+// eventSubscribersMutex, so the sync loops can range over a snapshot while
+// subscribers come and go.
+var (
+	eventSubscribersMutex sync.RWMutex
+	EventSubscribers      = make([]EventSubscriber, 0)
+)
+
+// eventSubscribers returns the subscribers at this moment.
+func eventSubscribers() []EventSubscriber {
+	eventSubscribersMutex.RLock()
+	defer eventSubscribersMutex.RUnlock()
+	return EventSubscribers
+}
+
+// AddEventSubscriber registers subscriber, false when one of the same name
+// already is.
+func AddEventSubscriber(subscriber EventSubscriber) bool {
+	eventSubscribersMutex.Lock()
+	defer eventSubscribersMutex.Unlock()
+
+	for _, existing := range EventSubscribers {
+		if existing.Name == subscriber.Name {
+			return false
+		}
+	}
+	subscribers := make([]EventSubscriber, 0, len(EventSubscribers)+1)
+	EventSubscribers = append(append(subscribers, EventSubscribers...), subscriber)
+	return true
+}
+
+// removeEventSubscribers drops the subscribers remove matches.
+func removeEventSubscribers(remove func(EventSubscriber) bool) {
+	eventSubscribersMutex.Lock()
+	defer eventSubscribersMutex.Unlock()
+
+	subscribers := make([]EventSubscriber, 0, len(EventSubscribers))
+	for _, subscriber := range EventSubscribers {
+		if !remove(subscriber) {
+			subscribers = append(subscribers, subscriber)
+		}
+	}
+	EventSubscribers = subscribers
+}
+
+func RemoveEventSubscriber(name string) {
+	removeEventSubscribers(func(subscriber EventSubscriber) bool {
+		return subscriber.Name == name
+	})
+}
 
 type Controller struct {
 	Client   *mautrix.Client
@@ -41,23 +175,23 @@ type UserSync struct {
 	SyncMutex    sync.Mutex
 }
 
-var cfg, cfgError = (&Conf{}).getConf()
-
 var GlobalWebsocketConnection = WebsocketController{
 	Registry: make([]*WebsocketUnit, 0),
 }
 
 var GlobalController = Controller{
 	Client: &mautrix.Client{
-		UserID:      id.NewUserID(cfg.User.Username, cfg.HomeServerDomain),
-		AccessToken: cfg.User.AccessToken,
+		UserID:      id.NewUserID(cfg().User.Username, cfg().HomeServerDomain),
+		AccessToken: cfg().User.AccessToken,
 	},
-	Username: cfg.User.Username,
+	Username: cfg().User.Username,
 }
 
-var ks = Keystore{
-	filepath: cfg.KeystoreFilepath,
-}
+var GlobalStorage Storage
+
+// ErrStorageUnavailable is returned when no storage was opened, like in a
+// process that failed to start it.
+var ErrStorageUnavailable = errors.New("storage is not available")
 
 func (c *Controller) CreateProcess(password string) error {
 	m := MatrixClient{
@@ -69,7 +203,7 @@ func (c *Controller) CreateProcess(password string) error {
 		return err
 	}
 
-	m.Client.UserID = id.NewUserID(c.Username, cfg.HomeServerDomain)
+	m.Client.UserID = id.NewUserID(c.Username, cfg().HomeServerDomain)
 	m.Client.AccessToken = accessToken
 	log.Println("[+] Created user: ", c.Username)
 
@@ -81,6 +215,10 @@ func (c *Controller) CreateProcess(password string) error {
 }
 
 func (c *Controller) LoginProcess(password string) error {
+	if GlobalStorage == nil {
+		return ErrStorageUnavailable
+	}
+
 	m := MatrixClient{
 		Client: c.Client,
 	}
@@ -95,7 +233,7 @@ func (c *Controller) LoginProcess(password string) error {
 		}
 	}
 
-	m.Client.UserID = id.NewUserID(c.Username, cfg.HomeServerDomain)
+	m.Client.UserID = id.NewUserID(c.Username, cfg().HomeServerDomain)
 	m.Client.AccessToken = accessToken
 	err = m.ProcessActiveSessions(password)
 	if err != nil {
@@ -105,18 +243,60 @@ func (c *Controller) LoginProcess(password string) error {
 	return nil
 }
 
-func (c *Controller) SendMessage(username, message, contact, platform, deviceName string, fileData []byte) error {
-	formattedUsername, err := cfg.FormatUsername(platform, contact)
+// LogoutProcess invalidates accessToken, or every token of the user with all.
+// When it is the token the user syncs with, it is also dropped from storage
+// and the sync loop and websockets running on it are stopped.
+func (c *Controller) LogoutProcess(ctx context.Context, accessToken string, all bool) error {
+	if err := Logout(ctx, c.Client, all); err != nil {
+		return err
+	}
+	GlobalAccessTokenCache.ForgetUser(c.Username)
+
+	user, err := GlobalStorage.Keystore().FetchUser(c.Username)
 	if err != nil {
 		return err
 	}
 
-	clientDb := ClientDB{
-		username: username,
-		filepath: "db/" + username + ".db",
+	if all || subtle.ConstantTimeCompare([]byte(user.AccessToken), []byte(accessToken)) == 1 {
+		if err := GlobalStorage.Keystore().RemoveAccessToken(c.Username); err != nil {
+			return err
+		}
+		StopSync(c.Username)
+		GlobalWebsocketConnection.CloseUser(c.Username, "logged out")
+	}
+
+	clientDb, err := GlobalStorage.OpenClient(c.Username)
+	if err != nil {
+		return err
+	}
+	defer clientDb.Close()
+
+	stored, err := clientDb.Fetch()
+	if err != nil {
+		return err
+	}
+
+	if all || subtle.ConstantTimeCompare([]byte(stored), []byte(accessToken)) == 1 {
+		if err := clientDb.RemoveAccessToken(c.Username); err != nil {
+			return err
+		}
+	}
+
+	log.Println("[+] Logged out:", c.Username)
+	return nil
+}
+
+func (c *Controller) SendMessage(username, message, contact, platform, deviceName string, fileData []byte) error {
+	formattedUsername, err := cfg().FormatUsername(platform, contact)
+	if err != nil {
+		return err
 	}
 
-	clientDb.Init()
+	clientDb, err := GlobalStorage.OpenClient(username)
+	if err != nil {
+		return err
+	}
+	defer clientDb.Close()
 
 	rooms, err := clientDb.FetchRoomsByMembers(formattedUsername)
 	if err != nil {
@@ -136,27 +316,59 @@ func (c *Controller) SendMessage(username, message, contact, platform, deviceNam
 	}
 
 	room := rooms[0]
+
+	// Encrypted rooms can only be written to through the syncing client that
+	// owns the user's crypto machine.
+	client := c.Client
+	if encryptedClient, ok := GlobalEncryptedClients.Get(username); ok {
+		client = encryptedClient
+	}
+
 	if fileData != nil {
-		uploadResp, err := c.Client.UploadBytesWithName(
-			context.Background(),
-			fileData,
-			"application/pdf",
-			"shortmesh.pdf",
-		)
+		isEncrypted, err := IsRoomEncrypted(context.Background(), client, room.ID)
 		if err != nil {
 			return err
 		}
+
 		fileMsg := &event.MessageEventContent{
 			MsgType: event.MsgFile,
 			Body:    "body",
-			URL:     id.ContentURIString(uploadResp.ContentURI.String()),
 			Info: &event.FileInfo{
 				MimeType: "application/pdf",
 				Size:     len(fileData),
 			},
 			FileName: "shortmesh.pdf",
 		}
-		resp, err := c.Client.SendMessageEvent(
+
+		if isEncrypted {
+			ciphertext, file := EncryptAttachment(fileData)
+			uploadResp, err := client.UploadBytesWithName(
+				context.Background(),
+				ciphertext,
+				"application/octet-stream",
+				"shortmesh.pdf",
+			)
+			if err != nil {
+				return err
+			}
+			fileMsg.File = &event.EncryptedFileInfo{
+				EncryptedFile: *file,
+				URL:           uploadResp.ContentURI.CUString(),
+			}
+		} else {
+			uploadResp, err := client.UploadBytesWithName(
+				context.Background(),
+				fileData,
+				"application/pdf",
+				"shortmesh.pdf",
+			)
+			if err != nil {
+				return err
+			}
+			fileMsg.URL = id.ContentURIString(uploadResp.ContentURI.String())
+		}
+
+		resp, err := client.SendMessageEvent(
 			context.Background(),
 			room.ID,
 			event.EventMessage,
@@ -167,7 +379,7 @@ func (c *Controller) SendMessage(username, message, contact, platform, deviceNam
 		}
 		log.Println("Sent PDF to", room.ID, resp.EventID)
 	} else {
-		resp, err := c.Client.SendText(
+		resp, err := client.SendText(
 			context.Background(),
 			room.ID,
 			message,
@@ -181,60 +393,150 @@ func (c *Controller) SendMessage(username, message, contact, platform, deviceNam
 	return nil
 }
 
-func (c *Controller) ListDevices(username, platform string) ([]string, error) {
-	devices := ClientDevices[username][platform]
+// ListDevices returns the devices username linked on platform, as last
+// listed by the bridge.
+func (c *Controller) ListDevices(username, platform string) ([]Device, error) {
+	clientDb, err := GlobalStorage.OpenClient(username)
+	if err != nil {
+		return nil, err
+	}
+	defer clientDb.Close()
 
-	return devices, nil
+	return clientDb.FetchDevices(platform)
 }
 
-func (c *Controller) AddDevice(username, platform string) (string, error) {
-	websocketUrl := ""
-	if index := GetWebsocketIndex(username, platform); index > -1 {
-		websocketUrl = GlobalWebsocketConnection.Registry[index].Url
-	} else {
-		clientDb := ClientDB{
-			username: username,
-			filepath: "db/" + username + ".db",
+// AddDevice registers a new device login of username on platform, running
+// alongside the ones in progress. A phone number only has one login at a time,
+// adding it again returns the login in progress.
+func (c *Controller) AddDevice(username, platform string, login DeviceLogin) (*WebsocketUnit, error) {
+	if login.Method == LoginMethodPhone {
+		for _, unit := range GlobalWebsocketConnection.Logins(username, platform) {
+			if unit.Login == login {
+				return unit, nil
+			}
 		}
-		clientDb.Init()
+	}
 
-		bridges, err := clientDb.FetchBridgeRooms(username)
-		if err != nil {
-			return "", err
-		}
+	clientDb, err := GlobalStorage.OpenClient(username)
+	if err != nil {
+		return nil, err
+	}
+	defer clientDb.Close()
 
-		bridge := &Bridges{
-			Name:   platform,
-			Client: c.Client,
-		}
+	bridges, err := clientDb.FetchBridgeRooms(username)
+	if err != nil {
+		return nil, err
+	}
 
-		for _, _bridge := range bridges {
-			if _bridge.Name == platform {
-				bridge.RoomID = _bridge.RoomID
-				break
-			}
-		}
+	bridge := &Bridges{
+		Name:   platform,
+		Client: c.Client,
+	}
 
-		if bridge.RoomID == "" {
-			return "", fmt.Errorf("bridge room not found for: %s", platform)
+	for _, _bridge := range bridges {
+		if _bridge.Name == platform {
+			bridge.RoomID = _bridge.RoomID
+			bridge.BotName = _bridge.BotName
+			break
 		}
+	}
 
-		ws := Websockets{Bridge: bridge}
+	if bridge.RoomID == "" {
+		return nil, fmt.Errorf("bridge room not found for: %s", platform)
+	}
 
-		websocketUrl = ws.RegisterWebsocket(platform, username)
+	session, err := NewLoginSession(username, platform, login.Method, time.Now())
+	if err != nil {
+		return nil, err
 	}
+	if err := clientDb.CreateLoginSession(&session); err != nil {
+		return nil, err
+	}
+
+	unit := NewWebsocketUnit(bridge, platform, username, login, session)
+	GlobalWebsocketConnection.Register(unit)
+	GlobalShutdown.Go(unit.watch)
+	return unit, nil
+}
 
-	return websocketUrl, nil
+// CancelDeviceLogins cancels every device login of username on platform in
+// progress, returning the cancelled ones.
+func CancelDeviceLogins(username, platform string) []LoginStatus {
+	statuses := []LoginStatus{}
+	for _, unit := range GlobalWebsocketConnection.Logins(username, platform) {
+		unit.finish("cancelled by the user")
+		statuses = append(statuses, unit.Status())
+	}
+	return statuses
+}
+
+// CancelDeviceLogin cancels the device login of username on platform with id,
+// reporting false when it is not in progress.
+func CancelDeviceLogin(username, platform, id string) (LoginStatus, bool) {
+	unit := GlobalWebsocketConnection.LookupLogin(username, id)
+	if unit == nil || unit.PlatformName != platform {
+		return LoginStatus{}, false
+	}
+
+	unit.finish("cancelled by the user")
+	return unit.Status(), true
+}
+
+// FetchDeviceLogin returns the device login of username with id, or
+// sql.ErrNoRows when there is none.
+func FetchDeviceLogin(username, id string) (LoginStatus, error) {
+	if unit := GlobalWebsocketConnection.LookupLogin(username, id); unit != nil {
+		return unit.Status(), nil
+	}
+
+	clientDb, err := GlobalStorage.OpenClient(username)
+	if err != nil {
+		return LoginStatus{}, err
+	}
+	defer clientDb.Close()
+
+	session, err := clientDb.FetchLoginSession(id)
+	if err != nil {
+		return LoginStatus{}, err
+	}
+
+	// Nothing expires logins the server stopped driving, after a restart for
+	// one, so they are expired once they are looked at past their timeout.
+	now := time.Now()
+	if session.Expired(now) {
+		transition, _ := session.Transition(LoginStateExpired, expiredLoginReason(session.State), now)
+		if err := clientDb.UpdateLoginSession(&session, &transition); err != nil {
+			return LoginStatus{}, err
+		}
+		if err := clientDb.RemoveActiveSessions(session.Platform, session.ID); err != nil {
+			return LoginStatus{}, err
+		}
+	}
+
+	status := LoginStatus{LoginSession: session}
+	if session.State == LoginStateAwaitingScan {
+		// Stored by the server driving the login, see WebsocketUnit.storeCode.
+		code, err := clientDb.FetchActiveSessions(session.Platform, session.ID)
+		if err != nil {
+			return LoginStatus{}, err
+		}
+		var update LoginUpdate
+		if len(code) > 0 && json.Unmarshal(code, &update) == nil {
+			status.QRCode = update.QRCode
+			status.PairingCode = update.PairingCode
+		}
+	}
+	return status, nil
 }
 
 func (c *Controller) AddWebhook(deviceName, url, method string) error {
-	clientDb := ClientDB{
-		username: c.Username,
-		filepath: "db/" + c.Username + ".db",
+	clientDb, err := GlobalStorage.OpenClient(c.Username)
+	if err != nil {
+		return err
 	}
-	clientDb.Init()
+	defer clientDb.Close()
 
-	err := clientDb.CreateWebhook(deviceName, url, method)
+	err = clientDb.CreateWebhook(deviceName, url, method)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestEventSubscribers(t *testing.T) {
+	room := id.RoomID("!management:example.org")
+	notice := &event.Event{
+		RoomID:    room,
+		Type:      event.EventMessage,
+		Timestamp: time.Now().UnixMilli(),
+		Content:   event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgNotice, Body: "pong"}},
+	}
+
+	var calls atomic.Int64
+	subscriber := EventSubscriber{Name: "@alice:example.org+test", RoomID: room, Callback: func(*event.Event) { calls.Add(1) }}
+	if !AddEventSubscriber(subscriber) {
+		t.Fatal("AddEventSubscriber() = false, want true")
+	}
+	t.Cleanup(func() { RemoveEventSubscriber(subscriber.Name) })
+	if AddEventSubscriber(subscriber) {
+		t.Error("AddEventSubscriber() of a name already registered = true, want false")
+	}
+
+	// Subscribers come and go while the sync loops dispatch events.
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("@alice:example.org+ask:%d", i)
+			for range 100 {
+				AddEventSubscriber(EventSubscriber{Name: name, RoomID: room, Callback: func(*event.Event) {}})
+				RemoveEventSubscriber(name)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				(&MatrixClient{}).processIncomingEvents(notice)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := calls.Load(); got != 800 {
+		t.Errorf("subscriber called %d times, want 800", got)
+	}
+
+	RemoveEventSubscriber(subscriber.Name)
+	(&MatrixClient{}).processIncomingEvents(notice)
+	if got := calls.Load(); got != 800 {
+		t.Errorf("removed subscriber still called, %d calls", got)
+	}
+}
+
+func TestSyncClientFailureReleasesUser(t *testing.T) {
+	useTestStorage(t)
+
+	// The homeserver no longer knows the token the user syncs with.
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Unknown access token"}`))
+	}))
+	defer homeserver.Close()
+	useTestConfig(t, &Conf{HomeServer: homeserver.URL, HomeServerDomain: "example.org"})
+
+	if !claimSyncingUser("henry") {
+		t.Fatal("claimSyncingUser() = false for a user nobody syncs")
+	}
+	if err := (&MatrixClient{}).syncClient(context.Background(), Users{Username: "henry", AccessToken: "syt_henry"}); err == nil {
+		t.Fatal("syncClient() with a rejected token succeeded")
+	}
+
+	syncLoopsMutex.Lock()
+	_, ok := syncLoops["henry"]
+	syncLoopsMutex.Unlock()
+	if ok {
+		t.Error("the failed sync loop is still registered")
+	}
+	if !claimSyncingUser("henry") {
+		t.Error("claimSyncingUser() = false after the sync failed, the user would never sync again")
+	}
+	forgetSyncingUser("henry")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	defaultCorsMethods = []string{"GET", "POST", "PUT", "DELETE"}
+	defaultCorsHeaders = []string{"Authorization", "Content-Type", "Accept", "Cache-Control", "X-Requested-With"}
+	defaultCorsMaxAge  = 10 * time.Minute
+)
+
+// AllowsOrigin reports whether a browser on origin may call the API.
+func (c *Cors) AllowsOrigin(origin string) bool {
+	return slices.Contains(c.AllowedOrigins, "*") || slices.ContainsFunc(c.AllowedOrigins, func(allowed string) bool {
+		return strings.EqualFold(allowed, origin)
+	})
+}
+
+func (c *Cors) allowsWildcard() bool {
+	return slices.Contains(c.AllowedOrigins, "*")
+}
+
+func (c *Cors) allowsMethod(method string) bool {
+	return slices.ContainsFunc(c.GetAllowedMethods(), func(allowed string) bool {
+		return strings.EqualFold(allowed, method)
+	})
+}
+
+func (c *Cors) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		if !slices.ContainsFunc(c.GetAllowedHeaders(), func(allowed string) bool {
+			return allowed == "*" || strings.EqualFold(allowed, header)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// CORSMiddleware answers preflight requests and adds the CORS headers to
+// requests from allowed origins. Other origins get no CORS headers, which the
+// browser enforces. The configuration is read per request.
+func CORSMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cors := cfg().Cors
+		origin := c.GetHeader("Origin")
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+		c.Writer.Header().Add("Vary", "Origin")
+		if preflight {
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		if !cors.AllowsOrigin(origin) {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		// Credentials are only ever allowed for origins listed by name, a
+		// wildcard would hand them to any site.
+		if cors.allowsWildcard() {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+			if cors.AllowCredentials {
+				c.Header("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if !preflight {
+			if len(cors.ExposedHeaders) > 0 {
+				c.Header("Access-Control-Expose-Headers", strings.Join(cors.ExposedHeaders, ", "))
+			}
+			c.Next()
+			return
+		}
+
+		requestHeaders := c.GetHeader("Access-Control-Request-Headers")
+		if !cors.allowsMethod(c.GetHeader("Access-Control-Request-Method")) || !cors.allowsHeaders(requestHeaders) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		allowedHeaders := strings.Join(cors.GetAllowedHeaders(), ", ")
+		if slices.Contains(cors.GetAllowedHeaders(), "*") {
+			allowedHeaders = requestHeaders
+		}
+
+		c.Header("Access-Control-Allow-Methods", strings.Join(cors.GetAllowedMethods(), ", "))
+		if allowedHeaders != "" {
+			c.Header("Access-Control-Allow-Headers", allowedHeaders)
+		}
+		c.Header("Access-Control-Max-Age", strconv.Itoa(int(cors.GetMaxAge().Seconds())))
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// checkWebsocketOrigin lets clients without an Origin, which are not
+// browsers, the API's own origin and the configured origins open websockets.
+func checkWebsocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if cfg().Cors.AllowsOrigin(origin) {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(CORSMiddleware())
+	router.POST("/login", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	named := Cors{AllowedOrigins: []string{"https://app.example.org"}, AllowCredentials: true}
+	wildcard := Cors{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+
+	tests := []struct {
+		name            string
+		cors            Cors
+		method          string
+		origin          string
+		requestMethod   string
+		requestHeaders  string
+		wantStatus      int
+		wantOrigin      string
+		wantCredentials string
+	}{
+		{"no origin", named, http.MethodPost, "", "", "", http.StatusOK, "", ""},
+		{"allowed origin", named, http.MethodPost, "https://app.example.org", "", "", http.StatusOK, "https://app.example.org", "true"},
+		{"other origin", named, http.MethodPost, "https://evil.example.org", "", "", http.StatusOK, "", ""},
+		{"nothing configured", Cors{}, http.MethodPost, "https://app.example.org", "", "", http.StatusOK, "", ""},
+		{"wildcard never allows credentials", wildcard, http.MethodPost, "https://evil.example.org", "", "", http.StatusOK, "*", ""},
+		{"preflight", named, http.MethodOptions, "https://app.example.org", "POST", "Authorization, Content-Type", http.StatusNoContent, "https://app.example.org", "true"},
+		{"preflight from other origin", named, http.MethodOptions, "https://evil.example.org", "POST", "", http.StatusForbidden, "", ""},
+		{"preflight for other method", named, http.MethodOptions, "https://app.example.org", "PATCH", "", http.StatusForbidden, "https://app.example.org", "true"},
+		{"preflight for other header", named, http.MethodOptions, "https://app.example.org", "POST", "X-Secret", http.StatusForbidden, "https://app.example.org", "true"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := *cfg()
+			conf.Cors = tt.cors
+			useTestConfig(t, &conf)
+
+			req := httptest.NewRequest(tt.method, "/login", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			if tt.requestHeaders != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.requestHeaders)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", recorder.Code, tt.wantStatus)
+			}
+			if got := recorder.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := recorder.Header().Get("Access-Control-Allow-Credentials"); got != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, tt.wantCredentials)
+			}
+		})
+	}
+}
+
+func TestCheckWebsocketOrigin(t *testing.T) {
+	conf := *cfg()
+	conf.Cors = Cors{AllowedOrigins: []string{"https://app.example.org"}}
+	useTestConfig(t, &conf)
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"https://app.example.org", true},
+		{"http://api.example.org", true},
+		{"https://evil.example.org", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://api.example.org/ws/wa/alice", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if got := checkWebsocketOrigin(req); got != tt.want {
+			t.Errorf("checkWebsocketOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Connection states of a device, from the bridge states mautrix bridges
+// report for their logins.
+const (
+	DeviceStateConnected    = "connected"
+	DeviceStateConnecting   = "connecting"
+	DeviceStateDisconnected = "disconnected"
+	DeviceStateLoggedOut    = "logged_out"
+	DeviceStateUnknown      = "unknown"
+)
+
+// Device is an account the user linked on a platform through its bridge.
+// @Description Represents an account linked on a platform and whether the bridge is connected to it
+// @name Device
+// @type object
+type Device struct {
+	ID          string     `json:"id" example:"1234567890"`               // Login ID on the bridge
+	Handle      string     `json:"handle" example:"1234567890"`           // Phone number or username, contacts are reached through
+	Platform    string     `json:"platform" example:"wa"`                 // Platform the device is linked on
+	DisplayName string     `json:"display_name,omitempty" example:"John"` // Name of the account, when the bridge reports one
+	State       string     `json:"state" example:"connected"`             // connected, connecting, disconnected, logged_out or unknown
+	LinkedAt    time.Time  `json:"linked_at"`                             // When the device was first listed
+	LastSeenAt  *time.Time `json:"last_seen_at,omitempty"`                // When the bridge was last connected to it
+}
+
+// deviceState maps a bridge state of mautrix bridges onto the connection
+// state of a device.
+func deviceState(bridgeState string) string {
+	switch status.BridgeStateEvent(bridgeState) {
+	case status.StateConnected, status.StateBackfilling:
+		return DeviceStateConnected
+	case status.StateConnecting:
+		return DeviceStateConnecting
+	case status.StateTransientDisconnect, status.StateUnknownError, status.StateBridgeUnreachable:
+		return DeviceStateDisconnected
+	case status.StateBadCredentials, status.StateLoggedOut:
+		return DeviceStateLoggedOut
+	}
+	return DeviceStateUnknown
+}
+
+// RefreshDevices lists the devices of the bridge and stores them, dropping
+// the ones the bridge no longer lists.
+func (b *Bridges) RefreshDevices(ctx context.Context) ([]Device, error) {
+	listed, err := b.ListDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDb, err := GlobalStorage.OpenClient(b.Client.UserID.Localpart())
+	if err != nil {
+		return nil, err
+	}
+	defer clientDb.Close()
+
+	if err := clientDb.SyncDevices(b.Name, listed, time.Now()); err != nil {
+		return nil, err
+	}
+	return clientDb.FetchDevices(b.Name)
+}
+
+// DevicesDaemon keeps the devices of the bridge up to date until ctx is done,
+// listing them again every refresh interval of the bridge and following the
+// state notices the bridge sends in its management room.
+func (b *Bridges) DevicesDaemon(ctx context.Context) {
+	bridgeCfg, ok := cfg().GetBridgeConfig(b.Name)
+	if !ok {
+		log.Println("Bridge config not found for:", b.Name)
+		return
+	}
+
+	eventSubName := ReverseAliasForEventSubscriber(b.Client.UserID.Localpart(), b.Name, cfg().HomeServerDomain) + "+deviceStates"
+	eventSince := time.Now().UTC()
+	eventSubscriber := EventSubscriber{
+		Name:   eventSubName,
+		Since:  &eventSince,
+		RoomID: b.RoomID,
+		Callback: func(evt *event.Event) {
+			if evt.Sender != id.UserID(b.BotName) || evt.Type != event.EventMessage {
+				return
+			}
+			device, state, ok := parseStateNotice(b.Name, evt)
+			if !ok {
+				return
+			}
+			GlobalShutdown.Go(func() { b.updateDeviceState(ctx, device, state) })
+		},
+	}
+	AddEventSubscriber(eventSubscriber)
+	defer RemoveEventSubscriber(eventSubName)
+
+	ticker := time.NewTicker(bridgeCfg.DeviceList.GetRefresh())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// The configuration may have changed since.
+			bridgeCfg, ok = cfg().GetBridgeConfig(b.Name)
+			if !ok {
+				log.Println("Bridge removed from the configuration, no longer refreshing devices:", b.Name)
+				return
+			}
+			ticker.Reset(bridgeCfg.DeviceList.GetRefresh())
+
+			if _, err := b.RefreshDevices(ctx); err != nil {
+				log.Println("Error refreshing devices:", err, b.Name)
+			}
+		}
+	}
+}
+
+// updateDeviceState stores the state the bridge reported for device, listing
+// the devices again when it is one the bridge didn't list before.
+func (b *Bridges) updateDeviceState(ctx context.Context, device, state string) {
+	clientDb, err := GlobalStorage.OpenClient(b.Client.UserID.Localpart())
+	if err != nil {
+		log.Println("Error opening client db:", err)
+		return
+	}
+	updated, err := clientDb.UpdateDeviceState(b.Name, device, state, time.Now())
+	clientDb.Close()
+	if err != nil {
+		log.Println("Error updating device state:", err)
+		return
+	}
+	log.Printf("[+] Device %s on %s is %s", device, b.Name, state)
+
+	if !updated {
+		if _, err := b.RefreshDevices(ctx); err != nil {
+			log.Println("Error refreshing devices:", err, b.Name)
+		}
+	}
+}
+
+// parseStateNotice reads the device and connection state out of a state
+// notice of the bridge, from the bridge state mautrix bridges attach to it or
+// else from the state pattern of the bridge.
+func parseStateNotice(bridgeType string, evt *event.Event) (string, string, bool) {
+	if state, ok := bridgeState(evt); ok {
+		if state.RemoteID == "" {
+			return "", "", false
+		}
+		return state.RemoteID, deviceState(string(state.StateEvent)), true
+	}
+	if _, ok := evt.Content.Raw["fi.mau.bridge_state"]; ok {
+		return "", "", false
+	}
+
+	device, state, ok, err := cfg().MatchStateNotice(bridgeType, evt.Content.AsMessage().Body)
+	if err != nil || !ok {
+		return "", "", false
+	}
+	return device, deviceState(state), true
+}
+
+// bridgeState returns the bridge state mautrix bridges attach to their state
+// notices, if evt carries one.
+func bridgeState(evt *event.Event) (status.BridgeState, bool) {
+	var state status.BridgeState
+	raw, ok := evt.Content.Raw["fi.mau.bridge_state"]
+	if !ok {
+		return state, false
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return state, false
+	}
+	if err := json.Unmarshal(data, &state); err != nil || state.StateEvent == "" {
+		return state, false
+	}
+	return state, true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestParseStateNotice(t *testing.T) {
+	useTestConfig(t, &Conf{Bridges: []map[string]BridgeConfig{{"wa": {}}}})
+
+	tests := []struct {
+		name       string
+		raw        map[string]any
+		wantDevice string
+		wantState  string
+		wantOK     bool
+	}{
+		{
+			"Bridge state",
+			map[string]any{
+				"msgtype": "m.notice",
+				"body":    "State update for +1234567890: `TRANSIENT_DISCONNECT`",
+				"fi.mau.bridge_state": map[string]any{
+					"state_event": "TRANSIENT_DISCONNECT",
+					"remote_id":   "1234567890",
+					"remote_name": "+1234567890",
+				},
+			},
+			"1234567890", DeviceStateDisconnected, true,
+		},
+		{
+			"State notice text",
+			map[string]any{"msgtype": "m.notice", "body": "State update for +1234567890: `CONNECTED`"},
+			"1234567890", DeviceStateConnected, true,
+		},
+		{
+			"Other notice",
+			map[string]any{"msgtype": "m.notice", "body": "Successfully logged in as +1234567890"},
+			"", "", false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			evt := &event.Event{Type: event.EventMessage, Content: event.Content{VeryRaw: data, Raw: tt.raw}}
+			if err := evt.Content.ParseRaw(evt.Type); err != nil {
+				t.Fatal(err)
+			}
+			device, state, ok := parseStateNotice("wa", evt)
+			if device != tt.wantDevice || state != tt.wantState || ok != tt.wantOK {
+				t.Errorf("parseStateNotice() = %q, %q, %v, want %q, %q, %v", device, state, ok, tt.wantDevice, tt.wantState, tt.wantOK)
+			}
+		})
+	}
+}
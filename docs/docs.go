@@ -64,6 +64,215 @@ const docTemplate = `{
                 }
             }
         },
+        "/api-keys": {
+            "get": {
+                "description": "Lists the API keys issued for the authenticated user, without the keys themselves",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Lists API keys",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Bearer token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "API keys",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.APIKey"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid or missing Bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "This endpoint requires a Matrix access token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Issues an API key acting as the authenticated user with the given scopes, so services don't need the Matrix access token.\nThe key is only returned in this response, store it safely. API keys cannot be used to issue other keys.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Issues an API key",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Bearer token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "API Key",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CreateAPIKeyJsonRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "API key issued",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIKey"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid or missing Bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "This endpoint requires a Matrix access token, or the scope is only granted to operators",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api-keys/{id}": {
+            "delete": {
+                "description": "Revokes an API key of the authenticated user, it stops working immediately",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Revokes an API key",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "API Key ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Bearer token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "API key revoked",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid or missing Bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "This endpoint requires a Matrix access token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "API key not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/bridges/status": {
+            "get": {
+                "description": "Reports whether the bot of each configured bridge answers in the management room of the user the access token\nbelongs to, with the latency of its last answer and the last bridge state it reported. Bridges are unhealthy once\ntheir bot missed bridge_health.failures pings in a row, and unknown before they were first pinged.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Reports the health of the bridges",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Bearer token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Health of the bridges",
+                        "schema": {
+                            "$ref": "#/definitions/main.BridgesStatusResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid or missing Bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "API key is missing the devices:manage scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
         "/login": {
             "post": {
                 "description": "Authenticates a user and returns an access token",
@@ -76,20 +285,401 @@ const docTemplate = `{
                 "summary": "Logs a user into the Matrix server",
                 "parameters": [
                     {
-                        "description": "Login Credentials",
-                        "name": "payload",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/main.ClientJsonRequest"
-                        }
+                        "description": "Login Credentials",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ClientJsonRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully logged in",
+                        "schema": {
+                            "$ref": "#/definitions/main.LoginResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Login failed",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/logout": {
+            "post": {
+                "description": "Invalidates the access token at the homeserver. When it is the token the server syncs with, it is removed from storage and the user's sync loop and websockets are stopped",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Logs the access token out",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Bearer token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully logged out",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid or missing Bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "This endpoint requires a Matrix access token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Logout failed at the homeserver",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/logout/all": {
+            "post": {
+                "description": "Invalidates every access token of the user at the homeserver, removes the stored one and stops the user's sync loop and websockets",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Logs every access token of the user out",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Bearer token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully logged out",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid or missing Bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "This endpoint requires a Matrix access token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Logout failed at the homeserver",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/{platform}/command": {
+            "post": {
+                "description": "Sends the command as is into the management room of the platform's bridge for the given user,\nsuch as \"!wa sync\" or \"!signal help\", and returns the notices the bridge bot replied with. Replies are collected\nuntil the bot stayed quiet for bridge_commands.quiet_period after its first reply, or bridge_commands.timeout passed.\nOnly operators can run commands, with the bridge_commands.admin_token of the configuration. Matrix access tokens\nand API keys are refused, and the endpoint is disabled while no admin token is set.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Runs a command of the bridge bot",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Platform Name",
+                        "name": "platform",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Bearer admin token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Bridge Command",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.BridgeCommandJsonRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Replies of the bridge bot",
+                        "schema": {
+                            "$ref": "#/definitions/main.BridgeCommandResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing Bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "This endpoint requires the admin token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Platform not configured or user not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "The user is logged out",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/{platform}/device/{device_name}/webhook": {
+            "post": {
+                "description": "Adds a webhook for a given device",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Adds a webhook for a given device",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Platform Name",
+                        "name": "platform",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Device Name",
+                        "name": "device_name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "URL",
+                        "name": "url",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Method",
+                        "name": "method",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Bearer token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Webhook added successfully",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid or missing Bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Username does not match access token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/{platform}/devices": {
+            "post": {
+                "description": "Registers a new device login for the specified platform, starts it with the bridge and returns the websocket URL to\nfollow it on, served on the API port. Clients without a websocket poll GET /{platform}/devices/login/{id} instead.\nEvery call starts another login, so several numbers of a platform and other platforms can be linked at the same time,\neach running in its own room with the bridge bot. Adding a phone number whose login is in progress returns that login.\nSeveral websockets may follow the same login, it ends when the login succeeds or fails or the last websocket disconnects.\nThe websocket connection will:\n- Receive JSON frames with a type: qr (base64 image and the text it encodes), pairing_code, status (notices of the bridge),\ninput (the bridge asks for the input of a login step), success (with the linked phone number), failed (with a reason),\ntimeout or cancelled\n- Send {\"type\": \"input\", \"input\": ..., \"value\": ...} frames answering the login steps the bridge asks for, configured\nas login_steps of the bridge, such as the phone number, code and password of Telegram logins\n- Close with code 1000 after success, 4000 after failure, 4001 after a timeout and 4002 once cancelled\nAdding format=binary to the websocket URL keeps the older protocol: QR codes as binary frames, pairing codes as\ntext frames and an empty binary frame when the login ends.\nThe websocket URL carries a single-use ticket bound to the user and platform that expires after a minute.\nHandshakes without it must send the access token, or an API key with the devices:manage scope, as a Bearer token.\nDevices are linked by scanning a QR code by default. With the phone method the pairing code to enter on the\nphone is also returned in the response, for clients that can't scan a QR code.\nHere are various platforms supported:\n'wa' (for WhatsApp)\n'signal' (for Signal)",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Adds a device for a given platform",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Platform Name",
+                        "name": "platform",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Bearer token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Device Payload",
+                        "name": "payload",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/main.AddDeviceJsonRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully added device and established websocket connection",
+                        "schema": {
+                            "$ref": "#/definitions/main.DeviceResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid or missing Bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Username does not match access token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "429": {
+                        "description": "Rate limit exceeded, retry after the Retry-After header",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/{platform}/devices/login": {
+            "delete": {
+                "description": "Cancels every device login of the user on the platform that is in progress. The bridge is sent its cancel command\nin the room of each login, the codes it showed are forgotten and websockets following the logins receive a cancelled\nframe before being closed with code 4002. Logins are also cancelled when the last websocket following them disconnects.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Cancels the device logins in progress",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Platform Name",
+                        "name": "platform",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Bearer token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "Successfully logged in",
+                        "description": "States of the cancelled device logins",
                         "schema": {
-                            "$ref": "#/definitions/main.LoginResponse"
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.LoginStatus"
+                            }
                         }
                     },
                     "400": {
@@ -99,13 +689,13 @@ const docTemplate = `{
                         }
                     },
                     "401": {
-                        "description": "Login failed",
+                        "description": "Invalid or missing Bearer token",
                         "schema": {
                             "$ref": "#/definitions/main.ErrorResponse"
                         }
                     },
-                    "500": {
-                        "description": "Internal server error",
+                    "404": {
+                        "description": "No device login in progress",
                         "schema": {
                             "$ref": "#/definitions/main.ErrorResponse"
                         }
@@ -113,16 +703,13 @@ const docTemplate = `{
                 }
             }
         },
-        "/{platform}/device/{device_name}/webhook": {
-            "post": {
-                "description": "Adds a webhook for a given device",
-                "consumes": [
-                    "application/json"
-                ],
+        "/{platform}/devices/login/{id}": {
+            "get": {
+                "description": "Returns the state of a device login started with POST /{platform}/devices, so clients without a websocket can follow it.\nA login is pending until the bridge shows a QR or pairing code, then awaiting_scan, and scanned once the bridge\nreports the code was used. It ends in success, failed, expired when it stays in a state past the timeout\nconfigured under login_timeouts, or cancelled. The QR code text and pairing code are included while awaiting_scan.",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Adds a webhook for a given device",
+                "summary": "Reports the state of a device login",
                 "parameters": [
                     {
                         "type": "string",
@@ -133,25 +720,11 @@ const docTemplate = `{
                     },
                     {
                         "type": "string",
-                        "description": "Device Name",
-                        "name": "device_name",
+                        "description": "Login ID",
+                        "name": "id",
                         "in": "path",
                         "required": true
                     },
-                    {
-                        "type": "string",
-                        "description": "URL",
-                        "name": "url",
-                        "in": "query",
-                        "required": true
-                    },
-                    {
-                        "type": "string",
-                        "description": "Method",
-                        "name": "method",
-                        "in": "query",
-                        "required": true
-                    },
                     {
                         "type": "string",
                         "description": "Bearer token",
@@ -162,10 +735,9 @@ const docTemplate = `{
                 ],
                 "responses": {
                     "200": {
-                        "description": "Webhook added successfully",
+                        "description": "State of the device login",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "$ref": "#/definitions/main.LoginStatus"
                         }
                     },
                     "400": {
@@ -180,6 +752,12 @@ const docTemplate = `{
                             "$ref": "#/definitions/main.ErrorResponse"
                         }
                     },
+                    "404": {
+                        "description": "Device login not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
@@ -187,18 +765,13 @@ const docTemplate = `{
                         }
                     }
                 }
-            }
-        },
-        "/{platform}/devices": {
-            "post": {
-                "description": "Registers a new device connection for the specified platform and establishes a websocket connection.\nThe websocket connection will:\n- Receive media/images from the platform bridge\n- Handle login synchronization events\n- Send existing active sessions if available\n- Close connection when receiving nil data (indicating end of session or error)\nHere are various platforms supported:\n'wa' (for WhatsApp)\n'signal' (for Signal)",
-                "consumes": [
-                    "application/json"
-                ],
+            },
+            "delete": {
+                "description": "Cancels the device login with the id returned by POST /{platform}/devices, leaving the other logins of the platform\nrunning. The bridge is sent its cancel command and websockets following the login are closed with code 4002.",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Adds a device for a given platform",
+                "summary": "Cancels a device login in progress",
                 "parameters": [
                     {
                         "type": "string",
@@ -207,28 +780,26 @@ const docTemplate = `{
                         "in": "path",
                         "required": true
                     },
+                    {
+                        "type": "string",
+                        "description": "Login ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
                     {
                         "type": "string",
                         "description": "Bearer token",
                         "name": "Authorization",
                         "in": "header",
                         "required": true
-                    },
-                    {
-                        "description": "Device Payload",
-                        "name": "payload",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/main.ClientBridgeJsonRequest"
-                        }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "Successfully added device and established websocket connection",
+                        "description": "State of the cancelled device login",
                         "schema": {
-                            "$ref": "#/definitions/main.DeviceResponse"
+                            "$ref": "#/definitions/main.LoginStatus"
                         }
                     },
                     "400": {
@@ -243,8 +814,8 @@ const docTemplate = `{
                             "$ref": "#/definitions/main.ErrorResponse"
                         }
                     },
-                    "500": {
-                        "description": "Internal server error",
+                    "404": {
+                        "description": "Device login not in progress",
                         "schema": {
                             "$ref": "#/definitions/main.ErrorResponse"
                         }
@@ -254,7 +825,7 @@ const docTemplate = `{
         },
         "/{platform}/list/devices": {
             "post": {
-                "description": "Retrieves all active devices for the specified platform and user",
+                "description": "Retrieves the devices linked on the specified platform by the user the access token belongs to, with the connection\nstate the bridge last reported for each. Devices are listed again periodically, after a login succeeds and when the\nbridge reports a device it didn't list before.",
                 "consumes": [
                     "application/json"
                 ],
@@ -281,7 +852,6 @@ const docTemplate = `{
                         "description": "Device List Request",
                         "name": "payload",
                         "in": "body",
-                        "required": true,
                         "schema": {
                             "$ref": "#/definitions/main.ClientBridgeJsonRequest"
                         }
@@ -291,8 +861,7 @@ const docTemplate = `{
                     "200": {
                         "description": "List of devices",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "$ref": "#/definitions/main.DeviceListResponse"
                         }
                     },
                     "400": {
@@ -307,6 +876,18 @@ const docTemplate = `{
                             "$ref": "#/definitions/main.ErrorResponse"
                         }
                     },
+                    "403": {
+                        "description": "Username does not match access token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "429": {
+                        "description": "Rate limit exceeded, retry after the Retry-After header",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
@@ -318,7 +899,7 @@ const docTemplate = `{
         },
         "/{platform}/message/{contact}": {
             "post": {
-                "description": "Sends a message to a contact through the specified platform bridge. The message can include text and optional file data.\nThe function validates and sanitizes all input fields according to the following rules:\n- Username: 3-32 characters, letters, numbers, and underscores only\n- Message: 1-4096 characters, cannot be empty\n- Device name: 2-20 characters, letters and numbers only\n- Contact: Valid E.164 phone number format (8-15 digits)\n- Platform: 2-20 characters, letters and numbers only",
+                "description": "Sends a message to a contact through the specified platform bridge. The message can include text and optional file data.\nThe message is sent as the user the access token belongs to.\nThe function validates and sanitizes all input fields according to the following rules:\n- Message: 1-4096 characters, cannot be empty\n- Device name: 2-20 characters, letters and numbers only\n- Contact: Valid E.164 phone number format (8-15 digits)\n- Platform: 2-20 characters, letters and numbers only",
                 "consumes": [
                     "application/json"
                 ],
@@ -367,7 +948,7 @@ const docTemplate = `{
                         }
                     },
                     "400": {
-                        "description": "Invalid request - validation errors for username, message, device_name, platform, or contact",
+                        "description": "Invalid request - validation errors for message, device_name, platform, or contact",
                         "schema": {
                             "$ref": "#/definitions/main.ErrorResponse"
                         }
@@ -378,6 +959,18 @@ const docTemplate = `{
                             "$ref": "#/definitions/main.ErrorResponse"
                         }
                     },
+                    "403": {
+                        "description": "Username does not match access token",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
+                    "429": {
+                        "description": "Rate limit exceeded, retry after the Retry-After header",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErrorResponse"
+                        }
+                    },
                     "500": {
                         "description": "Failed to send message or internal server error",
                         "schema": {
@@ -389,11 +982,198 @@ const docTemplate = `{
         }
     },
     "definitions": {
+        "main.APIKey": {
+            "description": "Represents an API key issued for a user",
+            "type": "object",
+            "properties": {
+                "allowed_ips": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "10.0.0.0/8"
+                    ]
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "key": {
+                    "type": "string",
+                    "example": "smk_3q2b7wQxLk..."
+                },
+                "last_used_at": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string",
+                    "example": "billing-service"
+                },
+                "prefix": {
+                    "type": "string",
+                    "example": "smk_3q2b7wQx"
+                },
+                "scopes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "messages:send"
+                    ]
+                }
+            }
+        },
+        "main.AddDeviceJsonRequest": {
+            "description": "Request payload to add a device. The method is qr (default) or phone, which requires the phone number of the account to link.",
+            "type": "object",
+            "properties": {
+                "method": {
+                    "type": "string",
+                    "example": "phone"
+                },
+                "phone_number": {
+                    "description": "Required for the phone method, E.164 format",
+                    "type": "string",
+                    "example": "+1234567890"
+                },
+                "username": {
+                    "description": "Deprecated: the user is taken from the access token, must match it if set",
+                    "type": "string",
+                    "example": "john_doe"
+                }
+            }
+        },
+        "main.BridgeCommandJsonRequest": {
+            "description": "Request payload to run a command of the bridge bot in the management room of the user",
+            "type": "object",
+            "required": [
+                "command",
+                "username"
+            ],
+            "properties": {
+                "command": {
+                    "description": "Required: 1-4096 characters, sent as is",
+                    "type": "string",
+                    "example": "!wa sync"
+                },
+                "username": {
+                    "description": "Required: the user to run the command for",
+                    "type": "string",
+                    "example": "john_doe"
+                }
+            }
+        },
+        "main.BridgeCommandResponse": {
+            "description": "Response payload with the notices the bridge bot replied to a command with",
+            "type": "object",
+            "properties": {
+                "command": {
+                    "type": "string",
+                    "example": "!wa sync"
+                },
+                "replies": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.BridgeReply"
+                    }
+                },
+                "timed_out": {
+                    "description": "The bot never went quiet, or never replied, before the timeout",
+                    "type": "boolean",
+                    "example": false
+                }
+            }
+        },
+        "main.BridgeHealth": {
+            "description": "Represents the health of a bridge, from the pings of its bot and the bridge states it reports",
+            "type": "object",
+            "properties": {
+                "bridge_state": {
+                    "description": "Last bridge state the bot reported",
+                    "type": "string",
+                    "example": "CONNECTED"
+                },
+                "bridge_state_at": {
+                    "description": "When the bot reported it",
+                    "type": "string"
+                },
+                "error": {
+                    "description": "Why the last ping failed",
+                    "type": "string"
+                },
+                "failures": {
+                    "description": "Pings in a row the bot didn't answer",
+                    "type": "integer",
+                    "example": 0
+                },
+                "last_ping_at": {
+                    "description": "When the bot was last pinged",
+                    "type": "string"
+                },
+                "last_reply_at": {
+                    "description": "When the bot last answered a ping",
+                    "type": "string"
+                },
+                "latency_ms": {
+                    "description": "How long the bot took to answer the last ping, in milliseconds",
+                    "type": "integer",
+                    "example": 250
+                },
+                "platform": {
+                    "description": "Platform of the bridge",
+                    "type": "string",
+                    "example": "wa"
+                },
+                "status": {
+                    "description": "healthy, unhealthy or unknown",
+                    "type": "string",
+                    "example": "healthy"
+                }
+            }
+        },
+        "main.BridgeReply": {
+            "description": "A notice of the bridge bot replying to a command",
+            "type": "object",
+            "properties": {
+                "body": {
+                    "type": "string",
+                    "example": "Synced 12 chats"
+                },
+                "event_id": {
+                    "type": "string",
+                    "example": "$1234567890abcdef"
+                },
+                "sent_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.BridgesStatusResponse": {
+            "description": "Response payload listing the health of every configured bridge",
+            "type": "object",
+            "properties": {
+                "bridges": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.BridgeHealth"
+                    }
+                }
+            }
+        },
         "main.ClientBridgeJsonRequest": {
             "description": "Request payload to bind a platform bridge to a user",
             "type": "object",
             "properties": {
                 "username": {
+                    "description": "Deprecated: the user is taken from the access token, must match it if set",
                     "type": "string",
                     "example": "john_doe"
                 }
@@ -416,13 +1196,115 @@ const docTemplate = `{
         "main.ClientMessageJsonRequeset": {
             "type": "object"
         },
+        "main.CreateAPIKeyJsonRequest": {
+            "description": "Request payload to issue an API key. Scopes are any of messages:send, messages:read, devices:manage and webhooks:manage.",
+            "type": "object",
+            "properties": {
+                "allowed_ips": {
+                    "description": "Optional: IP addresses or CIDR ranges the key may be used from",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "10.0.0.0/8"
+                    ]
+                },
+                "expires_at": {
+                    "description": "Optional: the key stops working at this time",
+                    "type": "string",
+                    "example": "2030-01-01T00:00:00Z"
+                },
+                "name": {
+                    "type": "string",
+                    "example": "billing-service"
+                },
+                "scopes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "messages:send"
+                    ]
+                }
+            }
+        },
+        "main.Device": {
+            "description": "Represents an account linked on a platform and whether the bridge is connected to it",
+            "type": "object",
+            "properties": {
+                "display_name": {
+                    "description": "Name of the account, when the bridge reports one",
+                    "type": "string",
+                    "example": "John"
+                },
+                "handle": {
+                    "description": "Phone number or username, contacts are reached through",
+                    "type": "string",
+                    "example": "1234567890"
+                },
+                "id": {
+                    "description": "Login ID on the bridge",
+                    "type": "string",
+                    "example": "1234567890"
+                },
+                "last_seen_at": {
+                    "description": "When the bridge was last connected to it",
+                    "type": "string"
+                },
+                "linked_at": {
+                    "description": "When the device was first listed",
+                    "type": "string"
+                },
+                "platform": {
+                    "description": "Platform the device is linked on",
+                    "type": "string",
+                    "example": "wa"
+                },
+                "state": {
+                    "description": "connected, connecting, disconnected, logged_out or unknown",
+                    "type": "string",
+                    "example": "connected"
+                }
+            }
+        },
+        "main.DeviceListResponse": {
+            "description": "Response payload listing the devices linked on a platform",
+            "type": "object",
+            "properties": {
+                "devices": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Device"
+                    }
+                }
+            }
+        },
         "main.DeviceResponse": {
-            "description": "Response payload for successful device addition. The websocket_url is used to establish a connection that: - Receives media/images from the platform bridge - Handles login synchronization events - Receives existing active sessions if available - Closes when receiving nil data (indicating end of session or error)",
+            "description": "Response payload for successful device addition. The websocket_url is used to establish a connection that: - Receives the login as JSON frames typed qr, pairing_code, status, input, success, failed or timeout - Carries the state of the login in every frame - Answers the login steps of the bridge with {\"type\": \"input\", \"input\": ..., \"value\": ...} frames - Closes with code 1000 after success, 4000 after failure, 4001 after a timeout and 4002 once cancelled",
             "type": "object",
             "properties": {
+                "login_id": {
+                    "description": "Follow the login with GET /{platform}/devices/login/{login_id}",
+                    "type": "string",
+                    "example": "Vb3kq9XhY2tPz0aL"
+                },
+                "pairing_code": {
+                    "description": "Phone logins: the code to enter on the phone, empty if the bridge didn't send it in time",
+                    "type": "string",
+                    "example": "ABCD-EFGH"
+                },
+                "ticket": {
+                    "type": "string",
+                    "example": "3q2b7wQxLk..."
+                },
+                "ticket_expires_at": {
+                    "type": "string"
+                },
                 "websocket_url": {
                     "type": "string",
-                    "example": "ws://localhost:8080/ws/telegram/john_doe"
+                    "example": "/ws/wa/john_doe/Vb3kq9XhY2tPz0aL?ticket=3q2b7wQxLk..."
                 }
             }
         },
@@ -457,6 +1339,84 @@ const docTemplate = `{
                     "example": "john_doe"
                 }
             }
+        },
+        "main.LoginStatus": {
+            "description": "Represents the state of a device login and the code it is awaiting",
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "description": "When the login expires unless it moves on, unset once it ended",
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "Vb3kq9XhY2tPz0aL"
+                },
+                "input": {
+                    "description": "Input of the login step to answer while awaiting_input",
+                    "type": "string",
+                    "example": "code"
+                },
+                "method": {
+                    "type": "string",
+                    "example": "qr"
+                },
+                "pairing_code": {
+                    "description": "Code to enter on the phone while awaiting_scan",
+                    "type": "string",
+                    "example": "ABCD-EFGH"
+                },
+                "phone_number": {
+                    "description": "Number the device was linked to",
+                    "type": "string",
+                    "example": "+1234567890"
+                },
+                "platform": {
+                    "type": "string",
+                    "example": "wa"
+                },
+                "qr": {
+                    "description": "Text of the QR code to scan while awaiting_scan",
+                    "type": "string",
+                    "example": "2@Xb4v..."
+                },
+                "reason": {
+                    "type": "string",
+                    "example": "Login failed: Entering code or scanning QR timed out"
+                },
+                "state": {
+                    "type": "string",
+                    "example": "awaiting_scan"
+                },
+                "transitions": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.LoginTransition"
+                    }
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.LoginTransition": {
+            "description": "A state a device login entered",
+            "type": "object",
+            "properties": {
+                "at": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "state": {
+                    "type": "string",
+                    "example": "pending"
+                }
+            }
         }
     }
 }`
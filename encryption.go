@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// EncryptedClients holds the syncing client of every user whose crypto
+// machine is running. Only these clients share olm/megolm sessions with the
+// bridges, so anything sent into an encrypted room has to go through them.
+type EncryptedClients struct {
+	mutex   sync.RWMutex
+	clients map[string]*mautrix.Client
+	closers map[string]io.Closer
+}
+
+var GlobalEncryptedClients = EncryptedClients{
+	clients: make(map[string]*mautrix.Client),
+	closers: make(map[string]io.Closer),
+}
+
+func (ec *EncryptedClients) Get(username string) (*mautrix.Client, bool) {
+	ec.mutex.RLock()
+	defer ec.mutex.RUnlock()
+	client, ok := ec.clients[username]
+	return client, ok
+}
+
+func (ec *EncryptedClients) add(username string, client *mautrix.Client, closer io.Closer) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	ec.clients[username] = client
+	ec.closers[username] = closer
+}
+
+func (ec *EncryptedClients) Remove(username string) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	if closer, ok := ec.closers[username]; ok {
+		if err := closer.Close(); err != nil {
+			log.Println("Error closing crypto store for:", username, err)
+		}
+	}
+	delete(ec.clients, username)
+	delete(ec.closers, username)
+}
+
+func CryptoStoreFilepath(username string) string {
+	return filepath.Join(cfg().Database.GetDir(), username+".crypto.db")
+}
+
+// EnableEncryption attaches a crypto machine backed by the user's crypto store
+// to the client. It has to be called after the syncer has been set and before
+// syncing starts, so encrypted events are decrypted and dispatched like any
+// other message.
+func (m *MatrixClient) EnableEncryption(ctx context.Context) error {
+	if cfg().Encryption.PickleKey == "" {
+		return fmt.Errorf("encryption is enabled but no pickle_key is configured")
+	}
+
+	username := m.Client.UserID.Localpart()
+
+	if m.Client.DeviceID == "" {
+		resp, err := m.Client.Whoami(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to resolve device ID: %w", err)
+		}
+		m.Client.DeviceID = resp.DeviceID
+	}
+
+	// The crypto helper manages its own persistent state store, which is what
+	// tells it which rooms are encrypted.
+	m.Client.StateStore = nil
+
+	closer, err := initCrypto(ctx, m.Client, []byte(cfg().Encryption.PickleKey), CryptoStoreFilepath(username))
+	if err != nil {
+		return err
+	}
+
+	GlobalEncryptedClients.add(username, m.Client, closer)
+	log.Println("[+] Encryption enabled for:", username, m.Client.DeviceID)
+
+	return nil
+}
+
+// IsRoomEncrypted reports whether the client knows the room to be encrypted.
+func IsRoomEncrypted(ctx context.Context, client *mautrix.Client, roomID id.RoomID) (bool, error) {
+	if client.Crypto == nil || client.StateStore == nil {
+		return false, nil
+	}
+	return client.StateStore.IsEncrypted(ctx, roomID)
+}
+
+// EncryptAttachment encrypts data for upload into an encrypted room and
+// returns the ciphertext together with the key material the receiver needs.
+func EncryptAttachment(data []byte) ([]byte, *attachment.EncryptedFile) {
+	file := attachment.NewEncryptedFile()
+	return file.Encrypt(data), file
+}
+
+// DownloadMedia fetches the media of a message, decrypting it when it was
+// sent as an encrypted attachment.
+func DownloadMedia(client *mautrix.Client, content *event.MessageEventContent) ([]byte, error) {
+	if content.File == nil {
+		return ParseImage(client, string(content.URL))
+	}
+
+	ciphertext, err := ParseImage(client, string(content.File.URL))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := content.File.PrepareForDecryption(); err != nil {
+		return nil, err
+	}
+
+	return content.File.Decrypt(ciphertext)
+}
@@ -0,0 +1,15 @@
+//go:build !goolm
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"maunium.net/go/mautrix"
+)
+
+func initCrypto(ctx context.Context, client *mautrix.Client, pickleKey []byte, storePath string) (io.Closer, error) {
+	return nil, fmt.Errorf("encryption is enabled but this binary was built without it, rebuild with -tags goolm")
+}
@@ -0,0 +1,33 @@
+//go:build goolm
+
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/cryptohelper"
+	"maunium.net/go/mautrix/event"
+)
+
+func initCrypto(ctx context.Context, client *mautrix.Client, pickleKey []byte, storePath string) (io.Closer, error) {
+	helper, err := cryptohelper.NewCryptoHelper(client, pickleKey, storePath)
+	if err != nil {
+		return nil, err
+	}
+
+	helper.DecryptErrorCallback = func(evt *event.Event, err error) {
+		log.Println("Failed decrypting event:", evt.ID, evt.RoomID, err)
+	}
+
+	if err := helper.Init(ctx); err != nil {
+		helper.Close()
+		return nil, err
+	}
+
+	client.Crypto = helper
+
+	return helper, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Health of a bridge, as seen from the management room of a user.
+const (
+	BridgeHealthy   = "healthy"
+	BridgeUnhealthy = "unhealthy"
+	BridgeUnknown   = "unknown"
+)
+
+const (
+	defaultBridgeHealthInterval = time.Minute
+	defaultBridgeHealthTimeout  = 15 * time.Second
+	defaultBridgeHealthFailures = 2
+	bridgeHealthAlertTimeout    = 10 * time.Second
+)
+
+// ErrPingTimeout is returned when the bridge bot doesn't answer a ping in
+// time.
+var ErrPingTimeout = errors.New("the bridge did not answer the ping in time")
+
+// BridgeHealth is whether a bridge bot answers in the management room of the
+// user, and what it last reported about its logins.
+// @Description Represents the health of a bridge, from the pings of its bot and the bridge states it reports
+// @name BridgeHealth
+// @type object
+type BridgeHealth struct {
+	Platform      string     `json:"platform" example:"wa"`                      // Platform of the bridge
+	Status        string     `json:"status" example:"healthy"`                   // healthy, unhealthy or unknown
+	Latency       int64      `json:"latency_ms,omitempty" example:"250"`         // How long the bot took to answer the last ping, in milliseconds
+	Failures      int        `json:"failures" example:"0"`                       // Pings in a row the bot didn't answer
+	Error         string     `json:"error,omitempty"`                            // Why the last ping failed
+	LastPingAt    *time.Time `json:"last_ping_at,omitempty"`                     // When the bot was last pinged
+	LastReplyAt   *time.Time `json:"last_reply_at,omitempty"`                    // When the bot last answered a ping
+	BridgeState   string     `json:"bridge_state,omitempty" example:"CONNECTED"` // Last bridge state the bot reported
+	BridgeStateAt *time.Time `json:"bridge_state_at,omitempty"`                  // When the bot reported it
+}
+
+// evaluate sets the status from the pings and the last bridge state.
+func (h *BridgeHealth) evaluate(failures int) {
+	switch {
+	case h.Failures >= failures, status.BridgeStateEvent(h.BridgeState) == status.StateBridgeUnreachable:
+		h.Status = BridgeUnhealthy
+	case h.LastReplyAt != nil:
+		h.Status = BridgeHealthy
+	default:
+		h.Status = BridgeUnknown
+	}
+}
+
+// BridgeHealthAlert is what the alert webhooks receive when a bridge turns
+// unhealthy or recovers.
+type BridgeHealthAlert struct {
+	Event    string       `json:"event"`
+	Username string       `json:"username"`
+	Bridge   BridgeHealth `json:"bridge"`
+}
+
+// HealthMonitor holds the health of the bridges of every syncing user.
+type HealthMonitor struct {
+	mutex   sync.Mutex
+	bridges map[string]map[string]*BridgeHealth
+}
+
+var GlobalBridgeHealth = HealthMonitor{
+	bridges: make(map[string]map[string]*BridgeHealth),
+}
+
+// Statuses returns the health of every configured bridge of username, unknown
+// for the ones not monitored.
+func (m *HealthMonitor) Statuses(username string) []BridgeHealth {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	statuses := make([]BridgeHealth, 0)
+	for _, entry := range cfg().Bridges {
+		for name := range entry {
+			if health, ok := m.bridges[username][name]; ok {
+				statuses = append(statuses, *health)
+			} else {
+				statuses = append(statuses, BridgeHealth{Platform: name, Status: BridgeUnknown})
+			}
+		}
+	}
+	return statuses
+}
+
+// Forget drops the health of the bridges of username, once it stops syncing.
+func (m *HealthMonitor) Forget(username string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.bridges, username)
+}
+
+// update applies fn to the health of platform for username and returns it
+// before and after.
+func (m *HealthMonitor) update(username, platform string, fn func(*BridgeHealth)) (BridgeHealth, BridgeHealth) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.bridges[username] == nil {
+		m.bridges[username] = make(map[string]*BridgeHealth)
+	}
+	health, ok := m.bridges[username][platform]
+	if !ok {
+		health = &BridgeHealth{Platform: platform, Status: BridgeUnknown}
+		m.bridges[username][platform] = health
+	}
+
+	before := *health
+	fn(health)
+	health.evaluate(cfg().BridgeHealth.GetFailures())
+	return before, *health
+}
+
+// RecordPing stores the outcome of a ping sent at.
+func (m *HealthMonitor) RecordPing(username, platform string, at time.Time, latency time.Duration, err error) (BridgeHealth, BridgeHealth) {
+	return m.update(username, platform, func(health *BridgeHealth) {
+		health.LastPingAt = &at
+		if err != nil {
+			health.Failures++
+			health.Error = err.Error()
+			return
+		}
+		replyAt := at.Add(latency)
+		health.Failures = 0
+		health.Error = ""
+		health.Latency = latency.Milliseconds()
+		health.LastReplyAt = &replyAt
+	})
+}
+
+// RecordState stores a bridge state the bot reported at.
+func (m *HealthMonitor) RecordState(username, platform, state string, at time.Time) (BridgeHealth, BridgeHealth) {
+	return m.update(username, platform, func(health *BridgeHealth) {
+		health.BridgeState = state
+		health.BridgeStateAt = &at
+	})
+}
+
+// Ping sends the ping command of the bridge into the management room and
+// returns how long the bot took to answer it.
+func (b *Bridges) Ping(ctx context.Context) (time.Duration, error) {
+	bridgeCfg, ok := cfg().GetBridgeConfig(b.Name)
+	if !ok {
+		return 0, fmt.Errorf("bridge config not found for: %s", b.Name)
+	}
+
+	pingCmd, exists := bridgeCfg.Cmd["ping"]
+	if !exists {
+		return 0, fmt.Errorf("ping command not found for: %s", b.Name)
+	}
+	// A broken pattern would never match the reply.
+	if _, err := cfg().CheckPingReplyPattern(b.Name, ""); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg().BridgeHealth.GetTimeout())
+	defer cancel()
+
+	sentAt := time.Now()
+	_, err := b.ask(ctx, "ping", pingCmd, func(evt *event.Event) bool {
+		matched, err := cfg().CheckPingReplyPattern(b.Name, evt.Content.AsMessage().Body)
+		return err == nil && matched
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 0, ErrPingTimeout
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(sentAt), nil
+}
+
+// HealthDaemon pings the bridge bot every interval until ctx is done, and
+// follows the bridge states it reports in the management room. Bridges
+// without a ping command only have their bridge states followed, until one
+// is configured.
+func (b *Bridges) HealthDaemon(ctx context.Context) {
+	bridgeCfg, ok := cfg().GetBridgeConfig(b.Name)
+	if !ok {
+		log.Println("Bridge config not found for:", b.Name)
+		return
+	}
+	username := b.Client.UserID.Localpart()
+
+	eventSubName := ReverseAliasForEventSubscriber(username, b.Name, cfg().HomeServerDomain) + "+health"
+	eventSince := time.Now().UTC()
+	eventSubscriber := EventSubscriber{
+		Name:   eventSubName,
+		Since:  &eventSince,
+		RoomID: b.RoomID,
+		Callback: func(evt *event.Event) {
+			if evt.Sender != id.UserID(b.BotName) || evt.Type != event.EventMessage {
+				return
+			}
+			state, ok := bridgeState(evt)
+			if !ok {
+				return
+			}
+			before, after := GlobalBridgeHealth.RecordState(username, b.Name, string(state.StateEvent), time.UnixMilli(evt.Timestamp))
+			alertBridgeHealth(username, before, after)
+		},
+	}
+	AddEventSubscriber(eventSubscriber)
+	defer RemoveEventSubscriber(eventSubName)
+
+	ticker := time.NewTicker(cfg().BridgeHealth.GetInterval())
+	defer ticker.Stop()
+	for {
+		if _, ok := bridgeCfg.Cmd["ping"]; ok {
+			at := time.Now()
+			latency, err := b.Ping(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Println("Error pinging bridge:", err, b.Name)
+			}
+			before, after := GlobalBridgeHealth.RecordPing(username, b.Name, at, latency, err)
+			alertBridgeHealth(username, before, after)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// The configuration may have changed since.
+		if bridgeCfg, ok = cfg().GetBridgeConfig(b.Name); !ok {
+			log.Println("Bridge removed from the configuration, no longer monitoring it:", b.Name)
+			return
+		}
+		ticker.Reset(cfg().BridgeHealth.GetInterval())
+	}
+}
+
+// alertBridgeHealth calls the alert webhooks when a bridge turned unhealthy
+// or recovered.
+func alertBridgeHealth(username string, before, after BridgeHealth) {
+	var alert string
+	switch {
+	case after.Status == BridgeUnhealthy && before.Status != BridgeUnhealthy:
+		alert = "bridge.unhealthy"
+	case after.Status == BridgeHealthy && before.Status == BridgeUnhealthy:
+		alert = "bridge.recovered"
+	default:
+		return
+	}
+	log.Printf("[!] Bridge %s of %s is %s: %s", after.Platform, username, after.Status, after.Error)
+
+	body, err := json.Marshal(BridgeHealthAlert{Event: alert, Username: username, Bridge: after})
+	if err != nil {
+		log.Println("Error encoding bridge health alert:", err)
+		return
+	}
+	for _, webhook := range cfg().BridgeHealth.Webhooks {
+		GlobalShutdown.Go(func() {
+			if err := sendAlert(GlobalShutdown.Context(), webhook, body); err != nil {
+				log.Println("Error sending bridge health alert:", err, webhook.URL)
+			}
+		})
+	}
+}
+
+func sendAlert(ctx context.Context, webhook AlertWebhook, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, bridgeHealthAlertTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, webhook.GetMethod(), webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
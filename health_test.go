@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthMonitorRecord(t *testing.T) {
+	useTestConfig(t, &Conf{
+		Bridges:      []map[string]BridgeConfig{{"wa": {}}, {"signal": {}}},
+		BridgeHealth: BridgeHealthConfig{Failures: 2},
+	})
+
+	monitor := HealthMonitor{bridges: make(map[string]map[string]*BridgeHealth)}
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		record     func() (BridgeHealth, BridgeHealth)
+		wantStatus string
+	}{
+		{
+			"Answered ping",
+			func() (BridgeHealth, BridgeHealth) {
+				return monitor.RecordPing("alice", "wa", now, 250*time.Millisecond, nil)
+			},
+			BridgeHealthy,
+		},
+		{
+			"Missed ping below the threshold",
+			func() (BridgeHealth, BridgeHealth) { return monitor.RecordPing("alice", "wa", now, 0, ErrPingTimeout) },
+			BridgeHealthy,
+		},
+		{
+			"Missed pings reach the threshold",
+			func() (BridgeHealth, BridgeHealth) { return monitor.RecordPing("alice", "wa", now, 0, ErrPingTimeout) },
+			BridgeUnhealthy,
+		},
+		{
+			"Answered ping recovers",
+			func() (BridgeHealth, BridgeHealth) {
+				return monitor.RecordPing("alice", "wa", now, 100*time.Millisecond, nil)
+			},
+			BridgeHealthy,
+		},
+		{
+			"Unreachable bridge state",
+			func() (BridgeHealth, BridgeHealth) {
+				return monitor.RecordState("alice", "wa", "BRIDGE_UNREACHABLE", now)
+			},
+			BridgeUnhealthy,
+		},
+		{
+			"Connected bridge state",
+			func() (BridgeHealth, BridgeHealth) { return monitor.RecordState("alice", "wa", "CONNECTED", now) },
+			BridgeHealthy,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, after := tt.record(); after.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", after.Status, tt.wantStatus)
+			}
+		})
+	}
+
+	statuses := monitor.Statuses("alice")
+	if len(statuses) != 2 || statuses[0].Latency != 100 || statuses[1].Status != BridgeUnknown {
+		t.Errorf("statuses = %+v", statuses)
+	}
+
+	monitor.Forget("alice")
+	if statuses := monitor.Statuses("alice"); statuses[0].Status != BridgeUnknown {
+		t.Errorf("status after forget = %q, want %q", statuses[0].Status, BridgeUnknown)
+	}
+}
+
+func TestAlertBridgeHealth(t *testing.T) {
+	alerts := make(chan BridgeHealthAlert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert BridgeHealthAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Error(err)
+		}
+		alerts <- alert
+	}))
+	t.Cleanup(server.Close)
+
+	useTestConfig(t, &Conf{BridgeHealth: BridgeHealthConfig{Webhooks: []AlertWebhook{{URL: server.URL}}}})
+
+	healthy := BridgeHealth{Platform: "wa", Status: BridgeHealthy}
+	unhealthy := BridgeHealth{Platform: "wa", Status: BridgeUnhealthy, Failures: 2, Error: ErrPingTimeout.Error()}
+
+	alertBridgeHealth("alice", healthy, healthy)
+	alertBridgeHealth("alice", healthy, unhealthy)
+
+	select {
+	case alert := <-alerts:
+		if alert.Event != "bridge.unhealthy" || alert.Username != "alice" || alert.Bridge.Failures != 2 {
+			t.Errorf("alert = %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert was sent")
+	}
+
+	select {
+	case alert := <-alerts:
+		t.Errorf("unexpected alert %+v", alert)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
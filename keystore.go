@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -11,45 +13,35 @@ import (
 )
 
 type Keystore struct {
-	connection *sql.DB
+	connection *SQLDatabase
 	filepath   string
 }
 
-func (ks *Keystore) Init() {
-	db, err := sql.Open("sqlite3", ks.filepath)
-	if err != nil {
-		panic(err)
-	}
-	ks.connection = db
-
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS users ( 
-		id INTEGER PRIMARY KEY AUTOINCREMENT, 
-		username TEXT NOT NULL UNIQUE, 
-		accessToken TEXT NOT NULL,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-	`)
-
+func (ks *Keystore) CreateUser(username string, accessToken string) error {
+	encryptedAccessToken, err := GlobalMasterKeys.EncryptString(accessToken, secretOwner("users", username))
 	if err != nil {
-		panic(err)
+		return err
 	}
-}
 
-func (ks *Keystore) CreateUser(username string, accessToken string) error {
 	tx, err := ks.connection.Begin()
 	if err != nil {
 		return err
 	}
 
-	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO users (username, accessToken) values(?,?)`)
+	stmt, err := tx.Prepare(`
+		INSERT INTO users (username, accessToken, accessTokenHash) VALUES (?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET
+			accessToken = excluded.accessToken,
+			accessTokenHash = excluded.accessTokenHash,
+			timestamp = CURRENT_TIMESTAMP
+	`)
 	if err != nil {
 		return err
 	}
 
 	defer stmt.Close()
 
-	_, err = stmt.Exec(username, accessToken)
+	_, err = stmt.Exec(username, encryptedAccessToken, AccessTokenHash(accessToken))
 	if err != nil {
 		return err
 	}
@@ -62,6 +54,45 @@ func (ks *Keystore) CreateUser(username string, accessToken string) error {
 	return nil
 }
 
+// FetchUserByAccessToken returns the user whose stored access token is
+// accessToken, or sql.ErrNoRows when there is none.
+func (ks *Keystore) FetchUserByAccessToken(accessToken string) (Users, error) {
+	var user Users
+	var stored string
+	err := ks.connection.QueryRow(
+		"select id, username, accessToken from users where accessTokenHash = ?",
+		AccessTokenHash(accessToken),
+	).Scan(&user.ID, &user.Username, &stored)
+	if err != nil {
+		return Users{}, err
+	}
+
+	stored, err = GlobalMasterKeys.DecryptString(stored, secretOwner("users", user.Username))
+	if err != nil {
+		return Users{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(accessToken)) != 1 {
+		return Users{}, sql.ErrNoRows
+	}
+
+	user.AccessToken = stored
+	return user, nil
+}
+
+// RemoveAccessToken forgets the token username syncs with once it has been
+// logged out, which stops SyncAllClients from picking the user up again.
+func (ks *Keystore) RemoveAccessToken(username string) error {
+	_, err := ks.connection.Exec(
+		"UPDATE users SET accessToken = '', accessTokenHash = NULL, timestamp = CURRENT_TIMESTAMP WHERE username = ?",
+		username,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to remove access token: %w", err)
+	}
+	return nil
+}
+
 func (ks *Keystore) FetchUser(username string) (Users, error) {
 	stmt, err := ks.connection.Prepare("select id, username, accessToken from users where username = ?")
 	if err != nil {
@@ -78,11 +109,16 @@ func (ks *Keystore) FetchUser(username string) (Users, error) {
 		return Users{}, err
 	}
 
+	_accessToken, err = GlobalMasterKeys.DecryptString(_accessToken, secretOwner("users", _username))
+	if err != nil {
+		return Users{}, err
+	}
+
 	return Users{ID: id, Username: _username, AccessToken: _accessToken}, nil
 }
 
 func (ks *Keystore) FetchAllUsers() ([]Users, error) {
-	stmt, err := ks.connection.Prepare("select id, username, accessToken from users")
+	stmt, err := ks.connection.Prepare("select id, username, accessToken from users where accessToken != ''")
 	if err != nil {
 		return []Users{}, err
 	}
@@ -107,71 +143,36 @@ func (ks *Keystore) FetchAllUsers() ([]Users, error) {
 			return []Users{}, err
 		}
 
+		_accessToken, err = GlobalMasterKeys.DecryptString(_accessToken, secretOwner("users", _username))
+		if err != nil {
+			return []Users{}, err
+		}
+
 		users = append(users, Users{ID: id, Username: _username, AccessToken: _accessToken})
 	}
 
 	return users, nil
 }
 
-// https://github.com/mattn/go-sqlite3/blob/v1.14.28/_example/simple/simple.go
-func (clientDb *ClientDB) Init() error {
-	db, err := sql.Open("sqlite3", clientDb.filepath)
-	if err != nil {
-		return err
-	}
-
-	clientDb.connection = db
-
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS clients ( 
-	id INTEGER PRIMARY KEY AUTOINCREMENT, 
-	username TEXT NOT NULL UNIQUE, 
-	password TEXT NOT NULL,
-	accessToken TEXT NOT NULL, 
-	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS rooms ( 
-	id INTEGER PRIMARY KEY AUTOINCREMENT, 
-	clientUsername TEXT NOT NULL,
-	roomID TEXT NOT NULL,
-	platformName TEXT NOT NULL,
-	members TEXT NOT NULL,
-	deviceName TEXT,
-	isBridge INTEGER NOT NULL,
-	sessions BLOB,
-	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP, 
-	sessionsTimestamp DATETIME DEFAULT CURRENT_TIMESTAMP, 
-	UNIQUE(clientUsername, roomID, platformName, isBridge)
-	);
-	
-	CREATE TABLE IF NOT EXISTS webhooks (
-	id INTEGER PRIMARY KEY AUTOINCREMENT, 
-	clientUsername TEXT NOT NULL,
-	deviceName TEXT NOT NULL,
-	url TEXT NOT NULL,
-	method TEXT NOT NULL,
-	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP, 
-	UNIQUE(clientUsername, deviceName, url, method)
-	);
-	`)
+func (clientDb *ClientDB) AuthenticateAccessToken(username string, accessToken string) (bool, error) {
+	query := `SELECT accessToken FROM clients WHERE username = ?`
 
+	var stored string
+	err := clientDb.connection.QueryRow(query, username).Scan(&stored)
 	if err != nil {
-		return err
+		if err == sql.ErrNoRows {
+			log.Printf("[-] Authentication failed for user: %s", username)
+			return false, nil
+		}
+		return false, fmt.Errorf("authentication query failed: %w", err)
 	}
-	return err
-}
-
-func (clientDb *ClientDB) AuthenticateAccessToken(username string, accessToken string) (bool, error) {
-	query := `SELECT COUNT(*) FROM clients WHERE username = ? AND accessToken = ?`
 
-	var count int
-	err := clientDb.connection.QueryRow(query, username, accessToken).Scan(&count)
+	storedAccessToken, err := GlobalMasterKeys.Decrypt(stored, secretOwner("clients", username))
 	if err != nil {
-		return false, fmt.Errorf("authentication query failed: %w", err)
+		return false, fmt.Errorf("authentication failed: %w", err)
 	}
 
-	if count == 0 {
+	if subtle.ConstantTimeCompare(storedAccessToken, []byte(accessToken)) != 1 {
 		log.Printf("[-] Authentication failed for user: %s", username)
 		return false, nil
 	}
@@ -181,10 +182,10 @@ func (clientDb *ClientDB) AuthenticateAccessToken(username string, accessToken s
 }
 
 func (clientDb *ClientDB) Authenticate(username string, password string) (bool, error) {
-	query := `SELECT COUNT(*) FROM clients WHERE username = ? AND password = ?`
+	query := `SELECT password FROM clients WHERE username = ?`
 
-	var count int
-	err := clientDb.connection.QueryRow(query, username, password).Scan(&count)
+	var stored string
+	err := clientDb.connection.QueryRow(query, username).Scan(&stored)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.Printf("[-] Authentication failed for user: %s", username)
@@ -193,7 +194,24 @@ func (clientDb *ClientDB) Authenticate(username string, password string) (bool,
 		return false, fmt.Errorf("authentication query failed: %w", err)
 	}
 
-	if count == 0 {
+	var matched bool
+	if IsHashedPassword(stored) {
+		matched, err = VerifyPassword(stored, password)
+		if err != nil {
+			return false, fmt.Errorf("authentication failed: %w", err)
+		}
+	} else {
+		// Rows written before passwords were hashed hold the plaintext, they
+		// are upgraded as soon as the user proves they know it.
+		matched = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		if matched {
+			if err := clientDb.UpdatePassword(username, password); err != nil {
+				log.Printf("[-] Failed migrating password hash for user: %s: %v", username, err)
+			}
+		}
+	}
+
+	if !matched {
 		log.Printf("[-] Authentication failed for user: %s", username)
 		return false, nil
 	}
@@ -202,15 +220,39 @@ func (clientDb *ClientDB) Authenticate(username string, password string) (bool,
 	return true, nil
 }
 
+func (clientDb *ClientDB) UpdatePassword(username string, password string) error {
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = clientDb.connection.Exec(`UPDATE clients SET password = ? WHERE username = ?`, hashedPassword, username)
+	return err
+}
+
 func (clientDb *ClientDB) Store(accessToken string, password string) error {
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	encryptedAccessToken, err := GlobalMasterKeys.EncryptString(accessToken, secretOwner("clients", clientDb.username))
+	if err != nil {
+		return err
+	}
+
 	tx, err := clientDb.connection.Begin()
 	if err != nil {
 		return err
 	}
 
 	stmt, err := tx.Prepare(`
-		INSERT OR REPLACE INTO clients (username, accessToken, password, timestamp) 
+		INSERT INTO clients (username, accessToken, password, timestamp) 
 		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (username) DO UPDATE SET
+			accessToken = excluded.accessToken,
+			password = excluded.password,
+			timestamp = CURRENT_TIMESTAMP
 	`)
 	if err != nil {
 		return err
@@ -218,7 +260,7 @@ func (clientDb *ClientDB) Store(accessToken string, password string) error {
 
 	defer stmt.Close()
 
-	_, err = stmt.Exec(clientDb.username, accessToken, password)
+	_, err = stmt.Exec(clientDb.username, encryptedAccessToken, hashedPassword)
 	if err != nil {
 		return err
 	}
@@ -249,11 +291,23 @@ func (clientDb *ClientDB) Fetch() (string, error) {
 		}
 		return accessToken, err
 	}
-	return accessToken, err
+	return GlobalMasterKeys.DecryptString(accessToken, secretOwner("clients", clientDb.username))
+}
+
+// RemoveAccessToken forgets the token of username once it has been logged
+// out, so the next password login asks the homeserver for a new one.
+func (clientDb *ClientDB) RemoveAccessToken(username string) error {
+	_, err := clientDb.connection.Exec("UPDATE clients SET accessToken = '' WHERE username = ?", username)
+	if err != nil {
+		return fmt.Errorf("failed to remove access token: %w", err)
+	}
+	return nil
 }
 
 func (clientDb *ClientDB) Close() {
-	defer clientDb.connection.Close()
+	if clientDb.release != nil {
+		clientDb.release()
+	}
 }
 
 func (clientDb *ClientDB) StoreRooms(
@@ -268,9 +322,13 @@ func (clientDb *ClientDB) StoreRooms(
 		return err
 	}
 
-	stmt, err := tx.Prepare(
-		`INSERT OR REPLACE INTO rooms (clientUsername, roomID, platformName, deviceName, members, isBridge) values(?,?,?,?,?,?)`,
-	)
+	stmt, err := tx.Prepare(`
+		INSERT INTO rooms (clientUsername, roomID, platformName, deviceName, members, isBridge) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (clientUsername, roomID, platformName, isBridge) DO UPDATE SET
+			deviceName = excluded.deviceName,
+			members = excluded.members,
+			timestamp = CURRENT_TIMESTAMP
+	`)
 	if err != nil {
 		return err
 	}
@@ -293,7 +351,7 @@ func (clientDb *ClientDB) StoreRooms(
 
 func (clientDb *ClientDB) FetchRooms(roomID string) (Rooms, error) {
 	stmt, err := clientDb.connection.Prepare(
-		"select clientUsername, roomID, platformName, deviceName, members, isBridge from rooms where roomID = ?",
+		"select clientUsername, roomID, platformName, deviceName, members, isBridge from rooms where clientUsername = ? and roomID = ?",
 	)
 	if err != nil {
 		return Rooms{}, err
@@ -307,7 +365,7 @@ func (clientDb *ClientDB) FetchRooms(roomID string) (Rooms, error) {
 
 	defer stmt.Close()
 
-	err = stmt.QueryRow(roomID).Scan(&clientUsername, &_roomID, &platformName, &deviceName, &members, &isBridge)
+	err = stmt.QueryRow(clientDb.username, roomID).Scan(&clientUsername, &_roomID, &platformName, &deviceName, &members, &isBridge)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return Rooms{}, nil
@@ -330,14 +388,14 @@ func (clientDb *ClientDB) FetchRooms(roomID string) (Rooms, error) {
 func (clientDb *ClientDB) FetchRoomsByMembers(members string) ([]Rooms, error) {
 	log.Println("Fetching room members for", members, clientDb.filepath)
 	stmt, err := clientDb.connection.Prepare(
-		"select clientUsername, roomID, platformName, deviceName, members, isBridge from rooms where members = ?",
+		"select clientUsername, roomID, platformName, deviceName, members, isBridge from rooms where clientUsername = ? and members = ?",
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(members)
+	rows, err := stmt.Query(clientDb.username, members)
 	if err != nil {
 		return nil, err
 	}
@@ -378,7 +436,7 @@ func (clientDb *ClientDB) FetchRoomsByMembers(members string) ([]Rooms, error) {
 func (clientDb *ClientDB) FetchBridgeRooms(username string) ([]*Bridges, error) {
 	// log.Println("Fetching bridge rooms for", username, clientDb.filepath)
 	stmt, err := clientDb.connection.Prepare(
-		"select clientUsername, roomID, platformName, deviceName, members, isBridge from rooms where clientUsername = ? and isBridge = 1",
+		"select clientUsername, roomID, platformName, deviceName, members, isBridge from rooms where clientUsername = ? and isBridge = ?",
 	)
 	if err != nil {
 		return []*Bridges{}, err
@@ -386,7 +444,7 @@ func (clientDb *ClientDB) FetchBridgeRooms(username string) ([]*Bridges, error)
 
 	defer stmt.Close()
 
-	rows, err := stmt.Query(username)
+	rows, err := stmt.Query(username, true)
 	if err != nil {
 		return []*Bridges{}, err
 	}
@@ -418,86 +476,167 @@ func (clientDb *ClientDB) FetchBridgeRooms(username string) ([]*Bridges, error)
 	return bridges, err
 }
 
-func (clientDb *ClientDB) FetchActiveSessions(username string) ([]byte, time.Time, error) {
-	stmt, err := clientDb.connection.Prepare("select sessions, sessionsTimestamp from rooms where clientUsername = ? and isBridge = 1")
-	if err != nil {
-		return []byte{}, time.Time{}, err
-	}
-	defer stmt.Close()
-
+// FetchActiveSessions returns the code the login session loginID on
+// platformName is awaiting, empty when it has none.
+func (clientDb *ClientDB) FetchActiveSessions(platformName string, loginID string) ([]byte, error) {
 	var sessions []byte
-	var sessionsTimestamp time.Time
-	err = stmt.QueryRow(username).Scan(&sessions, &sessionsTimestamp)
+	err := clientDb.connection.QueryRow(
+		"select sessions from login_sessions where id = ? and clientUsername = ? and platformName = ?",
+		loginID, clientDb.username, platformName,
+	).Scan(&sessions)
 	if err != nil {
-		return []byte{}, time.Time{}, err
+		return []byte{}, err
 	}
-	return sessions, sessionsTimestamp, nil
-}
 
-func (clientDb *ClientDB) StoreActiveSessions(username string, sessions []byte) error {
-	tx, err := clientDb.connection.Begin()
-	if err != nil {
-		return err
+	if len(sessions) == 0 {
+		return sessions, nil
 	}
 
-	stmt, err := tx.Prepare("UPDATE rooms SET sessions = ?, sessionsTimestamp = CURRENT_TIMESTAMP WHERE clientUsername = ? AND isBridge = 1")
+	return GlobalMasterKeys.Decrypt(string(sessions), secretOwner("login_sessions", clientDb.username, loginID))
+}
+
+func (clientDb *ClientDB) StoreActiveSessions(platformName string, loginID string, sessions []byte) error {
+	encryptedSessions, err := GlobalMasterKeys.Encrypt(sessions, secretOwner("login_sessions", clientDb.username, loginID))
 	if err != nil {
 		return err
 	}
 
-	defer stmt.Close()
-
-	_, err = stmt.Exec(sessions, username)
+	_, err = clientDb.connection.Exec(
+		"update login_sessions set sessions = ? where id = ? and clientUsername = ? and platformName = ?",
+		[]byte(encryptedSessions), loginID, clientDb.username, platformName,
+	)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to store login code: %w", err)
 	}
+	return nil
+}
 
-	err = tx.Commit()
+func (clientDb *ClientDB) RemoveActiveSessions(platformName string, loginID string) error {
+	_, err := clientDb.connection.Exec(
+		"update login_sessions set sessions = NULL where id = ? and clientUsername = ? and platformName = ?",
+		loginID, clientDb.username, platformName,
+	)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to remove login code: %w", err)
 	}
-
 	return nil
 }
 
-func (clientDb *ClientDB) RemoveActiveSessions(username string) error {
-	tx, err := clientDb.connection.Begin()
+// RotateSecrets re-encrypts every stored access token under the current master
+// key, and hashes the ones stored before their hash was, so they resolve
+// without asking the homeserver.
+func (ks *Keystore) RotateSecrets(mk *MasterKeys) (int, error) {
+	rows, err := ks.connection.Query("select id, username, accessToken, accessTokenHash from users where accessToken != ''")
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	stmt, err := tx.Prepare("update rooms set sessions = NULL, sessionsTimestamp = CURRENT_TIMESTAMP where clientUsername = ?")
-	if err != nil {
-		return err
+	type rotatedUser struct {
+		accessToken     string
+		accessTokenHash string
 	}
+	rotated := make(map[int]rotatedUser)
+	for rows.Next() {
+		var id int
+		var username string
+		var accessToken string
+		var accessTokenHash sql.NullString
+		if err := rows.Scan(&id, &username, &accessToken, &accessTokenHash); err != nil {
+			rows.Close()
+			return 0, err
+		}
 
-	defer stmt.Close()
+		owner := secretOwner("users", username)
+		value, changed, err := mk.Rotate(accessToken, owner)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed rotating user %d: %w", id, err)
+		}
 
-	_, err = stmt.Exec(username)
-	if err != nil {
-		return err
+		hash := accessTokenHash.String
+		if hash == "" {
+			plaintext, err := mk.DecryptString(accessToken, owner)
+			if err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("failed hashing the access token of user %d: %w", id, err)
+			}
+			hash = AccessTokenHash(plaintext)
+			changed = true
+		}
+
+		if changed {
+			rotated[id] = rotatedUser{accessToken: value, accessTokenHash: hash}
+		}
 	}
+	rows.Close()
 
-	err = tx.Commit()
-	if err != nil {
-		return err
+	for id, user := range rotated {
+		if _, err := ks.connection.Exec("update users set accessToken = ?, accessTokenHash = ? where id = ?", user.accessToken, user.accessTokenHash, id); err != nil {
+			return 0, err
+		}
 	}
 
-	return nil
+	return len(rotated), nil
 }
 
-func IsActiveSessionsExpired(clientDb *ClientDB, username string) bool {
-	sessions, sessionsTimestamp, err := clientDb.FetchActiveSessions(username)
+// RotateSecrets re-encrypts the stored access token and bridge session blobs
+// under the current master key.
+func (clientDb *ClientDB) RotateSecrets(mk *MasterKeys) (int, error) {
+	count := 0
+
+	var accessToken string
+	err := clientDb.connection.QueryRow("select accessToken from clients where username = ? and accessToken != ''", clientDb.username).Scan(&accessToken)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err == nil {
+		value, changed, err := mk.Rotate(accessToken, secretOwner("clients", clientDb.username))
+		if err != nil {
+			return 0, fmt.Errorf("failed rotating client access token: %w", err)
+		}
+		if changed {
+			if _, err := clientDb.connection.Exec("update clients set accessToken = ? where username = ?", value, clientDb.username); err != nil {
+				return 0, err
+			}
+			count++
+		}
+	}
+
+	rows, err := clientDb.connection.Query("select id, sessions from login_sessions where clientUsername = ? and sessions is not null", clientDb.username)
 	if err != nil {
-		return true
+		return 0, err
 	}
 
-	if sessionsTimestamp.IsZero() || len(sessions) == 0 {
-		return true
+	rotated := make(map[string]string)
+	for rows.Next() {
+		var id string
+		var sessions []byte
+		if err := rows.Scan(&id, &sessions); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if len(sessions) == 0 {
+			continue
+		}
+
+		value, changed, err := mk.Rotate(string(sessions), secretOwner("login_sessions", clientDb.username, id))
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed rotating code of login session %s: %w", id, err)
+		}
+		if changed {
+			rotated[id] = value
+		}
 	}
+	rows.Close()
 
-	now := time.Now()
-	return now.After(sessionsTimestamp.Add(16 * time.Second))
+	for id, value := range rotated {
+		if _, err := clientDb.connection.Exec("update login_sessions set sessions = ? where id = ? and clientUsername = ?", []byte(value), id, clientDb.username); err != nil {
+			return 0, err
+		}
+	}
+
+	return count + len(rotated), nil
 }
 
 // Webhook CRUD methods
@@ -510,8 +649,9 @@ func (clientDb *ClientDB) CreateWebhook(deviceName string, url string, method st
 	}
 
 	stmt, err := tx.Prepare(`
-		INSERT OR REPLACE INTO webhooks (clientUsername, deviceName, url, method, timestamp) 
+		INSERT INTO webhooks (clientUsername, deviceName, url, method, timestamp) 
 		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (clientUsername, deviceName, url, method) DO UPDATE SET timestamp = CURRENT_TIMESTAMP
 	`)
 	if err != nil {
 		return err
@@ -785,3 +925,332 @@ func (clientDb *ClientDB) DeleteWebhooksByDevice(deviceName string) error {
 
 	return nil
 }
+
+const apiKeyColumns = "id, username, name, prefix, scopes, allowedIPs, expiresAt, lastUsedAt, timestamp"
+
+func scanAPIKey(row interface{ Scan(...any) error }) (APIKey, error) {
+	var key APIKey
+	var scopes, allowedIPs string
+	var expiresAt, lastUsedAt sql.NullTime
+
+	err := row.Scan(
+		&key.ID, &key.Username, &key.Name, &key.Prefix,
+		&scopes, &allowedIPs, &expiresAt, &lastUsedAt, &key.CreatedAt,
+	)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	key.Scopes = splitList(scopes)
+	key.AllowedIPs = splitList(allowedIPs)
+	key.ExpiresAt = nullTimePtr(expiresAt)
+	key.LastUsedAt = nullTimePtr(lastUsedAt)
+	return key, nil
+}
+
+// CreateAPIKey stores key under the hash of its secret, which is never
+// stored itself.
+func (ks *Keystore) CreateAPIKey(key *APIKey, keyHash string) error {
+	var expiresAt sql.NullTime
+	if key.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: key.ExpiresAt.UTC(), Valid: true}
+	}
+
+	err := ks.connection.QueryRow(`
+		INSERT INTO api_keys (username, name, prefix, keyHash, scopes, allowedIPs, expiresAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, timestamp
+	`,
+		key.Username, key.Name, key.Prefix, keyHash,
+		joinList(key.Scopes), joinList(key.AllowedIPs), expiresAt,
+	).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create api key: %w", err)
+	}
+
+	return nil
+}
+
+func (ks *Keystore) FetchAPIKeyByHash(keyHash string) (APIKey, error) {
+	row := ks.connection.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE keyHash = ?", keyHash)
+	return scanAPIKey(row)
+}
+
+func (ks *Keystore) FetchAPIKeys(username string) ([]APIKey, error) {
+	rows, err := ks.connection.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE username = ? ORDER BY id", username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// DeleteAPIKey revokes the key of username with id, reporting whether there
+// was one.
+func (ks *Keystore) DeleteAPIKey(username string, id int) (bool, error) {
+	result, err := ks.connection.Exec("DELETE FROM api_keys WHERE username = ? AND id = ?", username, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete api key: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (ks *Keystore) TouchAPIKey(id int) error {
+	_, err := ks.connection.Exec("UPDATE api_keys SET lastUsedAt = ? WHERE id = ?", time.Now().UTC(), id)
+	return err
+}
+
+func nullTime(value *time.Time) sql.NullTime {
+	if value == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: value.UTC(), Valid: true}
+}
+
+// CreateLoginSession stores a new device login with the states it went
+// through so far.
+func (clientDb *ClientDB) CreateLoginSession(session *LoginSession) error {
+	tx, err := clientDb.connection.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO login_sessions (id, clientUsername, platformName, method, state, reason, phoneNumber, roomID, expiresAt, updatedAt, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		session.ID, clientDb.username, session.Platform, session.Method, session.State, session.Reason,
+		session.PhoneNumber, session.RoomID, nullTime(session.ExpiresAt), session.UpdatedAt.UTC(), session.CreatedAt.UTC(),
+	)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to create login session: %w", err)
+	}
+
+	for _, transition := range session.Transitions {
+		if err := insertLoginTransition(tx, session.ID, transition); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UpdateLoginSession stores the current state of session, along with the
+// transition that led to it unless it is nil.
+func (clientDb *ClientDB) UpdateLoginSession(session *LoginSession, transition *LoginTransition) error {
+	tx, err := clientDb.connection.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE login_sessions SET method = ?, state = ?, reason = ?, phoneNumber = ?, roomID = ?, expiresAt = ?, updatedAt = ?
+		WHERE id = ? AND clientUsername = ?
+	`,
+		session.Method, session.State, session.Reason, session.PhoneNumber, session.RoomID,
+		nullTime(session.ExpiresAt), session.UpdatedAt.UTC(), session.ID, clientDb.username,
+	)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to update login session: %w", err)
+	}
+
+	if transition != nil {
+		if err := insertLoginTransition(tx, session.ID, *transition); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func insertLoginTransition(tx *SQLTx, sessionID string, transition LoginTransition) error {
+	_, err := tx.Exec(
+		"INSERT INTO login_session_transitions (loginSessionID, state, reason, timestamp) VALUES (?, ?, ?, ?)",
+		sessionID, transition.State, transition.Reason, transition.At.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store login transition: %w", err)
+	}
+	return nil
+}
+
+// FetchLoginSession returns the device login of the client with id, or
+// sql.ErrNoRows when there is none.
+func (clientDb *ClientDB) FetchLoginSession(id string) (LoginSession, error) {
+	session := LoginSession{Username: clientDb.username}
+	var expiresAt sql.NullTime
+
+	err := clientDb.connection.QueryRow(`
+		SELECT id, platformName, method, state, reason, phoneNumber, roomID, expiresAt, updatedAt, timestamp
+		FROM login_sessions WHERE id = ? AND clientUsername = ?
+	`, id, clientDb.username).Scan(
+		&session.ID, &session.Platform, &session.Method, &session.State, &session.Reason,
+		&session.PhoneNumber, &session.RoomID, &expiresAt, &session.UpdatedAt, &session.CreatedAt,
+	)
+	if err != nil {
+		return LoginSession{}, err
+	}
+	session.ExpiresAt = nullTimePtr(expiresAt)
+
+	rows, err := clientDb.connection.Query(`
+		SELECT t.state, t.reason, t.timestamp FROM login_session_transitions t
+		JOIN login_sessions s ON s.id = t.loginSessionID
+		WHERE t.loginSessionID = ? AND s.clientUsername = ? ORDER BY t.id
+	`, id, clientDb.username)
+	if err != nil {
+		return LoginSession{}, fmt.Errorf("failed to fetch login transitions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var transition LoginTransition
+		if err := rows.Scan(&transition.State, &transition.Reason, &transition.At); err != nil {
+			return LoginSession{}, fmt.Errorf("failed to scan login transition: %w", err)
+		}
+		session.Transitions = append(session.Transitions, transition)
+	}
+
+	return session, rows.Err()
+}
+
+// FetchLoginRooms returns the rooms earlier device logins of the client on
+// platformName ran in, for later logins to run in again.
+func (clientDb *ClientDB) FetchLoginRooms(platformName string) ([]string, error) {
+	rows, err := clientDb.connection.Query(
+		"SELECT DISTINCT roomID FROM login_sessions WHERE clientUsername = ? AND platformName = ? AND roomID != ''",
+		clientDb.username, platformName,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch login rooms: %w", err)
+	}
+	defer rows.Close()
+
+	var rooms []string
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			return nil, fmt.Errorf("failed to scan login room: %w", err)
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// SyncDevices stores the devices the bridge of platformName listed, keeping
+// when each was linked and last seen, and drops the devices it no longer
+// lists.
+func (clientDb *ClientDB) SyncDevices(platformName string, devices []Device, now time.Time) error {
+	now = now.UTC()
+	tx, err := clientDb.connection.Begin()
+	if err != nil {
+		return err
+	}
+
+	ids := make([]any, 0, len(devices)+2)
+	ids = append(ids, clientDb.username, platformName)
+	for _, device := range devices {
+		var lastSeenAt *time.Time
+		if device.State == DeviceStateConnected {
+			lastSeenAt = &now
+		}
+
+		_, err := tx.Exec(`
+			INSERT INTO devices (clientUsername, platformName, id, handle, displayName, state, linkedAt, lastSeenAt, updatedAt)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (clientUsername, platformName, id) DO UPDATE SET
+				handle = excluded.handle,
+				displayName = CASE WHEN excluded.displayName != '' THEN excluded.displayName ELSE devices.displayName END,
+				state = CASE WHEN excluded.state != ? THEN excluded.state ELSE devices.state END,
+				lastSeenAt = COALESCE(excluded.lastSeenAt, devices.lastSeenAt),
+				updatedAt = excluded.updatedAt
+		`,
+			clientDb.username, platformName, device.ID, device.Handle, device.DisplayName, device.State,
+			now, nullTime(lastSeenAt), now, DeviceStateUnknown,
+		)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to store device: %w", err)
+		}
+		ids = append(ids, device.ID)
+	}
+
+	query := "DELETE FROM devices WHERE clientUsername = ? AND platformName = ?"
+	if len(devices) > 0 {
+		query += " AND id NOT IN (?" + strings.Repeat(", ?", len(devices)-1) + ")"
+	}
+	if _, err := tx.Exec(query, ids...); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to remove unlisted devices: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// UpdateDeviceState stores the state the bridge of platformName reported for
+// the device with the login ID or handle device, reporting false when there
+// is no such device.
+func (clientDb *ClientDB) UpdateDeviceState(platformName string, device string, state string, now time.Time) (bool, error) {
+	now = now.UTC()
+	var lastSeenAt *time.Time
+	if state == DeviceStateConnected {
+		lastSeenAt = &now
+	}
+
+	result, err := clientDb.connection.Exec(`
+		UPDATE devices SET state = ?, lastSeenAt = COALESCE(?, lastSeenAt), updatedAt = ?
+		WHERE clientUsername = ? AND platformName = ? AND (id = ? OR handle = ?)
+	`, state, nullTime(lastSeenAt), now, clientDb.username, platformName, device, device)
+	if err != nil {
+		return false, fmt.Errorf("failed to update device state: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated > 0, nil
+}
+
+// FetchDevices returns the devices of the client on platformName, in the
+// order they were linked.
+func (clientDb *ClientDB) FetchDevices(platformName string) ([]Device, error) {
+	rows, err := clientDb.connection.Query(`
+		SELECT id, handle, displayName, state, linkedAt, lastSeenAt FROM devices
+		WHERE clientUsername = ? AND platformName = ? ORDER BY linkedAt, id
+	`, clientDb.username, platformName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := make([]Device, 0)
+	for rows.Next() {
+		device := Device{Platform: platformName}
+		var lastSeenAt sql.NullTime
+		if err := rows.Scan(&device.ID, &device.Handle, &device.DisplayName, &device.State, &device.LinkedAt, &lastSeenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		device.LastSeenAt = nullTimePtr(lastSeenAt)
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
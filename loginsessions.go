@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"slices"
+	"time"
+)
+
+// A device login starts pending until the bridge shows a QR or pairing code,
+// or asks for an input of one of its login steps, and ends in success,
+// failed, expired or cancelled.
+const (
+	LoginStatePending       = "pending"
+	LoginStateAwaitingScan  = "awaiting_scan"
+	LoginStateAwaitingInput = "awaiting_input"
+	LoginStateScanned       = "scanned"
+	LoginStateSuccess       = "success"
+	LoginStateFailed        = "failed"
+	LoginStateExpired       = "expired"
+	LoginStateCancelled     = "cancelled"
+)
+
+const (
+	defaultLoginPendingTimeout       = 5 * time.Minute
+	defaultLoginAwaitingScanTimeout  = 3 * time.Minute
+	defaultLoginAwaitingInputTimeout = 3 * time.Minute
+	defaultLoginScannedTimeout       = time.Minute
+)
+
+// loginTransitions lists the states each state may move to, the ones missing
+// are final.
+var loginTransitions = map[string][]string{
+	LoginStatePending: {
+		LoginStateAwaitingScan, LoginStateAwaitingInput, LoginStateScanned, LoginStateSuccess,
+		LoginStateFailed, LoginStateExpired, LoginStateCancelled,
+	},
+	LoginStateAwaitingScan: {
+		LoginStateAwaitingInput, LoginStateScanned, LoginStateSuccess,
+		LoginStateFailed, LoginStateExpired, LoginStateCancelled,
+	},
+	// Answered login steps go back to pending until the bridge replies.
+	LoginStateAwaitingInput: {
+		LoginStatePending, LoginStateAwaitingScan, LoginStateScanned, LoginStateSuccess,
+		LoginStateFailed, LoginStateExpired, LoginStateCancelled,
+	},
+	LoginStateScanned: {
+		LoginStateAwaitingInput, LoginStateSuccess, LoginStateFailed, LoginStateExpired, LoginStateCancelled,
+	},
+}
+
+// LoginSession is a device login of a user on a platform, persisted with
+// every state it went through.
+// @Description Represents a device login and the states it went through
+// @name LoginSession
+// @type object
+type LoginSession struct {
+	ID          string            `json:"id" example:"Vb3kq9XhY2tPz0aL"`
+	Username    string            `json:"-"`
+	Platform    string            `json:"platform" example:"wa"`
+	Method      string            `json:"method" example:"qr"`
+	State       string            `json:"state" example:"awaiting_scan"`
+	Reason      string            `json:"reason,omitempty" example:"Login failed: Entering code or scanning QR timed out"`
+	PhoneNumber string            `json:"phone_number,omitempty" example:"+1234567890"` // Number the device was linked to
+	RoomID      string            `json:"-"`                                            // Room of the bridge bot the login runs in
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`                         // When the login expires unless it moves on, unset once it ended
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	Transitions []LoginTransition `json:"transitions"`
+}
+
+// @Description A state a device login entered
+// @name LoginTransition
+// @type object
+type LoginTransition struct {
+	State  string    `json:"state" example:"pending"`
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// NewLoginSession starts a pending login of username on platform.
+func NewLoginSession(username, platform, method string, now time.Time) (LoginSession, error) {
+	raw := make([]byte, 12)
+	if _, err := rand.Read(raw); err != nil {
+		return LoginSession{}, err
+	}
+
+	now = now.UTC()
+	session := LoginSession{
+		ID:          base64.RawURLEncoding.EncodeToString(raw),
+		Username:    username,
+		Platform:    platform,
+		Method:      method,
+		State:       LoginStatePending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Transitions: []LoginTransition{{State: LoginStatePending, At: now}},
+	}
+	session.ExpiresAt = loginExpiresAt(LoginStatePending, now)
+	return session, nil
+}
+
+func loginExpiresAt(state string, now time.Time) *time.Time {
+	timeout := cfg().LoginTimeouts.Get(state)
+	if timeout <= 0 {
+		return nil
+	}
+	at := now.Add(timeout)
+	return &at
+}
+
+func (s *LoginSession) Ended() bool {
+	_, ok := loginTransitions[s.State]
+	return !ok
+}
+
+// Expired reports whether the login sat in its state past its timeout.
+func (s *LoginSession) Expired(now time.Time) bool {
+	return !s.Ended() && s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+// Transition moves the login to state, restarting the timeout of the new
+// state. Transitions the state machine doesn't allow are refused.
+func (s *LoginSession) Transition(state, reason string, now time.Time) (LoginTransition, bool) {
+	if !slices.Contains(loginTransitions[s.State], state) {
+		return LoginTransition{}, false
+	}
+
+	now = now.UTC()
+	transition := LoginTransition{State: state, Reason: reason, At: now}
+	s.State = state
+	s.Reason = reason
+	s.UpdatedAt = now
+	s.ExpiresAt = loginExpiresAt(state, now)
+	s.Transitions = append(s.Transitions, transition)
+	return transition, true
+}
+
+// LoginStatus is a device login along with the code it is awaiting, which
+// is only known to the server driving it.
+// @Description Represents the state of a device login and the code it is awaiting
+// @name LoginStatus
+// @type object
+type LoginStatus struct {
+	LoginSession
+	QRCode      string `json:"qr,omitempty" example:"2@Xb4v..."`           // Text of the QR code to scan while awaiting_scan
+	PairingCode string `json:"pairing_code,omitempty" example:"ABCD-EFGH"` // Code to enter on the phone while awaiting_scan
+	Input       string `json:"input,omitempty" example:"code"`             // Input of the login step to answer while awaiting_input
+}
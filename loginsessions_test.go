@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginSessionTransition(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		from        string
+		to          string
+		want        bool
+		wantExpires bool
+	}{
+		{"code shown", LoginStatePending, LoginStateAwaitingScan, true, true},
+		{"code scanned", LoginStateAwaitingScan, LoginStateScanned, true, true},
+		{"linked", LoginStateScanned, LoginStateSuccess, true, false},
+		{"expired", LoginStateAwaitingScan, LoginStateExpired, true, false},
+		{"cancelled", LoginStatePending, LoginStateCancelled, true, false},
+		{"back to awaiting scan", LoginStateScanned, LoginStateAwaitingScan, false, true},
+		{"after success", LoginStateSuccess, LoginStateFailed, false, false},
+		{"after cancel", LoginStateCancelled, LoginStateAwaitingScan, false, false},
+	}
+
+	for _, tt := range tests {
+		session, err := NewLoginSession("alice", "wa", LoginMethodQR, now)
+		if err != nil {
+			t.Fatalf("NewLoginSession() error = %v", err)
+		}
+		session.State = tt.from
+		session.ExpiresAt = loginExpiresAt(tt.from, now)
+
+		_, ok := session.Transition(tt.to, "", now)
+		if ok != tt.want {
+			t.Errorf("%s: Transition() = %v, want %v", tt.name, ok, tt.want)
+		}
+		if (session.ExpiresAt != nil) != tt.wantExpires {
+			t.Errorf("%s: ExpiresAt = %v, want set %v", tt.name, session.ExpiresAt, tt.wantExpires)
+		}
+		if ok && (session.State != tt.to || len(session.Transitions) != 2) {
+			t.Errorf("%s: after Transition() state = %v with %d transitions", tt.name, session.State, len(session.Transitions))
+		}
+	}
+}
+
+func TestLoginSessionExpired(t *testing.T) {
+	now := time.Now()
+	session, err := NewLoginSession("alice", "wa", LoginMethodQR, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.Expired(now) {
+		t.Errorf("Expired() of a new login = true")
+	}
+	if !session.Expired(now.Add(defaultLoginPendingTimeout)) {
+		t.Errorf("Expired() past the pending timeout = false")
+	}
+	session.Transition(LoginStateSuccess, "", now)
+	if session.Expired(now.Add(time.Hour)) {
+		t.Errorf("Expired() of a successful login = true")
+	}
+}
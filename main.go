@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	_ "sherlock/matrix/docs"
 
@@ -53,27 +61,57 @@ type ClientJsonRequest struct {
 // @name ClientMessageJsonRequeset
 // @type object
 type ClientMessageJsonRequeset struct {
-	Username   string `json:"username" example:"john_doe" binding:"required"`       // Required: 3-32 characters, letters, numbers, underscores only
+	Username   string `json:"username,omitempty" example:"john_doe"`                // Deprecated: the user is taken from the access token, must match it if set
 	Message    string `json:"message" example:"Hello, world!" binding:"required"`   // Required: 1-4096 characters, cannot be empty
 	DeviceName string `json:"device_name" example:"wa123456789" binding:"required"` // Required: 2-20 characters, letters and numbers only
 	FileData   []byte `json:"file_data,omitempty" example:"[file_data]"`            // Optional: Binary file data for attachments
 }
 
+// AddDeviceJsonRequest represents how a device is to be linked
+// @Description Request payload to add a device. The method is qr (default) or phone, which requires the phone number of the account to link.
+// @name AddDeviceJsonRequest
+// @type object
+type AddDeviceJsonRequest struct {
+	Username    string `json:"username,omitempty" example:"john_doe"` // Deprecated: the user is taken from the access token, must match it if set
+	Method      string `json:"method,omitempty" example:"phone"`
+	PhoneNumber string `json:"phone_number,omitempty" example:"+1234567890"` // Required for the phone method, E.164 format
+}
+
 // ClientBridgeJsonRequest represents bridge connection details
 // @Description Request payload to bind a platform bridge to a user
 // @name ClientBridgeJsonRequest
 // @type object
 type ClientBridgeJsonRequest struct {
-	Username string `json:"username" example:"john_doe"`
+	Username string `json:"username,omitempty" example:"john_doe"` // Deprecated: the user is taken from the access token, must match it if set
 }
 
 type ClientWebhookJsonRequest struct {
-	Username   string `json:"username" example:"john_doe"`
+	Username   string `json:"username,omitempty" example:"john_doe"` // Deprecated: the user is taken from the access token, must match it if set
 	DeviceName string `json:"device_name" example:"wa123456789"`
 	URL        string `json:"url" example:"https://example.com"`
 	Method     string `json:"method" example:"POST"`
 }
 
+// CreateAPIKeyJsonRequest represents an API key to issue
+// @Description Request payload to issue an API key. Scopes are any of messages:send, messages:read, devices:manage and webhooks:manage.
+// @name CreateAPIKeyJsonRequest
+// @type object
+type CreateAPIKeyJsonRequest struct {
+	Name       string     `json:"name" example:"billing-service"`
+	Scopes     []string   `json:"scopes" example:"messages:send"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" example:"2030-01-01T00:00:00Z"` // Optional: the key stops working at this time
+	AllowedIPs []string   `json:"allowed_ips,omitempty" example:"10.0.0.0/8"`          // Optional: IP addresses or CIDR ranges the key may be used from
+}
+
+// BridgeCommandJsonRequest represents a command for the bridge bot
+// @Description Request payload to run a command of the bridge bot in the management room of the user
+// @name BridgeCommandJsonRequest
+// @type object
+type BridgeCommandJsonRequest struct {
+	Username string `json:"username" example:"john_doe" binding:"required"` // Required: the user to run the command for
+	Command  string `json:"command" example:"!wa sync" binding:"required"`  // Required: 1-4096 characters, sent as is
+}
+
 // LoginResponse represents the response for successful login
 // @Description Response payload for successful login
 type LoginResponse struct {
@@ -100,12 +138,36 @@ type MessageResponse struct {
 
 // DeviceResponse represents the response for successful device addition
 // @Description Response payload for successful device addition. The websocket_url is used to establish a connection that:
-// @Description - Receives media/images from the platform bridge
-// @Description - Handles login synchronization events
-// @Description - Receives existing active sessions if available
-// @Description - Closes when receiving nil data (indicating end of session or error)
+// @Description - Receives the login as JSON frames typed qr, pairing_code, status, input, success, failed or timeout
+// @Description - Carries the state of the login in every frame
+// @Description - Answers the login steps of the bridge with {"type": "input", "input": ..., "value": ...} frames
+// @Description - Closes with code 1000 after success, 4000 after failure, 4001 after a timeout and 4002 once cancelled
 type DeviceResponse struct {
-	WebsocketURL string `json:"websocket_url" example:"ws://localhost:8080/ws/telegram/john_doe"`
+	LoginID         string    `json:"login_id" example:"Vb3kq9XhY2tPz0aL"` // Follow the login with GET /{platform}/devices/login/{login_id}
+	WebsocketURL    string    `json:"websocket_url" example:"/ws/wa/john_doe/Vb3kq9XhY2tPz0aL?ticket=3q2b7wQxLk..."`
+	Ticket          string    `json:"ticket" example:"3q2b7wQxLk..."`
+	TicketExpiresAt time.Time `json:"ticket_expires_at"`
+	PairingCode     string    `json:"pairing_code,omitempty" example:"ABCD-EFGH"` // Phone logins: the code to enter on the phone, empty if the bridge didn't send it in time
+}
+
+// DeviceListResponse represents the devices linked on a platform
+// @Description Response payload listing the devices linked on a platform
+type DeviceListResponse struct {
+	Devices []Device `json:"devices"`
+}
+
+// BridgesStatusResponse represents the health of the bridges of the user
+// @Description Response payload listing the health of every configured bridge
+type BridgesStatusResponse struct {
+	Bridges []BridgeHealth `json:"bridges"`
+}
+
+// BridgeCommandResponse represents the replies of the bridge bot to a command
+// @Description Response payload with the notices the bridge bot replied to a command with
+type BridgeCommandResponse struct {
+	Command  string        `json:"command" example:"!wa sync"`
+	Replies  []BridgeReply `json:"replies"`
+	TimedOut bool          `json:"timed_out" example:"false"` // The bot never went quiet, or never replied, before the timeout
 }
 
 // Webhook represents a webhook configuration
@@ -190,6 +252,27 @@ func sanitizeContact(contact string) (string, error) {
 	return contact, nil
 }
 
+// sanitizeDeviceLogin checks the login method is one the platform is
+// configured for, and the phone number it needs.
+func sanitizeDeviceLogin(platform, method, phoneNumber string) (DeviceLogin, error) {
+	switch strings.TrimSpace(method) {
+	case "", LoginMethodQR:
+		return DeviceLogin{Method: LoginMethodQR}, nil
+	case LoginMethodPhone:
+		bridgeCfg, ok := cfg().GetBridgeConfig(platform)
+		if !ok || bridgeCfg.Cmd["login_phone"] == "" || bridgeCfg.Cmd["pairing_code"] == "" {
+			return DeviceLogin{}, fmt.Errorf("phone login is not configured for %s", platform)
+		}
+
+		number, err := sanitizeContact(phoneNumber)
+		if err != nil {
+			return DeviceLogin{}, fmt.Errorf("phone_number must be a valid E.164 phone number (e.g., +1234567890)")
+		}
+		return DeviceLogin{Method: LoginMethodPhone, PhoneNumber: "+" + number}, nil
+	}
+	return DeviceLogin{}, fmt.Errorf("method must be qr or phone")
+}
+
 func sanitizeDeviceName(deviceName string) (string, error) {
 	// Remove any whitespace
 	deviceName = strings.TrimSpace(deviceName)
@@ -205,7 +288,10 @@ func sanitizeDeviceName(deviceName string) (string, error) {
 
 // Helper function to extract Bearer token from Authorization header
 func extractBearerToken(c *gin.Context) (string, error) {
-	authHeader := c.GetHeader("Authorization")
+	return parseBearerToken(c.GetHeader("Authorization"))
+}
+
+func parseBearerToken(authHeader string) (string, error) {
 	if authHeader == "" {
 		return "", fmt.Errorf("Authorization header is required")
 	}
@@ -224,6 +310,17 @@ func extractBearerToken(c *gin.Context) (string, error) {
 	return token, nil
 }
 
+// bindOptionalJSON binds the request body into obj, accepting requests that
+// have no body at all.
+func bindOptionalJSON(c *gin.Context, obj any) bool {
+	if err := c.ShouldBindJSON(obj); err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("Invalid request payload: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		return false
+	}
+	return true
+}
+
 // ApiLogin godoc
 // @Summary Logs a user into the Matrix server
 // @Description Authenticates a user and returns an access token
@@ -257,9 +354,9 @@ func ApiLogin(c *gin.Context) {
 		return
 	}
 
-	homeServer := cfg.HomeServer
+	homeServer := cfg().HomeServer
 
-	client, err := mautrix.NewClient(homeServer, id.NewUserID(username, cfg.HomeServerDomain), cfg.User.AccessToken)
+	client, err := mautrix.NewClient(homeServer, id.NewUserID(username, cfg().HomeServerDomain), cfg().User.AccessToken)
 	if err != nil {
 		log.Printf("Failed to create Matrix client: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
@@ -273,6 +370,10 @@ func ApiLogin(c *gin.Context) {
 	}
 	if err := controller.LoginProcess(password); err != nil {
 		log.Printf("Login failed for %s: %v", username, err)
+		if errors.Is(err, ErrStorageUnavailable) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed", "details": err.Error()})
 		return
 	}
@@ -284,6 +385,59 @@ func ApiLogin(c *gin.Context) {
 	})
 }
 
+// ApiLogout godoc
+// @Summary Logs the access token out
+// @Description Invalidates the access token at the homeserver. When it is the token the server syncs with, it is removed from storage and the user's sync loop and websockets are stopped
+// @Produce  json
+// @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
+// @Success 200 {object} map[string]interface{} "Successfully logged out"
+// @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 403 {object} ErrorResponse "This endpoint requires a Matrix access token"
+// @Failure 502 {object} ErrorResponse "Logout failed at the homeserver"
+// @Router /logout [post]
+func ApiLogout(c *gin.Context) {
+	logout(c, false)
+}
+
+// ApiLogoutAll godoc
+// @Summary Logs every access token of the user out
+// @Description Invalidates every access token of the user at the homeserver, removes the stored one and stops the user's sync loop and websockets
+// @Produce  json
+// @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
+// @Success 200 {object} map[string]interface{} "Successfully logged out"
+// @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 403 {object} ErrorResponse "This endpoint requires a Matrix access token"
+// @Failure 502 {object} ErrorResponse "Logout failed at the homeserver"
+// @Router /logout/all [post]
+func ApiLogoutAll(c *gin.Context) {
+	logout(c, true)
+}
+
+func logout(c *gin.Context, all bool) {
+	username := AuthenticatedUsername(c)
+	accessToken := AuthenticatedAccessToken(c)
+
+	client, err := mautrix.NewClient(cfg().HomeServer, id.NewUserID(username, cfg().HomeServerDomain), accessToken)
+	if err != nil {
+		log.Printf("Failed to create Matrix client: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	controller := Controller{
+		Client:   client,
+		Username: username,
+		UserID:   client.UserID,
+	}
+	if err := controller.LogoutProcess(c.Request.Context(), accessToken, all); err != nil {
+		log.Printf("Logout failed for %s: %v", username, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Logout failed", "details": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "logged out"})
+}
+
 // ApiCreate godoc
 // @Summary Creates a new user on the Matrix server
 // @Description Registers a new user and returns an access token
@@ -317,7 +471,7 @@ func ApiCreate(c *gin.Context) {
 		return
 	}
 
-	homeServer := cfg.HomeServer
+	homeServer := cfg().HomeServer
 
 	client, err := mautrix.NewClient(homeServer, "", "")
 
@@ -348,8 +502,8 @@ func ApiCreate(c *gin.Context) {
 // ApiSendMessage godoc
 // @Summary Sends a message to a contact through a platform bridge
 // @Description Sends a message to a contact through the specified platform bridge. The message can include text and optional file data.
+// @Description The message is sent as the user the access token belongs to.
 // @Description The function validates and sanitizes all input fields according to the following rules:
-// @Description - Username: 3-32 characters, letters, numbers, and underscores only
 // @Description - Message: 1-4096 characters, cannot be empty
 // @Description - Device name: 2-20 characters, letters and numbers only
 // @Description - Contact: Valid E.164 phone number format (8-15 digits)
@@ -361,19 +515,17 @@ func ApiCreate(c *gin.Context) {
 // @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
 // @Param   payload body ClientMessageJsonRequeset true "Message Payload"
 // @Success 200 {object} map[string]interface{} "Message sent successfully" example:{"contact":"1234567890","message":"Hello, world!","status":"sent"}
-// @Failure 400 {object} ErrorResponse "Invalid request - validation errors for username, message, device_name, platform, or contact"
+// @Failure 400 {object} ErrorResponse "Invalid request - validation errors for message, device_name, platform, or contact"
 // @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 403 {object} ErrorResponse "Username does not match access token"
+// @Failure 429 {object} ErrorResponse "Rate limit exceeded, retry after the Retry-After header"
 // @Failure 500 {object} ErrorResponse "Failed to send message or internal server error"
 // @Router /{platform}/message/{contact} [post]
 func ApiSendMessage(c *gin.Context) {
 	var req ClientMessageJsonRequeset
 
-	// Extract Bearer token from Authorization header
-	accessToken, err := extractBearerToken(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-		return
-	}
+	username := AuthenticatedUsername(c)
+	accessToken := AuthenticatedAccessToken(c)
 
 	// Sanitize platform and contact parameters
 	platform, err := sanitizePlatform(c.Param("platform"))
@@ -394,11 +546,11 @@ func ApiSendMessage(c *gin.Context) {
 		return
 	}
 
-	// Validate required fields
-	if req.Username == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Username is required"})
+	if !checkBodyUsername(c, req.Username) {
 		return
 	}
+
+	// Validate required fields
 	if req.Message == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Message is required"})
 		return
@@ -408,13 +560,6 @@ func ApiSendMessage(c *gin.Context) {
 		return
 	}
 
-	// Sanitize username
-	username, err := sanitizeUsername(req.Username)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
 	// Sanitize message
 	message, err := sanitizeMessage(req.Message)
 	if err != nil {
@@ -429,23 +574,16 @@ func ApiSendMessage(c *gin.Context) {
 		return
 	}
 
-	cfg, _ := (&Conf{}).getConf()
-	homeServer := cfg.HomeServer
-
-	client, err := mautrix.NewClient(homeServer, id.NewUserID(username, cfg.HomeServerDomain), accessToken)
-	if err != nil {
-		log.Printf("Failed to create Matrix client: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not initialize client"})
+	if !checkRateLimit(c, RateLimitSend, platform, deviceName) {
 		return
 	}
 
-	// Validate access token
-	matrixClient := MatrixClient{
-		Client: client,
-	}
-	_, err = matrixClient.LoadActiveSessionsByAccessToken(accessToken)
+	homeServer := cfg().HomeServer
+
+	client, err := mautrix.NewClient(homeServer, id.NewUserID(username, cfg().HomeServerDomain), accessToken)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid access token", "details": err.Error()})
+		log.Printf("Failed to create Matrix client: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not initialize client"})
 		return
 	}
 
@@ -471,12 +609,24 @@ func ApiSendMessage(c *gin.Context) {
 
 // ApiAddDevice godoc
 // @Summary Adds a device for a given platform
-// @Description Registers a new device connection for the specified platform and establishes a websocket connection.
+// @Description Registers a new device login for the specified platform, starts it with the bridge and returns the websocket URL to
+// @Description follow it on, served on the API port. Clients without a websocket poll GET /{platform}/devices/login/{id} instead.
+// @Description Every call starts another login, so several numbers of a platform and other platforms can be linked at the same time,
+// @Description each running in its own room with the bridge bot. Adding a phone number whose login is in progress returns that login.
+// @Description Several websockets may follow the same login, it ends when the login succeeds or fails or the last websocket disconnects.
 // @Description The websocket connection will:
-// @Description - Receive media/images from the platform bridge
-// @Description - Handle login synchronization events
-// @Description - Send existing active sessions if available
-// @Description - Close connection when receiving nil data (indicating end of session or error)
+// @Description - Receive JSON frames with a type: qr (base64 image and the text it encodes), pairing_code, status (notices of the bridge),
+// @Description input (the bridge asks for the input of a login step), success (with the linked phone number), failed (with a reason),
+// @Description timeout or cancelled
+// @Description - Send {"type": "input", "input": ..., "value": ...} frames answering the login steps the bridge asks for, configured
+// @Description as login_steps of the bridge, such as the phone number, code and password of Telegram logins
+// @Description - Close with code 1000 after success, 4000 after failure, 4001 after a timeout and 4002 once cancelled
+// @Description Adding format=binary to the websocket URL keeps the older protocol: QR codes as binary frames, pairing codes as
+// @Description text frames and an empty binary frame when the login ends.
+// @Description The websocket URL carries a single-use ticket bound to the user and platform that expires after a minute.
+// @Description Handshakes without it must send the access token, or an API key with the devices:manage scope, as a Bearer token.
+// @Description Devices are linked by scanning a QR code by default. With the phone method the pairing code to enter on the
+// @Description phone is also returned in the response, for clients that can't scan a QR code.
 // @Description Here are various platforms supported:
 // @Description 'wa' (for WhatsApp)
 // @Description 'signal' (for Signal)
@@ -484,21 +634,19 @@ func ApiSendMessage(c *gin.Context) {
 // @Produce  json
 // @Param   platform path string true "Platform Name" example:"wa"
 // @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
-// @Param   payload body ClientBridgeJsonRequest true "Device Payload"
+// @Param   payload body AddDeviceJsonRequest false "Device Payload"
 // @Success 200 {object} DeviceResponse "Successfully added device and established websocket connection"
 // @Failure 400 {object} ErrorResponse "Invalid request"
 // @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 403 {object} ErrorResponse "Username does not match access token"
+// @Failure 429 {object} ErrorResponse "Rate limit exceeded, retry after the Retry-After header"
 // @Failure 500 {object} ErrorResponse "Internal server error"
 // @Router /{platform}/devices [post]
 func ApiAddDevice(c *gin.Context) {
-	var bridgeJsonRequest ClientBridgeJsonRequest
+	var addDeviceJsonRequest AddDeviceJsonRequest
 
-	// Extract Bearer token from Authorization header
-	accessToken, err := extractBearerToken(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-		return
-	}
+	username := AuthenticatedUsername(c)
+	accessToken := AuthenticatedAccessToken(c)
 
 	// Sanitize platform parameter
 	platformName, err := sanitizePlatform(c.Param("platform"))
@@ -507,21 +655,18 @@ func ApiAddDevice(c *gin.Context) {
 		return
 	}
 
-	if err := c.ShouldBindJSON(&bridgeJsonRequest); err != nil {
-		log.Printf("Invalid request payload: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+	if !bindOptionalJSON(c, &addDeviceJsonRequest) || !checkBodyUsername(c, addDeviceJsonRequest.Username) {
 		return
 	}
 
-	// Sanitize username
-	username, err := sanitizeUsername(bridgeJsonRequest.Username)
+	login, err := sanitizeDeviceLogin(platformName, addDeviceJsonRequest.Method, addDeviceJsonRequest.PhoneNumber)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	client, err := mautrix.NewClient(
-		cfg.HomeServer, id.NewUserID(username, cfg.HomeServerDomain), accessToken)
+		cfg().HomeServer, id.NewUserID(username, cfg().HomeServerDomain), accessToken)
 
 	if err != nil {
 		log.Printf("Failed to create Matrix client: %v", err)
@@ -529,69 +674,175 @@ func ApiAddDevice(c *gin.Context) {
 		return
 	}
 
-	matrixClient := MatrixClient{
+	controller := Controller{
 		Client: client,
+		UserID: client.UserID,
 	}
-	_, err = matrixClient.LoadActiveSessionsByAccessToken(accessToken)
+
+	unit, err := controller.AddDevice(username, platformName, login)
+
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid access token", "details": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	controller := Controller{
-		Client: client,
-		UserID: client.UserID,
+	ticket, expiresAt, err := GlobalWebsocketTickets.Issue(username, platformName, time.Now())
+	if err != nil {
+		log.Printf("Failed to issue websocket ticket: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
 	}
 
-	websocketUrl, err := controller.AddDevice(username, platformName)
+	response := DeviceResponse{
+		LoginID:         unit.Session.ID,
+		WebsocketURL:    unit.Url + "?ticket=" + ticket,
+		Ticket:          ticket,
+		TicketExpiresAt: expiresAt,
+	}
 
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// The login doesn't wait for a websocket, clients may only poll its
+	// state instead.
+	if wait, ok := unit.Start(); !ok {
+		unit.finish("the device login rate limit was exceeded")
+		c.Header("Retry-After", retryAfter(wait))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"websocket_url": websocketUrl,
-	})
+	// The pairing code is what clients that can't scan a QR code are after.
+	if login.Method == LoginMethodPhone {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), pairingCodeTimeout)
+		defer cancel()
+		response.PairingCode = unit.WaitForPairingCode(ctx)
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
-// ApiListDevices godoc
-// @Summary Lists devices for a given platform
-// @Description Retrieves all active devices for the specified platform and user
-// @Accept  json
+// ApiGetDeviceLogin godoc
+// @Summary Reports the state of a device login
+// @Description Returns the state of a device login started with POST /{platform}/devices, so clients without a websocket can follow it.
+// @Description A login is pending until the bridge shows a QR or pairing code, then awaiting_scan, and scanned once the bridge
+// @Description reports the code was used. It ends in success, failed, expired when it stays in a state past the timeout
+// @Description configured under login_timeouts, or cancelled. The QR code text and pairing code are included while awaiting_scan.
 // @Produce  json
 // @Param   platform path string true "Platform Name" example:"wa"
+// @Param   id path string true "Login ID" example:"Vb3kq9XhY2tPz0aL"
 // @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
-// @Param   payload body ClientBridgeJsonRequest true "Device List Request"
-// @Success 200 {object} map[string]interface{} "List of devices"
+// @Success 200 {object} LoginStatus "State of the device login"
 // @Failure 400 {object} ErrorResponse "Invalid request"
 // @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 404 {object} ErrorResponse "Device login not found"
 // @Failure 500 {object} ErrorResponse "Internal server error"
-// @Router /{platform}/list/devices [post]
-func ApiListDevices(c *gin.Context) {
-	var bridgeJsonRequest ClientBridgeJsonRequest
+// @Router /{platform}/devices/login/{id} [get]
+func ApiGetDeviceLogin(c *gin.Context) {
+	platformName, err := sanitizePlatform(c.Param("platform"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	// Extract Bearer token from Authorization header
-	accessToken, err := extractBearerToken(c)
+	status, err := FetchDeviceLogin(AuthenticatedUsername(c), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && status.Platform != platformName) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device login not found"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		log.Printf("Failed to fetch device login: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
 
-	if err := c.ShouldBindJSON(&bridgeJsonRequest); err != nil {
-		log.Printf("Invalid request payload: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+	c.JSON(http.StatusOK, status)
+}
+
+// ApiCancelDeviceLogins godoc
+// @Summary Cancels the device logins in progress
+// @Description Cancels every device login of the user on the platform that is in progress. The bridge is sent its cancel command
+// @Description in the room of each login, the codes it showed are forgotten and websockets following the logins receive a cancelled
+// @Description frame before being closed with code 4002. Logins are also cancelled when the last websocket following them disconnects.
+// @Produce  json
+// @Param   platform path string true "Platform Name" example:"wa"
+// @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
+// @Success 200 {array} LoginStatus "States of the cancelled device logins"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 404 {object} ErrorResponse "No device login in progress"
+// @Router /{platform}/devices/login [delete]
+func ApiCancelDeviceLogins(c *gin.Context) {
+	platformName, err := sanitizePlatform(c.Param("platform"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	username, err := sanitizeUsername(bridgeJsonRequest.Username)
+	statuses := CancelDeviceLogins(AuthenticatedUsername(c), platformName)
+	if len(statuses) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No device login in progress"})
+		return
+	}
+
+	c.JSON(http.StatusOK, statuses)
+}
+
+// ApiCancelDeviceLogin godoc
+// @Summary Cancels a device login in progress
+// @Description Cancels the device login with the id returned by POST /{platform}/devices, leaving the other logins of the platform
+// @Description running. The bridge is sent its cancel command and websockets following the login are closed with code 4002.
+// @Produce  json
+// @Param   platform path string true "Platform Name" example:"wa"
+// @Param   id path string true "Login ID" example:"Vb3kq9XhY2tPz0aL"
+// @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
+// @Success 200 {object} LoginStatus "State of the cancelled device login"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 404 {object} ErrorResponse "Device login not in progress"
+// @Router /{platform}/devices/login/{id} [delete]
+func ApiCancelDeviceLogin(c *gin.Context) {
+	platformName, err := sanitizePlatform(c.Param("platform"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	status, ok := CancelDeviceLogin(AuthenticatedUsername(c), platformName, c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device login not in progress"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// ApiListDevices godoc
+// @Summary Lists devices for a given platform
+// @Description Retrieves the devices linked on the specified platform by the user the access token belongs to, with the connection
+// @Description state the bridge last reported for each. Devices are listed again periodically, after a login succeeds and when the
+// @Description bridge reports a device it didn't list before.
+// @Accept  json
+// @Produce  json
+// @Param   platform path string true "Platform Name" example:"wa"
+// @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
+// @Param   payload body ClientBridgeJsonRequest false "Device List Request"
+// @Success 200 {object} DeviceListResponse "List of devices"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 403 {object} ErrorResponse "Username does not match access token"
+// @Failure 429 {object} ErrorResponse "Rate limit exceeded, retry after the Retry-After header"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /{platform}/list/devices [post]
+func ApiListDevices(c *gin.Context) {
+	var bridgeJsonRequest ClientBridgeJsonRequest
+
+	username := AuthenticatedUsername(c)
+	accessToken := AuthenticatedAccessToken(c)
+
+	if !bindOptionalJSON(c, &bridgeJsonRequest) || !checkBodyUsername(c, bridgeJsonRequest.Username) {
+		return
+	}
+
 	client, err := mautrix.NewClient(
-		cfg.HomeServer, id.NewUserID(username, cfg.HomeServerDomain), accessToken)
+		cfg().HomeServer, id.NewUserID(username, cfg().HomeServerDomain), accessToken)
 
 	if err != nil {
 		log.Printf("Failed to create Matrix client: %v", err)
@@ -610,17 +861,132 @@ func ApiListDevices(c *gin.Context) {
 		return
 	}
 
+	if !checkRateLimit(c, RateLimitList, platformName, "") {
+		return
+	}
+
 	log.Println("Listing devices for", username, platformName)
 	devices, err := controller.ListDevices(username, platformName)
 
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+		log.Printf("Failed to list devices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, DeviceListResponse{Devices: devices})
+}
+
+// ApiBridgesStatus godoc
+// @Summary Reports the health of the bridges
+// @Description Reports whether the bot of each configured bridge answers in the management room of the user the access token
+// @Description belongs to, with the latency of its last answer and the last bridge state it reported. Bridges are unhealthy once
+// @Description their bot missed bridge_health.failures pings in a row, and unknown before they were first pinged.
+// @Produce  json
+// @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
+// @Success 200 {object} BridgesStatusResponse "Health of the bridges"
+// @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 403 {object} ErrorResponse "API key is missing the devices:manage scope"
+// @Router /bridges/status [get]
+func ApiBridgesStatus(c *gin.Context) {
+	username := AuthenticatedUsername(c)
+
+	c.JSON(http.StatusOK, BridgesStatusResponse{Bridges: GlobalBridgeHealth.Statuses(username)})
+}
+
+// ApiBridgeCommand godoc
+// @Summary Runs a command of the bridge bot
+// @Description Sends the command as is into the management room of the platform's bridge for the given user,
+// @Description such as "!wa sync" or "!signal help", and returns the notices the bridge bot replied with. Replies are collected
+// @Description until the bot stayed quiet for bridge_commands.quiet_period after its first reply, or bridge_commands.timeout passed.
+// @Description Only operators can run commands, with the bridge_commands.admin_token of the configuration. Matrix access tokens
+// @Description and API keys are refused, and the endpoint is disabled while no admin token is set.
+// @Accept  json
+// @Produce  json
+// @Param   platform path string true "Platform Name" example:"wa"
+// @Param   Authorization header string true "Bearer admin token" example:"Bearer 4f9c2a..."
+// @Param   payload body BridgeCommandJsonRequest true "Bridge Command"
+// @Success 200 {object} BridgeCommandResponse "Replies of the bridge bot"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Missing Bearer token"
+// @Failure 403 {object} ErrorResponse "This endpoint requires the admin token"
+// @Failure 404 {object} ErrorResponse "Platform not configured or user not found"
+// @Failure 409 {object} ErrorResponse "The user is logged out"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /{platform}/command [post]
+func ApiBridgeCommand(c *gin.Context) {
+	var commandJsonRequest BridgeCommandJsonRequest
+
+	platformName, err := sanitizePlatform(c.Param("platform"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"devices": devices,
-	})
+	if err := c.ShouldBindJSON(&commandJsonRequest); err != nil {
+		log.Printf("Invalid request payload: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		return
+	}
+
+	command := strings.TrimSpace(commandJsonRequest.Command)
+	if len(command) == 0 || len(command) > 4096 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "command must be 1-4096 characters"})
+		return
+	}
+
+	bridgeCfg, ok := cfg().GetBridgeConfig(platformName)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Platform not configured"})
+		return
+	}
+
+	username := commandJsonRequest.Username
+	user, err := GlobalStorage.Keystore().FetchUser(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if user.AccessToken == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "The user is logged out"})
+		return
+	}
+
+	client, err := mautrix.NewClient(
+		cfg().HomeServer, id.NewUserID(username, cfg().HomeServerDomain), user.AccessToken)
+
+	if err != nil {
+		log.Printf("Failed to create Matrix client: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not initialize client"})
+		return
+	}
+
+	bridge := &Bridges{
+		Name:    platformName,
+		Client:  client,
+		BotName: bridgeCfg.BotName,
+	}
+	if err := bridge.JoinManagementRooms(); err != nil {
+		log.Printf("Failed to join management room: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	log.Printf("[+] Running bridge command for %s on %s with the admin token from %s: %s", username, platformName, c.ClientIP(), command)
+
+	replies, timedOut, err := bridge.RunCommand(c.Request.Context(), command)
+	if err != nil {
+		log.Printf("Failed to run bridge command: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, BridgeCommandResponse{Command: command, Replies: replies, TimedOut: timedOut})
 }
 
 func ApiListWebhooks(c *gin.Context) {
@@ -638,26 +1004,21 @@ func ApiListWebhooks(c *gin.Context) {
 // @Success 200 {object} map[string]interface{} "Webhook added successfully"
 // @Failure 400 {object} ErrorResponse "Invalid request"
 // @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 403 {object} ErrorResponse "Username does not match access token"
 // @Failure 500 {object} ErrorResponse "Internal server error"
 // @Router /{platform}/device/{device_name}/webhook [post]
 func ApiAddWebhook(c *gin.Context) {
 	var webhookJsonRequest ClientWebhookJsonRequest
 
-	// Extract Bearer token from Authorization header
-	accessToken, err := extractBearerToken(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-		return
-	}
+	username := AuthenticatedUsername(c)
+	accessToken := AuthenticatedAccessToken(c)
 
-	username, err := sanitizeUsername(webhookJsonRequest.Username)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindOptionalJSON(c, &webhookJsonRequest) || !checkBodyUsername(c, webhookJsonRequest.Username) {
 		return
 	}
 
 	client, err := mautrix.NewClient(
-		cfg.HomeServer, id.NewUserID(username, cfg.HomeServerDomain), accessToken)
+		cfg().HomeServer, id.NewUserID(username, cfg().HomeServerDomain), accessToken)
 
 	if err != nil {
 		log.Printf("Failed to create Matrix client: %v", err)
@@ -681,6 +1042,136 @@ func ApiAddWebhook(c *gin.Context) {
 
 }
 
+// ApiCreateAPIKey godoc
+// @Summary Issues an API key
+// @Description Issues an API key acting as the authenticated user with the given scopes, so services don't need the Matrix access token.
+// @Description The key is only returned in this response, store it safely. API keys cannot be used to issue other keys.
+// @Accept  json
+// @Produce  json
+// @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
+// @Param   payload body CreateAPIKeyJsonRequest true "API Key"
+// @Success 201 {object} APIKey "API key issued"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 403 {object} ErrorResponse "This endpoint requires a Matrix access token, or the scope is only granted to operators"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /api-keys [post]
+func ApiCreateAPIKey(c *gin.Context) {
+	var req CreateAPIKeyJsonRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Printf("Invalid request payload: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if len(name) == 0 || len(name) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name must be 1-64 characters"})
+		return
+	}
+
+	if err := ValidateScopes(req.Scopes); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrOperatorScope) {
+			status = http.StatusForbidden
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := ValidateAllowedIPs(req.AllowedIPs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	secret, err := GenerateAPIKey()
+	if err != nil {
+		log.Printf("Failed to generate api key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	key := APIKey{
+		Username:   AuthenticatedUsername(c),
+		Name:       name,
+		Prefix:     secret[:len(apiKeyPrefix)+8],
+		Scopes:     req.Scopes,
+		AllowedIPs: req.AllowedIPs,
+		ExpiresAt:  req.ExpiresAt,
+	}
+
+	if err := GlobalStorage.Keystore().CreateAPIKey(&key, AccessTokenHash(secret)); err != nil {
+		log.Printf("Failed to store api key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	key.Key = secret
+	c.JSON(http.StatusCreated, key)
+}
+
+// ApiListAPIKeys godoc
+// @Summary Lists API keys
+// @Description Lists the API keys issued for the authenticated user, without the keys themselves
+// @Produce  json
+// @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
+// @Success 200 {array} APIKey "API keys"
+// @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 403 {object} ErrorResponse "This endpoint requires a Matrix access token"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /api-keys [get]
+func ApiListAPIKeys(c *gin.Context) {
+	keys, err := GlobalStorage.Keystore().FetchAPIKeys(AuthenticatedUsername(c))
+	if err != nil {
+		log.Printf("Failed to list api keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+// ApiDeleteAPIKey godoc
+// @Summary Revokes an API key
+// @Description Revokes an API key of the authenticated user, it stops working immediately
+// @Produce  json
+// @Param   id path int true "API Key ID" example:"1"
+// @Param   Authorization header string true "Bearer token" example:"Bearer syt_YWxwaGE..."
+// @Success 200 {object} map[string]interface{} "API key revoked"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Invalid or missing Bearer token"
+// @Failure 403 {object} ErrorResponse "This endpoint requires a Matrix access token"
+// @Failure 404 {object} ErrorResponse "API key not found"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /api-keys/{id} [delete]
+func ApiDeleteAPIKey(c *gin.Context) {
+	keyID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key id"})
+		return
+	}
+
+	deleted, err := GlobalStorage.Keystore().DeleteAPIKey(AuthenticatedUsername(c), keyID)
+	if err != nil {
+		log.Printf("Failed to revoke api key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
+
 func ApiDeleteWebhook(c *gin.Context) {
 
 }
@@ -697,40 +1188,86 @@ func ApiDeleteAccount(c *gin.Context) {
 
 }
 
+// newRouter creates the engine the API is served from. Only the configured
+// proxies may set the client address the API key allowlists are checked
+// against.
+func newRouter() (*gin.Engine, error) {
+	router := gin.Default()
+	if err := router.SetTrustedProxies(cfg().TrustedProxies); err != nil {
+		return nil, err
+	}
+	router.Use(CORSMiddleware())
+	return router, nil
+}
+
 func main() {
 	if cfgError != nil {
 		panic(cfgError)
 	}
 
-	router := gin.Default()
+	masterKeys, err := LoadMasterKeys(cfg().Secrets)
+	if err != nil {
+		log.Fatalf("Failed loading the master key: %v\n"+
+			"Access tokens and login sessions are encrypted with it since this release. Generate one with\n"+
+			"    openssl rand -base64 32 > master.key\n"+
+			"and set secrets.master_key_file to it in conf.yaml, or export it in %s. Rows stored before stay readable, "+
+			"`rotate-keys` encrypts them.", err, defaultMasterKeyEnv)
+	}
+	GlobalMasterKeys = masterKeys
 
-	// Add CORS middleware
-	router.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+	storage, err := NewStorage(cfg())
+	if err != nil {
+		panic(err)
+	}
+	if err := storage.Init(); err != nil {
+		panic(err)
+	}
+	GlobalStorage = storage
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		if err := RotateAllSecrets(GlobalMasterKeys); err != nil {
+			log.Fatalln("Key rotation failed:", err)
 		}
+		GlobalShutdown.closeDatabases()
+		log.Println("[+] Key rotation complete")
+		return
+	}
 
-		c.Next()
-	})
+	GlobalRateLimiter = NewRateLimiter(cfg().RateLimits)
+	GlobalRateLimiter.Start()
+
+	router, err := newRouter()
+	if err != nil {
+		log.Fatalln("Invalid trusted_proxies:", err)
+	}
 
 	router.POST("/", ApiCreate)
 	router.POST("/login", ApiLogin)
-	router.POST("/:platform/devices", ApiAddDevice)
-	router.POST("/:platform/message/:contact", ApiSendMessage)
+	router.GET("/ws/:platform/:username/:id", ApiWebsocket)
+	router.POST("/:platform/command", RequireAdminToken(), ApiBridgeCommand)
+
+	authorized := router.Group("/", AuthMiddleware())
+	authorized.POST("/logout", RequireAccessToken(), ApiLogout)
+	authorized.POST("/logout/all", RequireAccessToken(), ApiLogoutAll)
+
+	authorized.POST("/:platform/devices", RequireScope(ScopeDevicesManage), ApiAddDevice)
+	authorized.GET("/:platform/devices/login/:id", RequireScope(ScopeDevicesManage), ApiGetDeviceLogin)
+	authorized.DELETE("/:platform/devices/login", RequireScope(ScopeDevicesManage), ApiCancelDeviceLogins)
+	authorized.DELETE("/:platform/devices/login/:id", RequireScope(ScopeDevicesManage), ApiCancelDeviceLogin)
+	authorized.POST("/:platform/message/:contact", RequireScope(ScopeMessagesSend), ApiSendMessage)
 
-	router.POST("/:platform/list/devices", ApiListDevices)
-	router.POST("/:platform/list/webhooks", ApiListWebhooks)
-	router.POST("/:platform/device/:device_name/webhook", ApiAddWebhook)
+	authorized.POST("/:platform/list/devices", RequireScope(ScopeDevicesManage), ApiListDevices)
+	authorized.GET("/bridges/status", RequireScope(ScopeDevicesManage), ApiBridgesStatus)
+	authorized.POST("/:platform/list/webhooks", RequireScope(ScopeWebhooksManage), ApiListWebhooks)
+	authorized.POST("/:platform/device/:device_name/webhook", RequireScope(ScopeWebhooksManage), ApiAddWebhook)
 
-	router.DELETE("/", ApiDeleteAccount)
-	router.DELETE("/devices/:device_id", ApiDeleteDevice)
-	router.DELETE("/platforms/:platform/devices/device_id", ApiDeletePlatform)
+	authorized.DELETE("/", RequireAccessToken(), ApiDeleteAccount)
+	authorized.DELETE("/devices/:device_id", RequireScope(ScopeDevicesManage), ApiDeleteDevice)
+	authorized.DELETE("/platforms/:platform/devices/device_id", RequireScope(ScopeDevicesManage), ApiDeletePlatform)
+
+	authorized.POST("/api-keys", RequireAccessToken(), ApiCreateAPIKey)
+	authorized.GET("/api-keys", RequireAccessToken(), ApiListAPIKeys)
+	authorized.DELETE("/api-keys/:id", RequireAccessToken(), ApiDeleteAPIKey)
 
 	router.GET("/docs/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
@@ -771,40 +1308,54 @@ func main() {
 		c.Redirect(http.StatusMovedPermanently, "/genindex.html")
 	})
 
-	ks.Init()
+	GlobalShutdown.NotifyOnSignals(syscall.SIGINT, syscall.SIGTERM)
+	ctx := GlobalShutdown.Context()
 
-	host := cfg.Server.Host
-	port := cfg.Server.Port
+	host := cfg().Server.Host
+	port := cfg().Server.Port
 
-	tlsCert := cfg.Server.Tls.Crt
-	tlsKey := cfg.Server.Tls.Key
+	tlsCert := cfg().Server.Tls.Crt
+	tlsKey := cfg().Server.Tls.Key
 
 	go func() {
-		err := (&MatrixClient{}).SyncAllClients()
+		err := (&MatrixClient{}).SyncAllClients(ctx)
 		if err != nil {
-			panic(err)
+			log.Println("Error syncing clients:", err)
+			GlobalShutdown.Trigger()
+		}
+	}()
+
+	GlobalShutdown.Go(func() {
+		GlobalConfig.Watch(ctx)
+	})
+
+	apiServer := &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", host, port),
+		Handler: router,
+	}
+	go func() {
+		var err error
+		if tlsCert != "" && tlsKey != "" {
+			apiServer.Addr = fmt.Sprintf(":%s", port)
+			err = apiServer.ListenAndServeTLS(tlsCert, tlsKey)
+		} else {
+			err = apiServer.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("API server error:", err)
+			GlobalShutdown.Trigger()
 		}
 	}()
 
-	if cfg.Websocket.Tls.Crt != "" && cfg.Websocket.Tls.Key != "" {
-		go func() {
-			err := MainWebsocket(true)
-			if err != nil {
-				panic(err)
-			}
-		}()
-	} else {
-		go func() {
-			err := MainWebsocket(false)
-			if err != nil {
-				panic(err)
-			}
-		}()
-	}
-
-	if tlsCert != "" && tlsKey != "" {
-		router.RunTLS(fmt.Sprintf(":%s", port), tlsCert, tlsKey)
-	} else {
-		router.Run(fmt.Sprintf("%s:%s", host, port))
+	<-ctx.Done()
+	log.Println("[+] Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg().Server.GetShutdownTimeout())
+	defer cancel()
+
+	if err := GlobalShutdown.Shutdown(shutdownCtx, apiServer); err != nil {
+		log.Println("Shutdown finished with error:", err)
+		return
 	}
+	log.Println("[+] Shutdown complete")
 }
@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"sync"
+	"strings"
 	"time"
 
 	"maunium.net/go/mautrix"
@@ -18,9 +18,11 @@ type SyncingClients struct {
 }
 
 type ClientDB struct {
-	connection *sql.DB
+	connection *SQLDatabase
 	username   string
 	filepath   string
+	// release hands the connection back to the storage it was opened from.
+	release func()
 }
 
 type MatrixClient struct {
@@ -40,14 +42,14 @@ func (m *MatrixClient) ProcessActiveSessions(
 	password string,
 ) error {
 	log.Println("Processing active sessions for user:", m.Client.UserID.Localpart())
-	var clientDB ClientDB = ClientDB{
-		username: m.Client.UserID.Localpart(),
-		filepath: "db/" + m.Client.UserID.Localpart() + ".db",
+	clientDB, err := GlobalStorage.OpenClient(m.Client.UserID.Localpart())
+	if err != nil {
+		return err
 	}
-	clientDB.Init()
+	defer clientDB.Close()
 
 	if m.Client.AccessToken != "" && m.Client.UserID != "" && password != "" {
-		err := ks.CreateUser(m.Client.UserID.Localpart(), m.Client.AccessToken)
+		err := GlobalStorage.Keystore().CreateUser(m.Client.UserID.Localpart(), m.Client.AccessToken)
 		if err != nil {
 			return err
 		}
@@ -59,7 +61,7 @@ func (m *MatrixClient) ProcessActiveSessions(
 		}
 	}
 
-	for _, entry := range cfg.Bridges {
+	for _, entry := range cfg().Bridges {
 		for name, config := range entry {
 			bridge := Bridges{
 				Name:    name,
@@ -77,37 +79,16 @@ func (m *MatrixClient) ProcessActiveSessions(
 	return nil
 }
 
-func (m *MatrixClient) LoadActiveSessionsByAccessToken(accessToken string) (string, error) {
-	log.Println("Loading active sessions: ", m.Client.UserID.Localpart(), accessToken)
-
-	var clientDB ClientDB = ClientDB{
-		username: m.Client.UserID.Localpart(),
-		filepath: "db/" + m.Client.UserID.Localpart() + ".db",
-	}
-	clientDB.Init()
-	exists, err := clientDB.AuthenticateAccessToken(m.Client.UserID.Localpart(), accessToken)
-
-	if err != nil {
-		return "", err
-	}
-
-	if !exists {
-		return "", fmt.Errorf("access token does not exist")
-	}
-
-	return accessToken, nil
-}
-
 func (m *MatrixClient) LoadActiveSessions(
 	password string,
 ) (string, error) {
-	log.Println("Loading active sessions: ", m.Client.UserID.Localpart(), password)
+	log.Println("Loading active sessions: ", m.Client.UserID.Localpart())
 
-	var clientDB ClientDB = ClientDB{
-		username: m.Client.UserID.Localpart(),
-		filepath: "db/" + m.Client.UserID.Localpart() + ".db",
+	clientDB, err := GlobalStorage.OpenClient(m.Client.UserID.Localpart())
+	if err != nil {
+		return "", err
 	}
-	clientDB.Init()
+	defer clientDB.Close()
 	exists, err := clientDB.Authenticate(m.Client.UserID.Localpart(), password)
 
 	if err != nil {
@@ -142,17 +123,43 @@ func (m *MatrixClient) Login(password string) (string, error) {
 	return resp.AccessToken, nil
 }
 
-func Logout(client *mautrix.Client) error {
-	// Logout from the session
-	_, err := client.Logout(context.Background())
-	if err != nil {
+// Logout invalidates the client's access token at the homeserver, or every
+// token of the user with all. Tokens that are already invalid are left be.
+func Logout(ctx context.Context, client *mautrix.Client, all bool) error {
+	var err error
+	if all {
+		_, err = client.LogoutAll(ctx)
+	} else {
+		_, err = client.Logout(ctx)
+	}
+
+	if err != nil && !errors.Is(err, mautrix.MUnknownToken) {
 		log.Printf("Logout failed: %v\n", err)
+		return err
 	}
 
-	// TODO: delete the session file
+	return nil
+}
 
-	fmt.Println("Logout successful.")
-	return err
+// StopSync stops the sync loop of username and drops what it registered, so
+// SyncAllClients starts over once the user has a token again.
+func StopSync(username string) {
+	syncLoopsMutex.Lock()
+	loop, ok := syncLoops[username]
+	delete(syncLoops, username)
+	syncLoopsMutex.Unlock()
+
+	if ok {
+		loop.cancel()
+	}
+
+	prefix := "@" + username + ":"
+	removeEventSubscribers(func(subscriber EventSubscriber) bool {
+		return strings.HasPrefix(subscriber.Name, prefix)
+	})
+
+	GlobalBridgeHealth.Forget(username)
+	forgetSyncingUser(username)
 }
 
 func (m *MatrixClient) Create(username string, password string) (string, error) {
@@ -181,60 +188,75 @@ func (m *MatrixClient) Create(username string, password string) (string, error)
 	return resp.AccessToken, nil
 }
 
-func (m *MatrixClient) Sync(ch chan *event.Event) error {
-	syncer := mautrix.NewDefaultSyncer()
-	m.Client.Syncer = syncer
+func (m *MatrixClient) Sync(ctx context.Context, ch chan *event.Event) error {
+	// Reuse the client's syncer so handlers registered by the crypto machine
+	// keep decrypting events.
+	syncer, ok := m.Client.Syncer.(*mautrix.DefaultSyncer)
+	if !ok {
+		syncer = mautrix.NewDefaultSyncer()
+		m.Client.Syncer = syncer
+	}
 
 	// syncer.OnEvent(func(ctx context.Context, evt *event.Event) {
-	syncer.OnEventType(event.EventMessage, func(ctx context.Context, evt *event.Event) {
-		ch <- evt
+	syncer.OnEventType(event.EventMessage, func(_ context.Context, evt *event.Event) {
+		select {
+		case ch <- evt:
+		case <-ctx.Done():
+		}
 	})
 
-	if err := m.Client.Sync(); err != nil {
+	if err := m.Client.SyncWithContext(ctx); err != nil && ctx.Err() == nil {
 		return err
 	}
 	return nil
 }
 
-func (m *MatrixClient) SyncAllClients() error {
+func (m *MatrixClient) SyncAllClients(ctx context.Context) error {
 	log.Println("Syncing all clients")
-	var wg sync.WaitGroup
 
 	for {
-		users, err := ks.FetchAllUsers()
+		users, err := GlobalStorage.Keystore().FetchAllUsers()
 
 		if err != nil {
 			return err
 		}
 
 		for _, user := range users {
-			if _, ok := syncingUsers[user.Username]; ok && len(syncingUsers[user.Username]) > 0 {
+			if !claimSyncingUser(user.Username) {
 				continue
-			} else {
-				syncingUsers[user.Username] = []string{}
 			}
 
-			wg.Add(1)
-
-			go func(user Users) {
-				err := m.syncClient(user) //blocking
+			GlobalShutdown.Go(func() {
+				err := m.syncClient(ctx, user) //blocking
 				if err != nil {
 					log.Println("Error syncing client:", err)
 					return
 				}
-
-			}(user)
+			})
 		}
 
-		time.Sleep(3 * time.Second)
+		select {
+		case <-ctx.Done():
+			log.Println("Stopped syncing all clients")
+			return nil
+		case <-time.After(3 * time.Second):
+		}
 	}
 }
 
-func (m *MatrixClient) syncClient(user Users) error {
-	homeServer := cfg.HomeServer
+func (m *MatrixClient) syncClient(ctx context.Context, user Users) (err error) {
+	// A sync that failed drops its loop and releases the user, for
+	// SyncAllClients to start it over.
+	defer func() {
+		if err != nil {
+			StopSync(user.Username)
+		}
+	}()
+
+	homeServer := cfg().HomeServer
 	client, err := mautrix.NewClient(
 		homeServer,
-		id.NewUserID(user.Username, cfg.HomeServerDomain),
+		id.NewUserID(user.Username, cfg().HomeServerDomain),
 		user.AccessToken,
 	)
 	mc := MatrixClient{
@@ -245,72 +267,55 @@ func (m *MatrixClient) syncClient(user Users) error {
 		return err
 	}
 
-	clientDb := ClientDB{
-		username: user.Username,
-		filepath: "db/" + user.Username + ".db",
-	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	clientDb.Init()
+	loop := newSyncLoop(ctx, cancel, client)
+	syncLoopsMutex.Lock()
+	syncLoops[user.Username] = loop
+	syncLoopsMutex.Unlock()
+
+	clientDb, err := GlobalStorage.OpenClient(user.Username)
+	if err != nil {
+		return err
+	}
 	bridges, err := clientDb.FetchBridgeRooms(user.Username)
+	clientDb.Close()
 	if err != nil {
 		log.Println("Error fetching bridge rooms for user:", err, user.Username)
 		return err
 	}
 
+	if cfg().Encryption.Enabled {
+		if err := mc.EnableEncryption(ctx); err != nil {
+			log.Println("Error enabling encryption for user:", err, user.Username)
+			return err
+		}
+		defer GlobalEncryptedClients.Remove(user.Username)
+	}
+
 	ch := make(chan *event.Event)
 	go func() {
 		for {
-			evt := <-ch
-			go m.processIncomingEvents(evt)
+			select {
+			case <-ctx.Done():
+				return
+			case evt := <-ch:
+				GlobalShutdown.Go(func() {
+					m.processIncomingEvents(evt)
+				})
+			}
 		}
 	}()
 
-	// insert bridge names into syncingUsers if not already present
 	go func() {
 		for _, bridge := range bridges {
 			bridge.Client = client
-			// bridge.Client.StateStore = mautrix.NewMemoryStateStore()
-			if _, ok := syncingUsers[user.Username]; !ok {
-				syncingUsers[user.Username] = []string{}
-			}
-			syncingUsers[user.Username] = append(syncingUsers[user.Username], bridge.Name)
-			if _, ok := ClientDevices[user.Username]; !ok {
-				ClientDevices[user.Username] = make(map[string][]string)
-			} else if _, ok := ClientDevices[user.Username][bridge.Name]; !ok {
-				ClientDevices[user.Username][bridge.Name] = make([]string, 0)
-			}
-
-			devices, err := bridge.ListDevices()
-			log.Println("Devices for bridge:", bridge.Name, devices)
-
-			if err != nil {
-				log.Println("Error listing devices for user:", err, user.Username)
-				continue
-			}
-			ClientDevices[user.Username][bridge.Name] = devices
-
-			go func(bridge *Bridges) {
-				bridgeCfg, ok := cfg.GetBridgeConfig(bridge.Name)
-				if !ok {
-					log.Println("Bridge config not found for:", bridge.Name)
-					return
-				}
-				bridge.ProcessIncomingLoginDaemon(bridgeCfg)
-			}(bridge)
-
-			go func(bridge *Bridges) {
-				bridge.CreateContactRooms()
-				log.Println("Joined member rooms for bridge:", bridge.Name)
-				// wg.Done()
-			}(bridge)
-
-			go func(bridge *Bridges) {
-				bridge.GetRoomInvitesDaemon()
-			}(bridge)
+			loop.follow(bridge)
 		}
 	}()
 
-	err = mc.Sync(ch)
+	err = mc.Sync(ctx, ch)
 
 	if err != nil {
 		log.Println("Sync error for user:", err, client.UserID.String())
@@ -320,8 +325,35 @@ func (m *MatrixClient) syncClient(user Users) error {
 	return nil
 }
 
+// followBridge lists the devices of bridge and keeps following its rooms until
+// ctx is done.
+func followBridge(ctx context.Context, bridge *Bridges) {
+	username := bridge.Client.UserID.Localpart()
+
+	addSyncingBridge(username, bridge.Name)
+
+	// Bridges that don't list the devices still get their rooms
+	// followed, with the devices stored before.
+	devices, err := bridge.RefreshDevices(ctx)
+	if err != nil {
+		log.Println("Error listing devices for user:", err, username)
+	} else {
+		log.Println("Devices for bridge:", bridge.Name, devices)
+	}
+
+	go bridge.DevicesDaemon(ctx)
+	go bridge.HealthDaemon(ctx)
+
+	go func() {
+		bridge.CreateContactRooms()
+		log.Println("Joined member rooms for bridge:", bridge.Name)
+	}()
+
+	go bridge.GetRoomInvitesDaemon()
+}
+
 func (m *MatrixClient) processIncomingEvents(evt *event.Event) error {
-	for _, subscriber := range EventSubscribers {
+	for _, subscriber := range eventSubscribers() {
 		if len(subscriber.ExcludeMsgTypes) > 0 {
 			for _, excludeMsgType := range subscriber.ExcludeMsgTypes {
 				if excludeMsgType == evt.Content.AsMessage().MsgType {
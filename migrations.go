@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is one step of a schema, loaded from migrations/<schema>/NNNN_description.sql.
+// SQLite keeps separate keystore and client schemas since every client has its
+// own file, PostgreSQL has a single schema for the shared database.
+type Migration struct {
+	Version     int
+	Description string
+	SQL         string
+}
+
+func LoadMigrations(schema string) ([]Migration, error) {
+	dir := path.Join("migrations", schema)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, description, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration name %s: %w", entry.Name(), err)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{
+			Version:     version,
+			Description: strings.ReplaceAll(description, "_", " "),
+			SQL:         string(content),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for index, migration := range migrations {
+		if migration.Version != index+1 {
+			return nil, fmt.Errorf("migrations for %s are not contiguous at version %d", schema, migration.Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// Migrate brings db up to the latest version of schema, applying every
+// missing migration in its own transaction. Databases written by a newer
+// binary are refused instead of being used with a schema we don't know.
+func Migrate(db *sql.DB, dialect Dialect, schema string) error {
+	migrations, err := LoadMigrations(schema)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("failed reading schema version: %w", err)
+	}
+
+	if current > len(migrations) {
+		return fmt.Errorf(
+			"%s database is at schema version %d, newer than the %d supported by this binary",
+			schema, current, len(migrations),
+		)
+	}
+
+	for _, migration := range migrations[current:] {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migration.SQL); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+		}
+
+		_, err = tx.Exec(
+			dialect.Rebind("INSERT INTO schema_version (version, description) VALUES (?, ?)"),
+			migration.Version, migration.Description,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("[+] Applied %s migration %d: %s", schema, migration.Version, migration.Description)
+	}
+
+	return nil
+}
+
+// migratedDatabases remembers the per-user databases that are already up to
+// date, so they are only migrated the first time they are opened.
+var migratedDatabases sync.Map
+
+func migrateOnce(db *sql.DB, filepath string, schema string) error {
+	if _, ok := migratedDatabases.Load(filepath); ok {
+		return nil
+	}
+
+	if err := Migrate(db, DialectSQLite, schema); err != nil {
+		return err
+	}
+
+	migratedDatabases.Store(filepath, true)
+	return nil
+}
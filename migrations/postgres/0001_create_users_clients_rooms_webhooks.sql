@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	username TEXT NOT NULL UNIQUE,
+	accessToken TEXT NOT NULL,
+	timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS clients (
+	id SERIAL PRIMARY KEY,
+	username TEXT NOT NULL UNIQUE,
+	password TEXT NOT NULL,
+	accessToken TEXT NOT NULL,
+	timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS rooms (
+	id SERIAL PRIMARY KEY,
+	clientUsername TEXT NOT NULL,
+	roomID TEXT NOT NULL,
+	platformName TEXT NOT NULL,
+	members TEXT NOT NULL,
+	deviceName TEXT,
+	isBridge BOOLEAN NOT NULL,
+	sessions BYTEA,
+	timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	sessionsTimestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(clientUsername, roomID, platformName, isBridge)
+);
+
+CREATE INDEX IF NOT EXISTS rooms_client_members ON rooms (clientUsername, members);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id SERIAL PRIMARY KEY,
+	clientUsername TEXT NOT NULL,
+	deviceName TEXT NOT NULL,
+	url TEXT NOT NULL,
+	method TEXT NOT NULL,
+	timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(clientUsername, deviceName, url, method)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS accessTokenHash TEXT;
+
+CREATE INDEX IF NOT EXISTS users_access_token_hash ON users (accessTokenHash);
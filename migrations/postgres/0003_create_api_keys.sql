@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+	id SERIAL PRIMARY KEY,
+	username TEXT NOT NULL,
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL,
+	keyHash TEXT NOT NULL UNIQUE,
+	scopes TEXT NOT NULL,
+	allowedIPs TEXT NOT NULL DEFAULT '',
+	expiresAt TIMESTAMPTZ,
+	lastUsedAt TIMESTAMPTZ,
+	timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_username ON api_keys (username);
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS login_sessions (
+	id TEXT PRIMARY KEY,
+	clientUsername TEXT NOT NULL,
+	platformName TEXT NOT NULL,
+	method TEXT NOT NULL,
+	state TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	phoneNumber TEXT NOT NULL DEFAULT '',
+	expiresAt TIMESTAMPTZ,
+	updatedAt TIMESTAMPTZ NOT NULL,
+	timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS login_sessions_client ON login_sessions (clientUsername);
+
+CREATE TABLE IF NOT EXISTS login_session_transitions (
+	id SERIAL PRIMARY KEY,
+	loginSessionID TEXT NOT NULL,
+	state TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS login_session_transitions_session ON login_session_transitions (loginSessionID);
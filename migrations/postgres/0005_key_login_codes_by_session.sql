@@ -0,0 +1,7 @@
+ALTER TABLE login_sessions ADD COLUMN roomID TEXT NOT NULL DEFAULT '';
+ALTER TABLE login_sessions ADD COLUMN sessions BYTEA;
+
+CREATE INDEX IF NOT EXISTS login_sessions_platform ON login_sessions (clientUsername, platformName);
+
+-- Login codes were kept per bridge room, they now belong to a login session.
+UPDATE rooms SET sessions = NULL;
@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS clients (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL UNIQUE,
+	password TEXT NOT NULL,
+	accessToken TEXT NOT NULL,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS rooms (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	clientUsername TEXT NOT NULL,
+	roomID TEXT NOT NULL,
+	platformName TEXT NOT NULL,
+	members TEXT NOT NULL,
+	deviceName TEXT,
+	isBridge INTEGER NOT NULL,
+	sessions BLOB,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+	sessionsTimestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(clientUsername, roomID, platformName, isBridge)
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	clientUsername TEXT NOT NULL,
+	deviceName TEXT NOT NULL,
+	url TEXT NOT NULL,
+	method TEXT NOT NULL,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(clientUsername, deviceName, url, method)
+);
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS login_sessions (
+	id TEXT PRIMARY KEY,
+	clientUsername TEXT NOT NULL,
+	platformName TEXT NOT NULL,
+	method TEXT NOT NULL,
+	state TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	phoneNumber TEXT NOT NULL DEFAULT '',
+	expiresAt DATETIME,
+	updatedAt DATETIME NOT NULL,
+	timestamp DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS login_session_transitions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	loginSessionID TEXT NOT NULL,
+	state TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	timestamp DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS login_session_transitions_session ON login_session_transitions (loginSessionID);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS devices (
+	clientUsername TEXT NOT NULL,
+	platformName TEXT NOT NULL,
+	id TEXT NOT NULL,
+	handle TEXT NOT NULL,
+	displayName TEXT NOT NULL DEFAULT '',
+	state TEXT NOT NULL,
+	linkedAt DATETIME NOT NULL,
+	lastSeenAt DATETIME,
+	updatedAt DATETIME NOT NULL,
+	PRIMARY KEY (clientUsername, platformName, id)
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL UNIQUE,
+	accessToken TEXT NOT NULL,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrate(t *testing.T) {
+	for _, schema := range []string{"sqlite/keystore", "sqlite/client"} {
+		t.Run(schema, func(t *testing.T) {
+			db := openTestDB(t)
+
+			migrations, err := LoadMigrations(schema)
+			if err != nil {
+				t.Fatalf("LoadMigrations() error = %v", err)
+			}
+
+			if err := Migrate(db, DialectSQLite, schema); err != nil {
+				t.Fatalf("Migrate() error = %v", err)
+			}
+
+			// Running again on an up to date database is a no-op.
+			if err := Migrate(db, DialectSQLite, schema); err != nil {
+				t.Fatalf("Migrate() second run error = %v", err)
+			}
+
+			version, err := schemaVersion(db)
+			if err != nil {
+				t.Fatalf("schemaVersion() error = %v", err)
+			}
+			if version != len(migrations) {
+				t.Errorf("schemaVersion() = %d, want %d", version, len(migrations))
+			}
+		})
+	}
+}
+
+func TestMigrateRefusesNewerDatabase(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := Migrate(db, DialectSQLite, "sqlite/keystore"); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	_, err := db.Exec("INSERT INTO schema_version (version, description) VALUES (9999, 'from the future')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(db, DialectSQLite, "sqlite/keystore"); err == nil {
+		t.Errorf("Migrate() on a newer database succeeded, want error")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters, following the second recommended option of RFC 9106.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// Bounds on the parameters VerifyPassword accepts from a stored hash, so a
+// corrupted or forged one can neither match every password nor exhaust the
+// server.
+const (
+	argon2MaxTime    = 16
+	argon2MaxMemory  = 1024 * 1024
+	argon2MinSaltLen = 8
+	argon2MinKeyLen  = 16
+	argon2MaxKeyLen  = 64
+)
+
+const argon2Prefix = "$argon2id$"
+
+// HashPassword hashes the password with argon2id and encodes the result in
+// the PHC string format, so the parameters travel with the hash.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix,
+		argon2.Version,
+		argon2Memory,
+		argon2Time,
+		argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+func IsHashedPassword(stored string) bool {
+	return strings.HasPrefix(stored, argon2Prefix)
+}
+
+// VerifyPassword checks password against a hash produced by HashPassword in
+// constant time.
+func VerifyPassword(encoded string, password string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, fmt.Errorf("invalid password hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, fmt.Errorf("invalid password hash version: %w", err)
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version: %d", version)
+	}
+
+	var memory uint32
+	var time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("invalid password hash parameters: %w", err)
+	}
+	if time == 0 || time > argon2MaxTime || memory == 0 || memory > argon2MaxMemory || threads == 0 {
+		return false, fmt.Errorf("password hash parameters out of range: m=%d,t=%d,p=%d", memory, time, threads)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid password hash salt: %w", err)
+	}
+	if len(salt) < argon2MinSaltLen {
+		return false, fmt.Errorf("password hash salt is too short")
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("invalid password hash: %w", err)
+	}
+	if len(hash) < argon2MinKeyLen || len(hash) > argon2MaxKeyLen {
+		return false, fmt.Errorf("password hash has an invalid length: %d", len(hash))
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+
+	return subtle.ConstantTimeCompare(hash, computed) == 1, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("securepassword123")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+
+	if !IsHashedPassword(hash) {
+		t.Errorf("IsHashedPassword(%q) = false, want true", hash)
+	}
+
+	if strings.Contains(hash, "securepassword123") {
+		t.Errorf("HashPassword() leaks the plaintext: %q", hash)
+	}
+
+	other, err := HashPassword("securepassword123")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	if hash == other {
+		t.Errorf("HashPassword() produced the same hash twice, salt is not random")
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	hash, err := HashPassword("securepassword123")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		encoded     string
+		password    string
+		want        bool
+		expectError bool
+	}{
+		{
+			name:     "Correct password",
+			encoded:  hash,
+			password: "securepassword123",
+			want:     true,
+		},
+		{
+			name:     "Wrong password",
+			encoded:  hash,
+			password: "wrongpassword",
+			want:     false,
+		},
+		{
+			name:        "Plaintext stored value",
+			encoded:     "securepassword123",
+			password:    "securepassword123",
+			want:        false,
+			expectError: true,
+		},
+		{
+			name:        "Corrupted parameters",
+			encoded:     "$argon2id$v=19$m=abc$c2FsdA$aGFzaA",
+			password:    "securepassword123",
+			want:        false,
+			expectError: true,
+		},
+		{
+			name:        "Empty hash",
+			encoded:     "$argon2id$v=19$m=65536,t=3,p=4$c29tZXNhbHRzb21lc2FsdA$",
+			password:    "anything",
+			want:        false,
+			expectError: true,
+		},
+		{
+			name:        "Empty salt",
+			encoded:     "$argon2id$v=19$m=65536,t=3,p=4$$" + strings.Split(hash, "$")[5],
+			password:    "securepassword123",
+			want:        false,
+			expectError: true,
+		},
+		{
+			name:        "Zero time",
+			encoded:     strings.Replace(hash, ",t=3,", ",t=0,", 1),
+			password:    "securepassword123",
+			want:        false,
+			expectError: true,
+		},
+		{
+			name:        "Zero threads",
+			encoded:     strings.Replace(hash, ",p=4$", ",p=0$", 1),
+			password:    "securepassword123",
+			want:        false,
+			expectError: true,
+		},
+		{
+			name:        "Zero memory",
+			encoded:     strings.Replace(hash, "$m=65536,", "$m=0,", 1),
+			password:    "securepassword123",
+			want:        false,
+			expectError: true,
+		},
+		{
+			name:        "Memory out of range",
+			encoded:     strings.Replace(hash, "$m=65536,", "$m=4294967295,", 1),
+			password:    "securepassword123",
+			want:        false,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := VerifyPassword(tt.encoded, tt.password)
+			if (err != nil) != tt.expectError {
+				t.Errorf("VerifyPassword() error = %v, expectError %v", err, tt.expectError)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("VerifyPassword() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
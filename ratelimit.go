@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Actions limited separately, each with its own user, platform and device
+// buckets.
+const (
+	RateLimitSend        = "send"
+	RateLimitDeviceLogin = "device_login"
+	RateLimitList        = "list"
+)
+
+// GlobalRateLimiter holds the buckets of every action, anything sending on a
+// user's behalf, whether from a request or a queue, takes from it.
+var GlobalRateLimiter = NewRateLimiter(RateLimits{})
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+type RateLimiter struct {
+	mutex   sync.Mutex
+	limits  RateLimits
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:  limits,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l RateLimit) enabled() bool {
+	return l.PerMinute > 0
+}
+
+func (l RateLimit) burst() float64 {
+	return math.Max(float64(l.Burst), 1)
+}
+
+// refill tops the bucket up with what its limit allows since it was last
+// used.
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Minutes()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.limit.burst(), b.tokens+elapsed*b.limit.PerMinute)
+		b.last = now
+	}
+}
+
+func (rl *RateLimiter) tiers(action string) RateLimitTiers {
+	switch action {
+	case RateLimitSend:
+		return rl.limits.Send
+	case RateLimitDeviceLogin:
+		return rl.limits.DeviceLogin
+	case RateLimitList:
+		return rl.limits.List
+	}
+	return RateLimitTiers{}
+}
+
+// Allow takes a token from the user, platform and device buckets of action.
+// When any of them is empty none is taken, and the wait until all of them
+// have one is returned instead. Empty platform or device skip those buckets.
+func (rl *RateLimiter) Allow(action, username, platform, device string, now time.Time) (time.Duration, bool) {
+	tiers := rl.tiers(action)
+
+	type check struct {
+		key   string
+		limit RateLimit
+	}
+	checks := []check{{fmt.Sprintf("%s|%s", action, username), tiers.User}}
+	if platform != "" {
+		checks = append(checks, check{fmt.Sprintf("%s|%s|%s", action, username, platform), tiers.Platform})
+		if device != "" {
+			checks = append(checks, check{fmt.Sprintf("%s|%s|%s|%s", action, username, platform, device), tiers.Device})
+		}
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	var wait time.Duration
+	buckets := make([]*tokenBucket, 0, len(checks))
+	for _, check := range checks {
+		if !check.limit.enabled() {
+			continue
+		}
+
+		bucket, ok := rl.buckets[check.key]
+		if !ok {
+			bucket = &tokenBucket{tokens: check.limit.burst(), last: now}
+			rl.buckets[check.key] = bucket
+		}
+		bucket.limit = check.limit
+		bucket.refill(now)
+
+		if bucket.tokens < 1 {
+			missing := time.Duration((1 - bucket.tokens) / check.limit.PerMinute * float64(time.Minute))
+			wait = max(wait, missing)
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	if wait > 0 {
+		return wait, false
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return 0, true
+}
+
+// prune drops the buckets that have refilled completely by now, a new one
+// starts full anyway.
+func (rl *RateLimiter) prune(now time.Time) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	for key, bucket := range rl.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.limit.burst() {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Start prunes unused buckets until shutdown.
+func (rl *RateLimiter) Start() {
+	GlobalShutdown.Go(func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-GlobalShutdown.Context().Done():
+				return
+			case now := <-ticker.C:
+				rl.prune(now)
+			}
+		}
+	})
+}
+
+// retryAfter formats wait for the Retry-After header, in whole seconds.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// checkRateLimit answers 429 with Retry-After when the authenticated user is
+// over the limit of action.
+func checkRateLimit(c *gin.Context, action, platform, device string) bool {
+	wait, ok := GlobalRateLimiter.Allow(action, AuthenticatedUsername(c), platform, device, time.Now())
+	if !ok {
+		c.Header("Retry-After", retryAfter(wait))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+		return false
+	}
+	return true
+}
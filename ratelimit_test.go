@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := NewRateLimiter(RateLimits{
+		Send: RateLimitTiers{
+			User:   RateLimit{PerMinute: 60, Burst: 3},
+			Device: RateLimit{PerMinute: 6, Burst: 1},
+		},
+	})
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		action   string
+		username string
+		device   string
+		at       time.Duration
+		wantOk   bool
+		wantWait time.Duration
+	}{
+		{"first send", RateLimitSend, "alice", "phone1", 0, true, 0},
+		{"device bucket empty", RateLimitSend, "alice", "phone1", 0, false, 10 * time.Second},
+		{"other device", RateLimitSend, "alice", "phone2", 0, true, 0},
+		{"other device again", RateLimitSend, "alice", "phone3", 0, true, 0},
+		{"user bucket empty", RateLimitSend, "alice", "phone4", 0, false, time.Second},
+		{"other user", RateLimitSend, "bob", "phone1", 0, true, 0},
+		{"unlimited action", RateLimitList, "alice", "", 0, true, 0},
+		{"user bucket refilled", RateLimitSend, "alice", "phone4", time.Second, true, 0},
+		{"device bucket refilled", RateLimitSend, "alice", "phone1", 10 * time.Second, true, 0},
+	}
+
+	for _, tt := range tests {
+		wait, ok := limiter.Allow(tt.action, tt.username, "wa", tt.device, now.Add(tt.at))
+		if ok != tt.wantOk || wait.Round(time.Millisecond) != tt.wantWait {
+			t.Errorf("%s: Allow() = %v, %v, want %v, %v", tt.name, wait, ok, tt.wantWait, tt.wantOk)
+		}
+	}
+
+	limiter.prune(now.Add(time.Hour))
+	if len(limiter.buckets) != 0 {
+		t.Errorf("prune() kept %d refilled buckets", len(limiter.buckets))
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	previous := GlobalRateLimiter
+	GlobalRateLimiter = NewRateLimiter(RateLimits{List: RateLimitTiers{Platform: RateLimit{PerMinute: 1}}})
+	t.Cleanup(func() { GlobalRateLimiter = previous })
+
+	router := gin.New()
+	router.POST("/:platform/list/devices", func(c *gin.Context) {
+		c.Set(authUsernameKey, "alice")
+		if !checkRateLimit(c, RateLimitList, c.Param("platform"), "") {
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/wa/list/devices", nil))
+		if recorder.Code != want {
+			t.Errorf("status = %v, want %v", recorder.Code, want)
+		}
+		if want == http.StatusTooManyRequests && recorder.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After = %q, want %q", recorder.Header().Get("Retry-After"), "60")
+		}
+	}
+}
@@ -19,7 +19,7 @@ type Rooms struct {
 
 func (r *Rooms) IsBridgeInviteForContact(evt *event.Event) (bool, error) {
 	// TODO: check if the invite is from a bridge bot but not a bridge room
-	for _, bridge := range cfg.Bridges {
+	for _, bridge := range cfg().Bridges {
 		for _, bridgeCfg := range bridge {
 			if bridgeCfg.BotName == evt.Sender.String() {
 				isBridge, err := r.IsBridgeMessage(evt)
@@ -36,12 +36,10 @@ func (r *Rooms) IsBridgeInviteForContact(evt *event.Event) (bool, error) {
 
 func (r *Rooms) IsBridgeMessage(evt *event.Event) (bool, error) {
 	if evt.Type == event.EventMessage {
-		var clientDB ClientDB = ClientDB{
-			username: r.Client.UserID.Localpart(),
-			filepath: "db/" + r.Client.UserID.Localpart() + ".db",
+		clientDB, err := GlobalStorage.OpenClient(r.Client.UserID.Localpart())
+		if err != nil {
+			return false, err
 		}
-
-		clientDB.Init()
 		defer clientDB.Close()
 
 		room, err := clientDB.FetchRooms(evt.RoomID.String())
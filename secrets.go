@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Secrets are stored with envelope encryption: every value gets its own
+// random data key, which is in turn encrypted with the master key. The master
+// key ID travels with the value, so rows written under an older master key
+// stay readable until they have been rotated. The ciphertext is bound to the
+// row it belongs to, see secretOwner, so it can't be moved into another
+// user's row.
+//
+// enc:v1:<master key id>:<wrapped data key>:<ciphertext>
+const encryptedSecretPrefix = "enc:v1:"
+
+const defaultMasterKeyEnv = "SHORTMESH_MASTER_KEY"
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+type MasterKeys struct {
+	current *masterKey
+	keys    map[string]*masterKey
+}
+
+var GlobalMasterKeys *MasterKeys
+
+func newMasterKey(encoded string) (*masterKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("master key must be base64 encoded: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(raw))
+	}
+
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(raw)
+	return &masterKey{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadMasterKeys reads the current master key from the configured file, or
+// from the environment when no file is set, along with any previous keys
+// that are still needed to read rows which have not been rotated yet.
+func LoadMasterKeys(secrets Secrets) (*MasterKeys, error) {
+	var encoded string
+	if secrets.MasterKeyFile != "" {
+		data, err := os.ReadFile(secrets.MasterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %w", err)
+		}
+		encoded = string(data)
+	} else {
+		env := secrets.MasterKeyEnv
+		if env == "" {
+			env = defaultMasterKeyEnv
+		}
+		encoded = os.Getenv(env)
+		if encoded == "" {
+			return nil, fmt.Errorf("no master key configured, set secrets.master_key_file or %s", env)
+		}
+	}
+
+	current, err := newMasterKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	mk := &MasterKeys{
+		current: current,
+		keys:    map[string]*masterKey{current.id: current},
+	}
+
+	for _, path := range secrets.PreviousMasterKeyFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read previous master key file %s: %w", path, err)
+		}
+		previous, err := newMasterKey(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous master key %s: %w", path, err)
+		}
+		mk.keys[previous.id] = previous
+	}
+
+	return mk, nil
+}
+
+func sealWithNonce(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openSealed(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// secretOwner names the row a secret is stored in, e.g. "users/alice", and
+// is passed as the associated data of its ciphertext.
+func secretOwner(table string, keys ...string) string {
+	return strings.Join(append([]string{table}, keys...), "/")
+}
+
+// AccessTokenHash is the lookup key stored next to an encrypted access token,
+// since the token itself can't be searched for once encrypted.
+func AccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:])
+}
+
+func IsEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, encryptedSecretPrefix)
+}
+
+// Encrypt seals plaintext under a fresh data key wrapped with the current
+// master key, bound to owner.
+func (mk *MasterKeys) Encrypt(plaintext []byte, owner string) (string, error) {
+	if mk == nil {
+		return "", fmt.Errorf("master key not loaded")
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := sealWithNonce(dataAEAD, plaintext, []byte(owner))
+	if err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := sealWithNonce(mk.current.aead, dataKey, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedSecretPrefix + strings.Join([]string{
+		mk.current.id,
+		base64.RawStdEncoding.EncodeToString(wrappedKey),
+		base64.RawStdEncoding.EncodeToString(ciphertext),
+	}, ":"), nil
+}
+
+// Decrypt opens a value produced by Encrypt for the same owner. Values
+// without the encryption prefix were written before encryption at rest
+// existed and are returned as they are.
+func (mk *MasterKeys) Decrypt(value string, owner string) ([]byte, error) {
+	if !IsEncryptedSecret(value) {
+		return []byte(value), nil
+	}
+
+	if mk == nil {
+		return nil, fmt.Errorf("master key not loaded")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedSecretPrefix), ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid encrypted secret format")
+	}
+
+	key, ok := mk.keys[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("secret was encrypted with unknown master key %s", parts[0])
+	}
+
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped data key: %w", err)
+	}
+
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %w", err)
+	}
+
+	dataKey, err := openSealed(key.aead, wrappedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := openSealed(dataAEAD, ciphertext, []byte(owner))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret of %s: %w", owner, err)
+	}
+	return plaintext, nil
+}
+
+func (mk *MasterKeys) EncryptString(plaintext string, owner string) (string, error) {
+	return mk.Encrypt([]byte(plaintext), owner)
+}
+
+func (mk *MasterKeys) DecryptString(value string, owner string) (string, error) {
+	plaintext, err := mk.Decrypt(value, owner)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// NeedsRotation reports whether value is stored in plaintext or under a
+// master key other than the current one.
+func (mk *MasterKeys) NeedsRotation(value string) bool {
+	if !IsEncryptedSecret(value) {
+		return true
+	}
+	return !strings.HasPrefix(value, encryptedSecretPrefix+mk.current.id+":")
+}
+
+// Rotate re-encrypts value of owner under the current master key when needed.
+func (mk *MasterKeys) Rotate(value string, owner string) (string, bool, error) {
+	if !mk.NeedsRotation(value) {
+		return value, false, nil
+	}
+
+	plaintext, err := mk.Decrypt(value, owner)
+	if err != nil {
+		return "", false, err
+	}
+
+	rotated, err := mk.Encrypt(plaintext, owner)
+	if err != nil {
+		return "", false, err
+	}
+	return rotated, true, nil
+}
+
+// RotateAllSecrets re-encrypts the keystore and every client under
+// the current master key. Rows still in plaintext are encrypted on the way.
+func RotateAllSecrets(mk *MasterKeys) error {
+	count, err := GlobalStorage.Keystore().RotateSecrets(mk)
+	if err != nil {
+		return fmt.Errorf("failed rotating keystore: %w", err)
+	}
+	log.Printf("[+] Rotated %d keystore secrets", count)
+
+	usernames, err := GlobalStorage.ClientUsernames()
+	if err != nil {
+		return err
+	}
+
+	for _, username := range usernames {
+		clientDb, err := GlobalStorage.OpenClient(username)
+		if err != nil {
+			return fmt.Errorf("failed opening client %s: %w", username, err)
+		}
+
+		count, err := clientDb.RotateSecrets(mk)
+		clientDb.Close()
+		if err != nil {
+			return fmt.Errorf("failed rotating client %s: %w", username, err)
+		}
+		log.Printf("[+] Rotated %d secrets for %s", count, username)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestMasterKey(t *testing.T, dir string, name string) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMasterKeysEncryptDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	mk, err := LoadMasterKeys(Secrets{MasterKeyFile: writeTestMasterKey(t, dir, "master.key")})
+	if err != nil {
+		t.Fatalf("LoadMasterKeys() error = %v", err)
+	}
+
+	alice := secretOwner("users", "alice")
+	encrypted, err := mk.EncryptString("syt_YWxwaGE", alice)
+	if err != nil {
+		t.Fatalf("EncryptString() error = %v", err)
+	}
+	if !IsEncryptedSecret(encrypted) {
+		t.Errorf("EncryptString() = %q, missing encryption prefix", encrypted)
+	}
+
+	decrypted, err := mk.DecryptString(encrypted, alice)
+	if err != nil {
+		t.Fatalf("DecryptString() error = %v", err)
+	}
+	if decrypted != "syt_YWxwaGE" {
+		t.Errorf("DecryptString() = %q, want %q", decrypted, "syt_YWxwaGE")
+	}
+
+	if _, err := mk.DecryptString(encrypted, secretOwner("users", "mallory")); err == nil {
+		t.Errorf("DecryptString() of a value moved into another user's row succeeded, want error")
+	}
+
+	legacy, err := mk.DecryptString("syt_plaintext", alice)
+	if err != nil || legacy != "syt_plaintext" {
+		t.Errorf("DecryptString() on plaintext = %q, %v, want it returned as is", legacy, err)
+	}
+}
+
+func TestMasterKeysRotate(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := writeTestMasterKey(t, dir, "old.key")
+	newKey := writeTestMasterKey(t, dir, "new.key")
+
+	oldKeys, err := LoadMasterKeys(Secrets{MasterKeyFile: oldKey})
+	if err != nil {
+		t.Fatalf("LoadMasterKeys() error = %v", err)
+	}
+	owner := secretOwner("clients", "alice")
+	encrypted, err := oldKeys.EncryptString("syt_YWxwaGE", owner)
+	if err != nil {
+		t.Fatalf("EncryptString() error = %v", err)
+	}
+
+	newOnly, err := LoadMasterKeys(Secrets{MasterKeyFile: newKey})
+	if err != nil {
+		t.Fatalf("LoadMasterKeys() error = %v", err)
+	}
+	if _, err := newOnly.DecryptString(encrypted, owner); err == nil {
+		t.Errorf("DecryptString() with unknown master key succeeded, want error")
+	}
+
+	rotating, err := LoadMasterKeys(Secrets{MasterKeyFile: newKey, PreviousMasterKeyFiles: []string{oldKey}})
+	if err != nil {
+		t.Fatalf("LoadMasterKeys() error = %v", err)
+	}
+
+	rotated, changed, err := rotating.Rotate(encrypted, owner)
+	if err != nil || !changed {
+		t.Fatalf("Rotate() = %v, %v, want rotated value", changed, err)
+	}
+
+	decrypted, err := newOnly.DecryptString(rotated, owner)
+	if err != nil || decrypted != "syt_YWxwaGE" {
+		t.Errorf("DecryptString() after rotation = %q, %v", decrypted, err)
+	}
+
+	if _, changed, _ := rotating.Rotate(rotated, owner); changed {
+		t.Errorf("Rotate() re-encrypted a value already under the current key")
+	}
+}
+
+func TestRotateAllSecretsHashesAccessTokens(t *testing.T) {
+	storage := useTestStorage(t)
+	if err := storage.Keystore().CreateUser("alice", "syt_alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users stored before access tokens were hashed.
+	if _, err := storage.keystore.connection.Exec("update users set accessTokenHash = NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Keystore().FetchUserByAccessToken("syt_alice"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("FetchUserByAccessToken() error = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	if err := RotateAllSecrets(GlobalMasterKeys); err != nil {
+		t.Fatalf("RotateAllSecrets() error = %v", err)
+	}
+	user, err := storage.Keystore().FetchUserByAccessToken("syt_alice")
+	if err != nil || user.Username != "alice" {
+		t.Errorf("FetchUserByAccessToken() after rotation = %q, %v, want alice", user.Username, err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+const defaultShutdownTimeout = 15 * time.Second
+
+// ShutdownManager owns the root context of the process and keeps track of
+// the background work and database handles that have to be drained or
+// closed before the process exits.
+type ShutdownManager struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+
+	dbMutex sync.Mutex
+	dbs     map[*sql.DB]struct{}
+}
+
+var GlobalShutdown = NewShutdownManager()
+
+func NewShutdownManager() *ShutdownManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ShutdownManager{
+		ctx:    ctx,
+		cancel: cancel,
+		dbs:    make(map[*sql.DB]struct{}),
+	}
+}
+
+// Context is cancelled once a shutdown has been requested.
+func (s *ShutdownManager) Context() context.Context {
+	return s.ctx
+}
+
+// NotifyOnSignals cancels the root context when any of the signals is received.
+func (s *ShutdownManager) NotifyOnSignals(signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case sig := <-ch:
+			log.Println("[+] Received signal:", sig)
+			s.cancel()
+		case <-s.ctx.Done():
+		}
+	}()
+}
+
+// Trigger requests a shutdown without waiting for a signal.
+func (s *ShutdownManager) Trigger() {
+	s.cancel()
+}
+
+// Go runs fn in a goroutine that is waited for during shutdown.
+func (s *ShutdownManager) Go(fn func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn()
+	}()
+}
+
+func (s *ShutdownManager) TrackDB(db *sql.DB) {
+	s.dbMutex.Lock()
+	defer s.dbMutex.Unlock()
+	s.dbs[db] = struct{}{}
+}
+
+func (s *ShutdownManager) UntrackDB(db *sql.DB) {
+	s.dbMutex.Lock()
+	defer s.dbMutex.Unlock()
+	delete(s.dbs, db)
+}
+
+func (s *ShutdownManager) closeDatabases() {
+	s.dbMutex.Lock()
+	defer s.dbMutex.Unlock()
+
+	for db := range s.dbs {
+		if err := db.Close(); err != nil {
+			log.Println("Error closing database:", err)
+		}
+		delete(s.dbs, db)
+	}
+}
+
+// Shutdown stops the subsystems in order: no new API requests or websocket
+// upgrades are accepted, in-flight requests are drained, open websockets
+// receive a close frame, sync loops and queued event processing are waited
+// for and finally every database handle is closed. Everything has to finish
+// before ctx expires.
+func (s *ShutdownManager) Shutdown(ctx context.Context, apiServer *http.Server) error {
+	s.cancel()
+
+	var shutdownErr error
+
+	if err := apiServer.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down API server:", err)
+		shutdownErr = err
+	}
+
+	// Websockets are hijacked, the server no longer tracks them.
+	GlobalWebsocketConnection.CloseAll("server shutting down")
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("[+] Background work drained")
+	case <-ctx.Done():
+		log.Println("Timed out waiting for background work:", ctx.Err())
+		shutdownErr = ctx.Err()
+	}
+
+	s.closeDatabases()
+
+	return shutdownErr
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// UserStore holds the accounts known to the API and the access token each
+// one syncs with.
+type UserStore interface {
+	APIKeyStore
+	CreateUser(username string, accessToken string) error
+	FetchUser(username string) (Users, error)
+	FetchUserByAccessToken(accessToken string) (Users, error)
+	FetchAllUsers() ([]Users, error)
+	RemoveAccessToken(username string) error
+	RotateSecrets(mk *MasterKeys) (int, error)
+}
+
+// APIKeyStore holds the API keys issued to users.
+type APIKeyStore interface {
+	CreateAPIKey(key *APIKey, keyHash string) error
+	FetchAPIKeyByHash(keyHash string) (APIKey, error)
+	FetchAPIKeys(username string) ([]APIKey, error)
+	DeleteAPIKey(username string, id int) (bool, error)
+	TouchAPIKey(id int) error
+}
+
+// ClientCredentialStore holds the credentials of a single client.
+type ClientCredentialStore interface {
+	AuthenticateAccessToken(username string, accessToken string) (bool, error)
+	Authenticate(username string, password string) (bool, error)
+	UpdatePassword(username string, password string) error
+	Store(accessToken string, password string) error
+	Fetch() (string, error)
+	RemoveAccessToken(username string) error
+}
+
+// RoomStore holds the management and contact rooms of a single client.
+type RoomStore interface {
+	StoreRooms(roomID string, platformName string, deviceName string, members string, isBridge bool) error
+	FetchRooms(roomID string) (Rooms, error)
+	FetchRoomsByMembers(members string) ([]Rooms, error)
+	FetchBridgeRooms(username string) ([]*Bridges, error)
+}
+
+// SessionStore holds the code each in-flight device login of a single client
+// is awaiting, keyed by platform and login session so concurrent logins keep
+// their own.
+type SessionStore interface {
+	FetchActiveSessions(platformName string, loginID string) ([]byte, error)
+	StoreActiveSessions(platformName string, loginID string, sessions []byte) error
+	RemoveActiveSessions(platformName string, loginID string) error
+}
+
+// DeviceStore holds the devices a single client linked through its bridges.
+type DeviceStore interface {
+	SyncDevices(platformName string, devices []Device, now time.Time) error
+	UpdateDeviceState(platformName string, device string, state string, now time.Time) (bool, error)
+	FetchDevices(platformName string) ([]Device, error)
+}
+
+// LoginSessionStore holds the device logins of a single client and the states
+// they went through.
+type LoginSessionStore interface {
+	CreateLoginSession(session *LoginSession) error
+	UpdateLoginSession(session *LoginSession, transition *LoginTransition) error
+	FetchLoginSession(id string) (LoginSession, error)
+	FetchLoginRooms(platformName string) ([]string, error)
+}
+
+// WebhookStore holds the webhooks of a single client.
+type WebhookStore interface {
+	CreateWebhook(deviceName string, url string, method string) error
+	FetchWebhook(deviceName string, url string, method string) (Webhook, error)
+	FetchWebhooksByDevice(deviceName string) ([]Webhook, error)
+	FetchAllWebhooks() ([]Webhook, error)
+	UpdateWebhook(deviceName string, oldURL string, oldMethod string, newURL string, newMethod string) error
+	DeleteWebhook(deviceName string, url string, method string) error
+	DeleteWebhooksByDevice(deviceName string) error
+}
+
+// ClientStore is everything persisted for a single client.
+type ClientStore interface {
+	ClientCredentialStore
+	RoomStore
+	SessionStore
+	LoginSessionStore
+	DeviceStore
+	WebhookStore
+	RotateSecrets(mk *MasterKeys) (int, error)
+	Close()
+}
+
+// Storage opens the stores of the configured database backend.
+type Storage interface {
+	Init() error
+	Keystore() UserStore
+	OpenClient(username string) (ClientStore, error)
+	ClientUsernames() ([]string, error)
+}
+
+const (
+	defaultDatabaseDir = "db"
+	defaultBusyTimeout = 5 * time.Second
+	defaultIdleTimeout = 10 * time.Minute
+)
+
+type Dialect int
+
+const (
+	DialectSQLite Dialect = iota
+	DialectPostgres
+)
+
+// Rebind rewrites the ? placeholders used throughout the queries into the
+// form the dialect's driver expects.
+func (d Dialect) Rebind(query string) string {
+	if d != DialectPostgres {
+		return query
+	}
+
+	var builder strings.Builder
+	index := 0
+	for _, r := range query {
+		if r == '?' {
+			index++
+			builder.WriteString("$" + strconv.Itoa(index))
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+func NewStorage(c *Conf) (Storage, error) {
+	switch c.Database.Driver {
+	case "", "sqlite", "sqlite3":
+		return &SQLiteStorage{
+			dir:              c.Database.GetDir(),
+			keystoreFilepath: c.KeystoreFilepath,
+			busyTimeout:      c.Database.GetBusyTimeout(),
+			idleTimeout:      c.Database.GetIdleTimeout(),
+			clients:          make(map[string]*sqliteClient),
+		}, nil
+	case "postgres", "postgresql":
+		if c.Database.DSN == "" {
+			return nil, fmt.Errorf("database.dsn is required for the postgres driver")
+		}
+		return &PostgresStorage{dsn: c.Database.DSN, idleTimeout: c.Database.GetIdleTimeout()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver: %s", c.Database.Driver)
+	}
+}
+
+// openSQLite opens path in WAL mode so readers don't block the writer, and
+// waits out locks held by other connections instead of failing with
+// SQLITE_BUSY. Transactions take the write lock up front, since a deferred
+// transaction upgrading to a writer can't be retried by the busy handler.
+func openSQLite(path string, busyTimeout time.Duration) (*sql.DB, error) {
+	dsn := fmt.Sprintf(
+		"file:%s?_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate",
+		path, busyTimeout.Milliseconds(),
+	)
+	return sql.Open("sqlite3", dsn)
+}
+
+// SQLiteStorage keeps the keystore in one file and every client in its own
+// <dir>/<username>.db file. Client databases are opened once and shared by
+// every caller until they have been idle for idleTimeout.
+type SQLiteStorage struct {
+	dir              string
+	keystoreFilepath string
+	busyTimeout      time.Duration
+	idleTimeout      time.Duration
+	keystore         *Keystore
+
+	clientsMutex sync.Mutex
+	clients      map[string]*sqliteClient
+}
+
+type sqliteClient struct {
+	clientDb *ClientDB
+	refs     int
+	lastUsed time.Time
+}
+
+func (s *SQLiteStorage) Init() error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	db, err := openSQLite(s.keystoreFilepath, s.busyTimeout)
+	if err != nil {
+		return err
+	}
+	GlobalShutdown.TrackDB(db)
+
+	if err := Migrate(db, DialectSQLite, "sqlite/keystore"); err != nil {
+		return err
+	}
+
+	s.keystore = &Keystore{connection: &SQLDatabase{DB: db, dialect: DialectSQLite}, filepath: s.keystoreFilepath}
+
+	GlobalShutdown.Go(func() {
+		ticker := time.NewTicker(s.idleTimeout)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-GlobalShutdown.Context().Done():
+				return
+			case now := <-ticker.C:
+				s.evictIdleClients(now)
+			}
+		}
+	})
+	return nil
+}
+
+func (s *SQLiteStorage) Keystore() UserStore {
+	return s.keystore
+}
+
+// OpenClient returns the pooled database of username, opening and migrating
+// it on first use. Every call must be paired with a Close, which hands the
+// database back to the pool.
+func (s *SQLiteStorage) OpenClient(username string) (ClientStore, error) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+
+	client, ok := s.clients[username]
+	if !ok {
+		path := filepath.Join(s.dir, username+".db")
+		db, err := openSQLite(path, s.busyTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := migrateOnce(db, path, "sqlite/client"); err != nil {
+			db.Close()
+			return nil, err
+		}
+		GlobalShutdown.TrackDB(db)
+
+		client = &sqliteClient{
+			clientDb: &ClientDB{
+				connection: &SQLDatabase{DB: db, dialect: DialectSQLite},
+				username:   username,
+				filepath:   path,
+			},
+		}
+		s.clients[username] = client
+	}
+
+	client.refs++
+	client.lastUsed = time.Now()
+
+	var once sync.Once
+	clientDb := *client.clientDb
+	clientDb.release = func() {
+		once.Do(func() { s.releaseClient(username) })
+	}
+	return &clientDb, nil
+}
+
+func (s *SQLiteStorage) releaseClient(username string) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+
+	if client, ok := s.clients[username]; ok {
+		client.refs--
+		client.lastUsed = time.Now()
+	}
+}
+
+// evictIdleClients closes the databases nobody has held since idleTimeout
+// before now.
+func (s *SQLiteStorage) evictIdleClients(now time.Time) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+
+	for username, client := range s.clients {
+		if client.refs > 0 || now.Sub(client.lastUsed) < s.idleTimeout {
+			continue
+		}
+
+		delete(s.clients, username)
+		GlobalShutdown.UntrackDB(client.clientDb.connection.DB)
+		if err := client.clientDb.connection.Close(); err != nil {
+			log.Println("Error closing client db:", err, username)
+		}
+	}
+}
+
+func (s *SQLiteStorage) ClientUsernames() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	var usernames []string
+	for _, path := range paths {
+		if filepath.Clean(path) == filepath.Clean(s.keystoreFilepath) || strings.HasSuffix(path, ".crypto.db") {
+			continue
+		}
+		usernames = append(usernames, strings.TrimSuffix(filepath.Base(path), ".db"))
+	}
+	return usernames, nil
+}
+
+// PostgresStorage keeps the keystore and every client in one shared database,
+// so several API nodes can serve the same users.
+type PostgresStorage struct {
+	dsn         string
+	idleTimeout time.Duration
+	connection  *SQLDatabase
+}
+
+func (s *PostgresStorage) Init() error {
+	db, err := sql.Open("pgx", s.dsn)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return fmt.Errorf("failed connecting to postgres: %w", err)
+	}
+	db.SetConnMaxIdleTime(s.idleTimeout)
+	GlobalShutdown.TrackDB(db)
+
+	if err := Migrate(db, DialectPostgres, "postgres"); err != nil {
+		return err
+	}
+
+	s.connection = &SQLDatabase{DB: db, dialect: DialectPostgres}
+	return nil
+}
+
+func (s *PostgresStorage) Keystore() UserStore {
+	return &Keystore{connection: s.connection}
+}
+
+func (s *PostgresStorage) OpenClient(username string) (ClientStore, error) {
+	return &ClientDB{
+		connection: s.connection,
+		username:   username,
+	}, nil
+}
+
+func (s *PostgresStorage) ClientUsernames() ([]string, error) {
+	rows, err := s.connection.Query("SELECT username FROM clients")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// SQLDatabase wraps *sql.DB so every query can be written once with ?
+// placeholders and rebound for the dialect it runs against.
+type SQLDatabase struct {
+	*sql.DB
+	dialect Dialect
+}
+
+func (db *SQLDatabase) Prepare(query string) (*sql.Stmt, error) {
+	return db.DB.Prepare(db.dialect.Rebind(query))
+}
+
+func (db *SQLDatabase) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.Rebind(query), args...)
+}
+
+func (db *SQLDatabase) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.dialect.Rebind(query), args...)
+}
+
+func (db *SQLDatabase) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.Rebind(query), args...)
+}
+
+func (db *SQLDatabase) Begin() (*SQLTx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &SQLTx{Tx: tx, dialect: db.dialect}, nil
+}
+
+type SQLTx struct {
+	*sql.Tx
+	dialect Dialect
+}
+
+func (tx *SQLTx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.Tx.Prepare(tx.dialect.Rebind(query))
+}
+
+func (tx *SQLTx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.Rebind(query), args...)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		query   string
+		want    string
+	}{
+		{DialectSQLite, "select * from rooms where clientUsername = ? and roomID = ?", "select * from rooms where clientUsername = ? and roomID = ?"},
+		{DialectPostgres, "select * from rooms where clientUsername = ? and roomID = ?", "select * from rooms where clientUsername = $1 and roomID = $2"},
+		{DialectPostgres, "select * from users", "select * from users"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.dialect.Rebind(tt.query); got != tt.want {
+			t.Errorf("Rebind(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestNewStorage(t *testing.T) {
+	tests := []struct {
+		database Database
+		wantErr  bool
+	}{
+		{Database{}, false},
+		{Database{Driver: "sqlite"}, false},
+		{Database{Driver: "postgres"}, true},
+		{Database{Driver: "postgres", DSN: "postgres://localhost/shortmesh"}, false},
+		{Database{Driver: "mysql"}, true},
+	}
+
+	for _, tt := range tests {
+		_, err := NewStorage(&Conf{Database: tt.database})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewStorage(%+v) error = %v, wantErr %v", tt.database, err, tt.wantErr)
+		}
+	}
+}
+
+func useTestMasterKeys(t *testing.T) {
+	t.Helper()
+	mk, err := LoadMasterKeys(Secrets{MasterKeyFile: writeTestMasterKey(t, t.TempDir(), "master.key")})
+	if err != nil {
+		t.Fatalf("LoadMasterKeys() error = %v", err)
+	}
+	previous := GlobalMasterKeys
+	GlobalMasterKeys = mk
+	t.Cleanup(func() { GlobalMasterKeys = previous })
+}
+
+// testStorage exercises a backend through the Storage interface, so SQLite
+// and PostgreSQL are held to the same behaviour.
+func testStorage(t *testing.T, storage Storage) {
+	t.Helper()
+
+	useTestMasterKeys(t)
+
+	if err := storage.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+
+	if err := storage.Keystore().CreateUser("alice", "token"); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if err := storage.Keystore().CreateUser("alice", "token2"); err != nil {
+		t.Fatalf("CreateUser() again error = %v", err)
+	}
+	user, err := storage.Keystore().FetchUser("alice")
+	if err != nil {
+		t.Fatalf("FetchUser() error = %v", err)
+	}
+	if user.AccessToken != "token2" {
+		t.Errorf("FetchUser().AccessToken = %v, want %v", user.AccessToken, "token2")
+	}
+
+	user, err = storage.Keystore().FetchUserByAccessToken("token2")
+	if err != nil || user.Username != "alice" {
+		t.Errorf("FetchUserByAccessToken() = %v, %v, want alice", user.Username, err)
+	}
+	if _, err := storage.Keystore().FetchUserByAccessToken("token"); err != sql.ErrNoRows {
+		t.Errorf("FetchUserByAccessToken() for a replaced token error = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	key := APIKey{Username: "alice", Name: "test", Prefix: "smk_test", Scopes: AllScopes, AllowedIPs: []string{"10.0.0.0/8"}, ExpiresAt: &expiresAt}
+	if err := storage.Keystore().CreateAPIKey(&key, "hash"); err != nil {
+		t.Fatalf("CreateAPIKey() error = %v", err)
+	}
+	fetched, err := storage.Keystore().FetchAPIKeyByHash("hash")
+	if err != nil {
+		t.Fatalf("FetchAPIKeyByHash() error = %v", err)
+	}
+	if fetched.ID != key.ID || len(fetched.Scopes) != len(AllScopes) || fetched.ExpiresAt == nil || !fetched.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("FetchAPIKeyByHash() = %+v, want %+v", fetched, key)
+	}
+	if deleted, err := storage.Keystore().DeleteAPIKey("bob", key.ID); err != nil || deleted {
+		t.Errorf("DeleteAPIKey() of another user = %v, %v, want false", deleted, err)
+	}
+	if deleted, err := storage.Keystore().DeleteAPIKey("alice", key.ID); err != nil || !deleted {
+		t.Errorf("DeleteAPIKey() = %v, %v, want true", deleted, err)
+	}
+	if keys, err := storage.Keystore().FetchAPIKeys("alice"); err != nil || len(keys) != 0 {
+		t.Errorf("FetchAPIKeys() after DeleteAPIKey() = %v, %v, want none", keys, err)
+	}
+
+	clientDb, err := storage.OpenClient("alice")
+	if err != nil {
+		t.Fatalf("OpenClient() error = %v", err)
+	}
+	defer clientDb.Close()
+
+	if err := clientDb.Store("token2", "password"); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	if ok, err := clientDb.Authenticate("alice", "password"); err != nil || !ok {
+		t.Errorf("Authenticate() = %v, %v, want true", ok, err)
+	}
+
+	if err := clientDb.StoreRooms("!bridge:example.org", "wa", "", "@whatsappbot:example.org", true); err != nil {
+		t.Fatalf("StoreRooms() error = %v", err)
+	}
+
+	// Storing the room again starts it over.
+	if err := clientDb.StoreRooms("!bridge:example.org", "wa", "", "@whatsappbot:example.org", true); err != nil {
+		t.Fatalf("StoreRooms() again error = %v", err)
+	}
+	bridges, err := clientDb.FetchBridgeRooms("alice")
+	if err != nil {
+		t.Fatalf("FetchBridgeRooms() error = %v", err)
+	}
+	if len(bridges) != 1 {
+		t.Errorf("FetchBridgeRooms() returned %d rooms, want 1", len(bridges))
+	}
+
+	session, err := NewLoginSession("alice", "wa", LoginMethodQR, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.RoomID = "!login:example.org"
+	if err := clientDb.CreateLoginSession(&session); err != nil {
+		t.Fatalf("CreateLoginSession() error = %v", err)
+	}
+	other, err := NewLoginSession("alice", "wa", LoginMethodQR, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clientDb.CreateLoginSession(&other); err != nil {
+		t.Fatalf("CreateLoginSession() error = %v", err)
+	}
+
+	// Codes of concurrent logins are kept apart.
+	if err := clientDb.StoreActiveSessions("wa", session.ID, []byte("first")); err != nil {
+		t.Fatalf("StoreActiveSessions() error = %v", err)
+	}
+	if err := clientDb.StoreActiveSessions("wa", other.ID, []byte("second")); err != nil {
+		t.Fatalf("StoreActiveSessions() error = %v", err)
+	}
+	if err := clientDb.RemoveActiveSessions("wa", other.ID); err != nil {
+		t.Fatalf("RemoveActiveSessions() error = %v", err)
+	}
+	if sessions, err := clientDb.FetchActiveSessions("wa", session.ID); err != nil || string(sessions) != "first" {
+		t.Errorf("FetchActiveSessions() = %s, %v, want %s", sessions, err, "first")
+	}
+	if sessions, err := clientDb.FetchActiveSessions("wa", other.ID); err != nil || len(sessions) != 0 {
+		t.Errorf("FetchActiveSessions() after RemoveActiveSessions() = %s, %v, want none", sessions, err)
+	}
+	if _, err := clientDb.FetchActiveSessions("signal", session.ID); err != sql.ErrNoRows {
+		t.Errorf("FetchActiveSessions() of another platform error = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	transition, _ := session.Transition(LoginStateFailed, "Login failed", time.Now())
+	if err := clientDb.UpdateLoginSession(&session, &transition); err != nil {
+		t.Fatalf("UpdateLoginSession() error = %v", err)
+	}
+	fetchedSession, err := clientDb.FetchLoginSession(session.ID)
+	if err != nil {
+		t.Fatalf("FetchLoginSession() error = %v", err)
+	}
+	if fetchedSession.State != LoginStateFailed || fetchedSession.Reason != "Login failed" || fetchedSession.ExpiresAt != nil || len(fetchedSession.Transitions) != 2 {
+		t.Errorf("FetchLoginSession() = %+v, want failed after 2 transitions", fetchedSession)
+	}
+	if fetchedSession.RoomID != session.RoomID {
+		t.Errorf("FetchLoginSession() room = %q, want %q", fetchedSession.RoomID, session.RoomID)
+	}
+	if _, err := clientDb.FetchLoginSession("missing"); err != sql.ErrNoRows {
+		t.Errorf("FetchLoginSession() of a missing login error = %v, want %v", err, sql.ErrNoRows)
+	}
+	if rooms, err := clientDb.FetchLoginRooms("wa"); err != nil || !reflect.DeepEqual(rooms, []string{"!login:example.org"}) {
+		t.Errorf("FetchLoginRooms() = %v, %v, want the login room", rooms, err)
+	}
+
+	linkedAt := time.Now().Add(-time.Hour)
+	listed := []Device{
+		{ID: "1234567890", Handle: "1234567890", Platform: "wa", State: DeviceStateConnected},
+		{ID: "1987654321", Handle: "1987654321", Platform: "wa", DisplayName: "Work", State: DeviceStateUnknown},
+	}
+	if err := clientDb.SyncDevices("wa", listed, linkedAt); err != nil {
+		t.Fatalf("SyncDevices() error = %v", err)
+	}
+	if updated, err := clientDb.UpdateDeviceState("wa", "1987654321", DeviceStateDisconnected, time.Now()); err != nil || !updated {
+		t.Errorf("UpdateDeviceState() = %v, %v, want true", updated, err)
+	}
+	if updated, err := clientDb.UpdateDeviceState("signal", "1987654321", DeviceStateConnected, time.Now()); err != nil || updated {
+		t.Errorf("UpdateDeviceState() on another platform = %v, %v, want false", updated, err)
+	}
+	// Listing again keeps when the devices were linked and what the list
+	// doesn't say, and drops the devices no longer listed.
+	listed = []Device{{ID: "1987654321", Handle: "1987654321", Platform: "wa", State: DeviceStateUnknown}}
+	if err := clientDb.SyncDevices("wa", listed, time.Now()); err != nil {
+		t.Fatalf("SyncDevices() again error = %v", err)
+	}
+	devices, err := clientDb.FetchDevices("wa")
+	if err != nil {
+		t.Fatalf("FetchDevices() error = %v", err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("FetchDevices() = %+v, want 1 device", devices)
+	}
+	if device := devices[0]; device.ID != "1987654321" || device.DisplayName != "Work" || device.State != DeviceStateDisconnected ||
+		!device.LinkedAt.Equal(linkedAt.UTC()) || device.LastSeenAt != nil {
+		t.Errorf("FetchDevices() = %+v, want the work device disconnected since %v", device, linkedAt)
+	}
+	if devices, err := clientDb.FetchDevices("signal"); err != nil || len(devices) != 0 {
+		t.Errorf("FetchDevices() of another platform = %v, %v, want none", devices, err)
+	}
+
+	if err := clientDb.CreateWebhook("device", "https://example.org/hook", "POST"); err != nil {
+		t.Fatalf("CreateWebhook() error = %v", err)
+	}
+	if err := clientDb.CreateWebhook("device", "https://example.org/hook", "POST"); err != nil {
+		t.Fatalf("CreateWebhook() again error = %v", err)
+	}
+	webhooks, err := clientDb.FetchAllWebhooks()
+	if err != nil {
+		t.Fatalf("FetchAllWebhooks() error = %v", err)
+	}
+	if len(webhooks) != 1 {
+		t.Errorf("FetchAllWebhooks() returned %d webhooks, want 1", len(webhooks))
+	}
+
+	if err := clientDb.RemoveAccessToken("alice"); err != nil {
+		t.Fatalf("ClientDB.RemoveAccessToken() error = %v", err)
+	}
+	if accessToken, err := clientDb.Fetch(); err != nil || accessToken != "" {
+		t.Errorf("Fetch() after RemoveAccessToken() = %v, %v, want none", accessToken, err)
+	}
+
+	if err := storage.Keystore().RemoveAccessToken("alice"); err != nil {
+		t.Fatalf("Keystore.RemoveAccessToken() error = %v", err)
+	}
+	if _, err := storage.Keystore().FetchUserByAccessToken("token2"); err != sql.ErrNoRows {
+		t.Errorf("FetchUserByAccessToken() after RemoveAccessToken() error = %v, want %v", err, sql.ErrNoRows)
+	}
+	if users, err := storage.Keystore().FetchAllUsers(); err != nil || len(users) != 0 {
+		t.Errorf("FetchAllUsers() after RemoveAccessToken() = %v, %v, want none", users, err)
+	}
+
+	usernames, err := storage.ClientUsernames()
+	if err != nil {
+		t.Fatalf("ClientUsernames() error = %v", err)
+	}
+	if len(usernames) != 1 || usernames[0] != "alice" {
+		t.Errorf("ClientUsernames() = %v, want [alice]", usernames)
+	}
+}
+
+func newTestSQLiteStorage(t *testing.T) *SQLiteStorage {
+	t.Helper()
+	dir := t.TempDir()
+	storage, err := NewStorage(&Conf{
+		KeystoreFilepath: filepath.Join(dir, "users.db"),
+		Database:         Database{Dir: dir},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(GlobalShutdown.closeDatabases)
+	return storage.(*SQLiteStorage)
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	testStorage(t, newTestSQLiteStorage(t))
+}
+
+func TestSQLiteStoragePool(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+	if err := storage.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+
+	first, err := storage.OpenClient("alice")
+	if err != nil {
+		t.Fatalf("OpenClient() error = %v", err)
+	}
+	second, err := storage.OpenClient("alice")
+	if err != nil {
+		t.Fatalf("OpenClient() error = %v", err)
+	}
+	if first.(*ClientDB).connection != second.(*ClientDB).connection {
+		t.Errorf("OpenClient() opened a second connection for the same user")
+	}
+
+	first.Close()
+	first.Close()
+	storage.evictIdleClients(time.Now().Add(storage.idleTimeout))
+	if _, ok := storage.clients["alice"]; !ok {
+		t.Errorf("evictIdleClients() closed a database that is still held")
+	}
+
+	second.Close()
+	storage.evictIdleClients(time.Now())
+	if _, ok := storage.clients["alice"]; !ok {
+		t.Errorf("evictIdleClients() closed a database before idle_timeout")
+	}
+
+	storage.evictIdleClients(time.Now().Add(storage.idleTimeout))
+	if _, ok := storage.clients["alice"]; ok {
+		t.Errorf("evictIdleClients() kept an idle database open")
+	}
+}
+
+// TestPostgresStorage runs against the database in
+// SHORTMESH_TEST_POSTGRES_DSN, which it expects to be empty.
+func TestPostgresStorage(t *testing.T) {
+	dsn := os.Getenv("SHORTMESH_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("SHORTMESH_TEST_POSTGRES_DSN not set")
+	}
+	t.Cleanup(GlobalShutdown.closeDatabases)
+
+	testStorage(t, &PostgresStorage{dsn: dsn})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebsocketTicketsRedeem(t *testing.T) {
+	tickets := NewWebsocketTickets()
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		username string
+		platform string
+		at       time.Duration
+		want     bool
+	}{
+		{"issued for", "alice", "wa", 0, true},
+		{"other user", "bob", "wa", 0, false},
+		{"other platform", "alice", "signal", 0, false},
+		{"expired", "alice", "wa", websocketTicketTTL, false},
+	}
+
+	for _, tt := range tests {
+		ticket, _, err := tickets.Issue("alice", "wa", now)
+		if err != nil {
+			t.Fatalf("Issue() error = %v", err)
+		}
+		if got := tickets.Redeem(ticket, tt.username, tt.platform, now.Add(tt.at)); got != tt.want {
+			t.Errorf("%s: Redeem() = %v, want %v", tt.name, got, tt.want)
+		}
+		if tickets.Redeem(ticket, "alice", "wa", now) {
+			t.Errorf("%s: Redeem() accepted a ticket twice", tt.name)
+		}
+	}
+}
+
+func TestAuthenticateWebsocket(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+	useTestMasterKeys(t)
+	if err := storage.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	previous := GlobalStorage
+	GlobalStorage = storage
+	t.Cleanup(func() { GlobalStorage = previous })
+
+	if err := storage.Keystore().CreateUser("alice", "syt_alice"); err != nil {
+		t.Fatal(err)
+	}
+	devicesKey := newTestAPIKey(t, APIKey{Username: "alice", Scopes: []string{ScopeDevicesManage}})
+	sendKey := newTestAPIKey(t, APIKey{Username: "alice", Scopes: []string{ScopeMessagesSend}})
+	allowlistedKey := newTestAPIKey(t, APIKey{Username: "alice", Scopes: []string{ScopeDevicesManage}, AllowedIPs: []string{"10.0.0.0/8"}})
+
+	ticket, _, err := GlobalWebsocketTickets.Issue("alice", "wa", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		query         string
+		authorization string
+		clientIP      string
+		want          bool
+	}{
+		{"nothing", "", "", "192.0.2.1", false},
+		{"ticket", "?ticket=" + ticket, "", "192.0.2.1", true},
+		{"used ticket", "?ticket=" + ticket, "", "192.0.2.1", false},
+		{"access token", "", "Bearer syt_alice", "192.0.2.1", true},
+		{"api key with devices:manage", "", "Bearer " + devicesKey, "192.0.2.1", true},
+		{"api key without devices:manage", "", "Bearer " + sendKey, "192.0.2.1", false},
+		{"api key from its allowlist", "", "Bearer " + allowlistedKey, "10.0.0.1", true},
+		{"api key from outside its allowlist", "", "Bearer " + allowlistedKey, "192.0.2.1", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/ws/wa/alice"+tt.query, nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		if got := authenticateWebsocket(req, tt.clientIP, "alice", "wa"); got != tt.want {
+			t.Errorf("%s: authenticateWebsocket() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"fmt"
-	"os"
+	"net/http"
 	"regexp"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
-	"gopkg.in/yaml.v3"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 )
@@ -16,23 +18,66 @@ type BridgeConfig struct {
 	BotName          string            `yaml:"botname"`
 	UsernameTemplate string            `yaml:"username_template"`
 	Cmd              map[string]string `yaml:"cmd"` // ← map instead of slice of maps
+	DeviceList       DeviceList        `yaml:"device_list"`
+	LoginSteps       []LoginStep       `yaml:"login_steps"`
 }
 
+// LoginStep is a question the bridge asks during a login, like the phone
+// number, code and password Telegram logins go through, that the client
+// answers over the websocket of the login.
+type LoginStep struct {
+	// Prompt matches the notice of the bridge asking the question.
+	Prompt string `yaml:"prompt"`
+	// Input names what the client is asked for, e.g. phone_number, code or
+	// password.
+	Input string `yaml:"input"`
+	// Secret inputs, like passwords, are flagged to the client so it can
+	// mask them.
+	Secret bool `yaml:"secret"`
+	// Command is sent to the bridge with the input in place of {{.}}, the
+	// input as is when unset.
+	Command string `yaml:"command"`
+}
+
+// DeviceList tells how the reply of a bridge to its devices command is read.
+type DeviceList struct {
+	// Pattern matches a line of the reply listing a device, its device
+	// capture naming the device. Optional id, name and state captures carry
+	// the login ID, display name and bridge state.
+	Pattern string `yaml:"pattern"`
+	// Empty matches the reply of a bridge the user has no logins on.
+	Empty string `yaml:"empty"`
+	// StatePattern matches the notices of the bridge about the state of a
+	// device, with device and state captures, for bridges that don't attach
+	// the bridge state to them.
+	StatePattern string `yaml:"state_pattern"`
+	// Timeout bounds how long the bridge has to reply.
+	Timeout time.Duration `yaml:"timeout"`
+	// Refresh is how often the devices are listed again.
+	Refresh time.Duration `yaml:"refresh"`
+}
+
+// The replies of mautrix bridges to list-logins, lines like
+// "* `1234567890` (+1234567890) - `CONNECTED`", and their state notices,
+// like "State update for +1234567890: `CONNECTED`".
+const (
+	defaultDeviceListPattern      = "^\\* `(?P<id>[^`]*)` \\(\\+?(?P<device>[^)]+)\\)(?: - `(?P<state>[A-Z_]+)`)?"
+	defaultDeviceListEmpty        = "^You're not logged in"
+	defaultDeviceListStatePattern = "^State update for \\+?(?P<device>[^:]+): `(?P<state>[A-Z_]+)`"
+	defaultDeviceListTimeout      = 30 * time.Second
+	defaultDeviceListRefresh      = 10 * time.Minute
+)
+
 type Tls struct {
 	Crt string `yaml:"crt"`
 	Key string `yaml:"key"`
 }
 
-type ServerWebsocket struct {
-	Port string `yaml:"port"`
-	Host string `yaml:"host"`
-	Tls  Tls    `yaml:"tls"`
-}
-
 type Server struct {
-	Port string `yaml:"port"`
-	Host string `yaml:"host"`
-	Tls  Tls    `yaml:"tls"`
+	Port            string        `yaml:"port"`
+	Host            string        `yaml:"host"`
+	Tls             Tls           `yaml:"tls"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
 }
 
 type User struct {
@@ -41,28 +86,278 @@ type User struct {
 	AccessToken string `yaml:"access_token"`
 }
 
+type Encryption struct {
+	Enabled   bool   `yaml:"enabled"`
+	PickleKey string `yaml:"pickle_key"`
+}
+
+type Secrets struct {
+	MasterKeyFile          string   `yaml:"master_key_file"`
+	MasterKeyEnv           string   `yaml:"master_key_env"`
+	PreviousMasterKeyFiles []string `yaml:"previous_master_key_files"`
+}
+
+type Database struct {
+	Driver      string        `yaml:"driver"`
+	DSN         string        `yaml:"dsn"`
+	Dir         string        `yaml:"dir"`
+	BusyTimeout time.Duration `yaml:"busy_timeout"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+// Cors lists the browser origins allowed to call the API and open
+// websockets. "*" allows any origin, but never with credentials.
+type Cors struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	ExposedHeaders   []string      `yaml:"exposed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// RateLimit lets PerMinute requests through on average and up to Burst at
+// once. A zero PerMinute disables it.
+type RateLimit struct {
+	PerMinute float64 `yaml:"per_minute"`
+	Burst     int     `yaml:"burst"`
+}
+
+// RateLimitTiers limit an action per user, per platform of the user and per
+// bridged device of the user.
+type RateLimitTiers struct {
+	User     RateLimit `yaml:"user"`
+	Platform RateLimit `yaml:"platform"`
+	Device   RateLimit `yaml:"device"`
+}
+
+type RateLimits struct {
+	Send        RateLimitTiers `yaml:"send"`
+	DeviceLogin RateLimitTiers `yaml:"device_login"`
+	List        RateLimitTiers `yaml:"list"`
+}
+
+// LoginTimeouts bound how long a device login may stay in each state before
+// it expires.
+type LoginTimeouts struct {
+	Pending      time.Duration `yaml:"pending"`
+	AwaitingScan time.Duration `yaml:"awaiting_scan"`
+	// AwaitingInput bounds how long the client has to answer a login step.
+	AwaitingInput time.Duration `yaml:"awaiting_input"`
+	Scanned       time.Duration `yaml:"scanned"`
+}
+
 type Conf struct {
 	Server           Server                    `yaml:"server"`
-	Websocket        ServerWebsocket           `yaml:"websocket"`
 	KeystoreFilepath string                    `yaml:"keystore_filepath"`
 	HomeServer       string                    `yaml:"homeserver"`
 	HomeServerDomain string                    `yaml:"homeserver_domain"`
 	Bridges          []map[string]BridgeConfig `yaml:"bridges"`
 	User             User                      `yaml:"user"`
+	Encryption       Encryption                `yaml:"encryption"`
+	Secrets          Secrets                   `yaml:"secrets"`
+	Database         Database                  `yaml:"database"`
+	RateLimits       RateLimits                `yaml:"rate_limits"`
+	Cors             Cors                      `yaml:"cors"`
+	LoginTimeouts    LoginTimeouts             `yaml:"login_timeouts"`
+	BridgeHealth     BridgeHealthConfig        `yaml:"bridge_health"`
+	BridgeCommands   BridgeCommands            `yaml:"bridge_commands"`
+	TrustedProxies   []string                  `yaml:"trusted_proxies"`
+
+	patterns *patternCache
+}
+
+// patternCache holds the patterns of a configuration compiled, so the notices
+// of the bridges are matched without compiling them again.
+type patternCache struct {
+	compiled sync.Map
 }
 
-func (c *Conf) getConf() (*Conf, error) {
-	yamlFile, err := os.ReadFile("conf.yaml")
+// compilePattern compiles expr once for the configuration. Validate sets up
+// the cache, configurations that were not validated compile it every time.
+func (c *Conf) compilePattern(expr string) (*regexp.Regexp, error) {
+	if c.patterns != nil {
+		if pattern, ok := c.patterns.compiled.Load(expr); ok {
+			return pattern.(*regexp.Regexp), nil
+		}
+	}
+	pattern, err := regexp.Compile(expr)
 	if err != nil {
-		return c, err
+		return nil, err
 	}
+	if c.patterns != nil {
+		c.patterns.compiled.Store(expr, pattern)
+	}
+	return pattern, nil
+}
 
-	err = yaml.Unmarshal(yamlFile, c)
+// matchPattern reports whether input matches expr, compiled once for the
+// configuration.
+func (c *Conf) matchPattern(expr string, input string) (bool, error) {
+	pattern, err := c.compilePattern(expr)
 	if err != nil {
-		return c, err
+		return false, err
+	}
+	return pattern.MatchString(input), nil
+}
+
+// BridgeHealthConfig sets how the bridge bots are pinged in the management
+// rooms and who is alerted when one stops answering.
+type BridgeHealthConfig struct {
+	// Interval is how often each bridge bot is pinged.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout bounds how long the bot has to answer a ping.
+	Timeout time.Duration `yaml:"timeout"`
+	// Failures is how many pings in a row may go unanswered before the
+	// bridge is unhealthy.
+	Failures int `yaml:"failures"`
+	// Webhooks are called when a bridge turns unhealthy and when it recovers.
+	Webhooks []AlertWebhook `yaml:"webhooks"`
+}
+
+// BridgeCommands bounds how long the replies of the bridge bot to a command
+// sent through POST /{platform}/command are collected.
+type BridgeCommands struct {
+	// QuietPeriod ends the collection once the bot sent nothing for this
+	// long after its first reply.
+	QuietPeriod time.Duration `yaml:"quiet_period"`
+	// Timeout ends it regardless.
+	Timeout time.Duration `yaml:"timeout"`
+	// AdminToken is the bearer token operators run commands for any user
+	// with, the endpoint is disabled while it is unset.
+	AdminToken string `yaml:"admin_token"`
+}
+
+type AlertWebhook struct {
+	URL    string `yaml:"url"`
+	Method string `yaml:"method"`
+}
+
+func (s *Server) GetShutdownTimeout() time.Duration {
+	if s.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return s.ShutdownTimeout
+}
+
+func (c *Cors) GetAllowedMethods() []string {
+	if len(c.AllowedMethods) == 0 {
+		return defaultCorsMethods
+	}
+	return c.AllowedMethods
+}
+
+func (c *Cors) GetAllowedHeaders() []string {
+	if len(c.AllowedHeaders) == 0 {
+		return defaultCorsHeaders
+	}
+	return c.AllowedHeaders
+}
+
+func (c *Cors) GetMaxAge() time.Duration {
+	if c.MaxAge <= 0 {
+		return defaultCorsMaxAge
+	}
+	return c.MaxAge
+}
+
+// Get returns the timeout of state, zero for the states a login ends in.
+func (t *LoginTimeouts) Get(state string) time.Duration {
+	var timeout, fallback time.Duration
+	switch state {
+	case LoginStatePending:
+		timeout, fallback = t.Pending, defaultLoginPendingTimeout
+	case LoginStateAwaitingScan:
+		timeout, fallback = t.AwaitingScan, defaultLoginAwaitingScanTimeout
+	case LoginStateAwaitingInput:
+		timeout, fallback = t.AwaitingInput, defaultLoginAwaitingInputTimeout
+	case LoginStateScanned:
+		timeout, fallback = t.Scanned, defaultLoginScannedTimeout
+	default:
+		return 0
+	}
+
+	if timeout <= 0 {
+		return fallback
+	}
+	return timeout
+}
+
+func (d *DeviceList) GetTimeout() time.Duration {
+	if d.Timeout <= 0 {
+		return defaultDeviceListTimeout
+	}
+	return d.Timeout
+}
+
+func (d *DeviceList) GetRefresh() time.Duration {
+	if d.Refresh <= 0 {
+		return defaultDeviceListRefresh
+	}
+	return d.Refresh
+}
+
+func (h *BridgeHealthConfig) GetInterval() time.Duration {
+	if h.Interval <= 0 {
+		return defaultBridgeHealthInterval
 	}
+	return h.Interval
+}
 
-	return c, nil
+func (h *BridgeHealthConfig) GetTimeout() time.Duration {
+	if h.Timeout <= 0 {
+		return defaultBridgeHealthTimeout
+	}
+	return h.Timeout
+}
+
+func (h *BridgeHealthConfig) GetFailures() int {
+	if h.Failures <= 0 {
+		return defaultBridgeHealthFailures
+	}
+	return h.Failures
+}
+
+func (b *BridgeCommands) GetQuietPeriod() time.Duration {
+	if b.QuietPeriod <= 0 {
+		return defaultBridgeCommandQuietPeriod
+	}
+	return b.QuietPeriod
+}
+
+func (b *BridgeCommands) GetTimeout() time.Duration {
+	if b.Timeout <= 0 {
+		return defaultBridgeCommandTimeout
+	}
+	return b.Timeout
+}
+
+func (w *AlertWebhook) GetMethod() string {
+	if w.Method == "" {
+		return http.MethodPost
+	}
+	return strings.ToUpper(w.Method)
+}
+
+func (d *Database) GetDir() string {
+	if d.Dir == "" {
+		return defaultDatabaseDir
+	}
+	return d.Dir
+}
+
+func (d *Database) GetBusyTimeout() time.Duration {
+	if d.BusyTimeout <= 0 {
+		return defaultBusyTimeout
+	}
+	return d.BusyTimeout
+}
+
+func (d *Database) GetIdleTimeout() time.Duration {
+	if d.IdleTimeout <= 0 {
+		return defaultIdleTimeout
+	}
+	return d.IdleTimeout
 }
 
 func (c *Conf) GetBridgeConfig(bridgeType string) (*BridgeConfig, bool) {
@@ -106,7 +401,246 @@ func (c *Conf) CheckSuccessPattern(bridgeType string, input string) (bool, error
 
 	// Replace %s with .* to create a regex pattern
 	regexPattern := strings.ReplaceAll(successPattern, "%s", ".*")
-	matched, err := regexp.MatchString(regexPattern, input)
+	matched, err := c.matchPattern(regexPattern, input)
+	if err != nil {
+		return false, fmt.Errorf("error matching pattern: %v", err)
+	}
+
+	return matched, nil
+}
+
+// MatchSuccessPattern reports whether input is the success notice of the
+// bridge, along with what it logged in as: the first %s of the pattern,
+// usually the phone number.
+func (c *Conf) MatchSuccessPattern(bridgeType string, input string) (bool, string, error) {
+	config, ok := c.GetBridgeConfig(bridgeType)
+	if !ok {
+		return false, "", fmt.Errorf("bridge type %s not found in configuration", bridgeType)
+	}
+
+	successPattern, ok := config.Cmd["success"]
+	if !ok {
+		return false, "", fmt.Errorf("success pattern not found for bridge type %s", bridgeType)
+	}
+
+	regexPattern := strings.ReplaceAll(successPattern, "%s", `(\S+)`)
+	pattern, err := c.compilePattern(regexPattern)
+	if err != nil {
+		return false, "", fmt.Errorf("error matching pattern: %v", err)
+	}
+
+	matches := pattern.FindStringSubmatch(input)
+	if matches == nil {
+		return false, "", nil
+	}
+	if len(matches) < 2 {
+		return true, "", nil
+	}
+
+	return true, matches[1], nil
+}
+
+// ParseDeviceList reads the devices listed in body, the reply of the bridge to
+// its devices command. It reports false when body is neither a device list
+// nor the reply of a bridge the user has no logins on.
+func (c *Conf) ParseDeviceList(bridgeType string, body string) ([]Device, bool, error) {
+	config, ok := c.GetBridgeConfig(bridgeType)
+	if !ok {
+		return nil, false, fmt.Errorf("bridge type %s not found in configuration", bridgeType)
+	}
+
+	pattern, err := c.compileDevicePattern(config.DeviceList.Pattern, defaultDeviceListPattern, "device")
+	if err != nil {
+		return nil, false, fmt.Errorf("device list pattern of bridge type %s: %w", bridgeType, err)
+	}
+
+	emptyPattern := config.DeviceList.Empty
+	if emptyPattern == "" {
+		emptyPattern = defaultDeviceListEmpty
+	}
+	empty, err := c.compilePattern(emptyPattern)
+	if err != nil {
+		return nil, false, fmt.Errorf("error compiling empty device list pattern: %w", err)
+	}
+
+	devices := make([]Device, 0)
+	if empty.MatchString(strings.TrimSpace(body)) {
+		return devices, true, nil
+	}
+
+	for _, line := range strings.Split(body, "\n") {
+		matches := pattern.FindStringSubmatch(strings.TrimSpace(line))
+		if matches == nil {
+			continue
+		}
+		device := Device{
+			Platform:    bridgeType,
+			Handle:      submatch(pattern, matches, "device"),
+			ID:          submatch(pattern, matches, "id"),
+			DisplayName: submatch(pattern, matches, "name"),
+			State:       deviceState(submatch(pattern, matches, "state")),
+		}
+		if device.Handle == "" {
+			continue
+		}
+		if device.ID == "" {
+			device.ID = device.Handle
+		}
+		devices = append(devices, device)
+	}
+	return devices, len(devices) > 0, nil
+}
+
+// MatchStateNotice reads the device and bridge state out of a notice of the
+// bridge about the state of a device, reporting false for other notices.
+func (c *Conf) MatchStateNotice(bridgeType string, body string) (string, string, bool, error) {
+	config, ok := c.GetBridgeConfig(bridgeType)
+	if !ok {
+		return "", "", false, fmt.Errorf("bridge type %s not found in configuration", bridgeType)
+	}
+
+	pattern, err := c.compileDevicePattern(config.DeviceList.StatePattern, defaultDeviceListStatePattern, "device", "state")
+	if err != nil {
+		return "", "", false, fmt.Errorf("state pattern of bridge type %s: %w", bridgeType, err)
+	}
+
+	matches := pattern.FindStringSubmatch(strings.TrimSpace(body))
+	if matches == nil {
+		return "", "", false, nil
+	}
+	return submatch(pattern, matches, "device"), submatch(pattern, matches, "state"), true, nil
+}
+
+// compileDevicePattern compiles expr, or fallback when it is empty, making
+// sure it has the named captures required.
+func (c *Conf) compileDevicePattern(expr, fallback string, required ...string) (*regexp.Regexp, error) {
+	if expr == "" {
+		expr = fallback
+	}
+	pattern, err := c.compilePattern(expr)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range required {
+		if pattern.SubexpIndex(name) < 0 {
+			return nil, fmt.Errorf("no %s capture", name)
+		}
+	}
+	return pattern, nil
+}
+
+func submatch(pattern *regexp.Regexp, matches []string, name string) string {
+	if index := pattern.SubexpIndex(name); index >= 0 {
+		return matches[index]
+	}
+	return ""
+}
+
+func (c *Conf) CheckTimeoutPattern(bridgeType string, input string) (bool, error) {
+	config, ok := c.GetBridgeConfig(bridgeType)
+	if !ok {
+		return false, fmt.Errorf("bridge type %s not found in configuration", bridgeType)
+	}
+
+	timeoutPattern, ok := config.Cmd["timeout"]
+	if !ok {
+		return false, fmt.Errorf("timeout pattern not found for bridge type %s", bridgeType)
+	}
+
+	matched, err := c.matchPattern(timeoutPattern, input)
+	if err != nil {
+		return false, fmt.Errorf("error matching pattern: %v", err)
+	}
+
+	return matched, nil
+}
+
+// MatchLoginStep returns the login step of bridgeType whose prompt input
+// matches, if any.
+func (c *Conf) MatchLoginStep(bridgeType string, input string) (*LoginStep, error) {
+	config, ok := c.GetBridgeConfig(bridgeType)
+	if !ok {
+		return nil, fmt.Errorf("bridge type %s not found in configuration", bridgeType)
+	}
+
+	for i, step := range config.LoginSteps {
+		if step.Prompt == "" {
+			continue
+		}
+		matched, err := c.matchPattern(step.Prompt, input)
+		if err != nil {
+			return nil, fmt.Errorf("error matching pattern of login step %s: %v", step.Input, err)
+		}
+		if matched {
+			return &config.LoginSteps[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// GetLoginStep returns the login step of bridgeType asking for input.
+func (c *Conf) GetLoginStep(bridgeType string, input string) (*LoginStep, bool) {
+	config, ok := c.GetBridgeConfig(bridgeType)
+	if !ok {
+		return nil, false
+	}
+
+	for i, step := range config.LoginSteps {
+		if step.Input == input {
+			return &config.LoginSteps[i], true
+		}
+	}
+	return nil, false
+}
+
+// Render returns the command sending input to the bridge.
+func (s *LoginStep) Render(input string) (string, error) {
+	if s.Command == "" {
+		return input, nil
+	}
+
+	tmpl, err := template.New(s.Input).Parse(s.Command)
+	if err != nil {
+		return "", fmt.Errorf("error parsing command of login step %s: %w", s.Input, err)
+	}
+	var cmd strings.Builder
+	if err := tmpl.Execute(&cmd, input); err != nil {
+		return "", fmt.Errorf("error rendering command of login step %s: %w", s.Input, err)
+	}
+	return cmd.String(), nil
+}
+
+func (c *Conf) CheckPhonePromptPattern(bridgeType string, input string) (bool, error) {
+	config, ok := c.GetBridgeConfig(bridgeType)
+	if !ok {
+		return false, fmt.Errorf("bridge type %s not found in configuration", bridgeType)
+	}
+
+	promptPattern, ok := config.Cmd["phone_prompt"]
+	if !ok {
+		return false, fmt.Errorf("phone prompt pattern not found for bridge type %s", bridgeType)
+	}
+
+	matched, err := c.matchPattern(promptPattern, input)
+	if err != nil {
+		return false, fmt.Errorf("error matching pattern: %v", err)
+	}
+
+	return matched, nil
+}
+
+func (c *Conf) CheckPingReplyPattern(bridgeType string, input string) (bool, error) {
+	config, ok := c.GetBridgeConfig(bridgeType)
+	if !ok {
+		return false, fmt.Errorf("bridge type %s not found in configuration", bridgeType)
+	}
+
+	pingReplyPattern, ok := config.Cmd["ping_reply"]
+	if !ok {
+		return false, fmt.Errorf("ping reply pattern not found for bridge type %s", bridgeType)
+	}
+
+	matched, err := c.matchPattern(pingReplyPattern, input)
 	if err != nil {
 		return false, fmt.Errorf("error matching pattern: %v", err)
 	}
@@ -114,18 +648,18 @@ func (c *Conf) CheckSuccessPattern(bridgeType string, input string) (bool, error
 	return matched, nil
 }
 
-func (c *Conf) CheckOngoingPattern(bridgeType string, input string) (bool, error) {
+func (c *Conf) CheckScannedPattern(bridgeType string, input string) (bool, error) {
 	config, ok := c.GetBridgeConfig(bridgeType)
 	if !ok {
 		return false, fmt.Errorf("bridge type %s not found in configuration", bridgeType)
 	}
 
-	ongoingPattern, ok := config.Cmd["ongoing"]
+	scannedPattern, ok := config.Cmd["scanned"]
 	if !ok {
-		return false, fmt.Errorf("ongoing pattern not found for bridge type %s", bridgeType)
+		return false, fmt.Errorf("scanned pattern not found for bridge type %s", bridgeType)
 	}
 
-	matched, err := regexp.MatchString(ongoingPattern, input)
+	matched, err := c.matchPattern(scannedPattern, input)
 	if err != nil {
 		return false, fmt.Errorf("error matching pattern: %v", err)
 	}
@@ -133,6 +667,33 @@ func (c *Conf) CheckOngoingPattern(bridgeType string, input string) (bool, error
 	return matched, nil
 }
 
+// MatchPairingCode extracts the pairing code from a notice of the bridge, the
+// pairing_code pattern marks where it is with %s.
+func (c *Conf) MatchPairingCode(bridgeType string, input string) (string, error) {
+	config, ok := c.GetBridgeConfig(bridgeType)
+	if !ok {
+		return "", fmt.Errorf("bridge type %s not found in configuration", bridgeType)
+	}
+
+	codePattern, ok := config.Cmd["pairing_code"]
+	if !ok {
+		return "", fmt.Errorf("pairing code pattern not found for bridge type %s", bridgeType)
+	}
+
+	regexPattern := strings.Replace(codePattern, "%s", `([A-Za-z0-9]+(?:-[A-Za-z0-9]+)*)`, 1)
+	pattern, err := c.compilePattern(regexPattern)
+	if err != nil {
+		return "", fmt.Errorf("error matching pattern: %v", err)
+	}
+
+	matches := pattern.FindStringSubmatch(input)
+	if len(matches) < 2 {
+		return "", nil
+	}
+
+	return matches[1], nil
+}
+
 func (c *Conf) CheckUsernameTemplate(bridgeType string, username string) (bool, error) {
 	config, ok := c.GetBridgeConfig(bridgeType)
 	if !ok {
@@ -151,7 +712,7 @@ func (c *Conf) CheckUsernameTemplate(bridgeType string, username string) (bool,
 	// Restore the .* pattern
 	regexPattern = strings.ReplaceAll(regexPattern, "\\.\\*", ".*")
 
-	matched, err := regexp.MatchString(regexPattern, username)
+	matched, err := c.matchPattern(regexPattern, username)
 	if err != nil {
 		return false, fmt.Errorf("error matching username pattern: %v", err)
 	}
@@ -184,19 +745,6 @@ func (c *Conf) FormatUsername(bridgeType string, username string) (string, error
 	return formattedUsername, nil
 }
 
-// ExtractBracketContent extracts the content inside the first pair of parentheses in the input string.
-func ExtractBracketContent(input string) (string, error) {
-	start := strings.Index(input, "(")
-	end := strings.Index(input, ")")
-	if start == -1 || end == -1 || end <= start+1 {
-		return "", fmt.Errorf("no content found in brackets")
-	}
-	content := input[start+1 : end]
-	// Remove the "+" character from the content
-	content = strings.ReplaceAll(content, "+", "")
-	return content, nil
-}
-
 func ReverseAliasForEventSubscriber(username, bridgeName, homeserver string) string {
 	// @username:bridgeName:homeserver.com -> username_bridgeName
 	return fmt.Sprintf("@%s:%s:%s", username, bridgeName, homeserver)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -63,3 +64,190 @@ func TestFormatUsername(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchPairingCode(t *testing.T) {
+	conf := &Conf{
+		Bridges: []map[string]BridgeConfig{
+			{
+				"wa": {
+					Cmd: map[string]string{"pairing_code": "Input the pairing code `%s` on your phone"},
+				},
+				"signal": {},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		bridgeType  string
+		input       string
+		want        string
+		expectError bool
+	}{
+		{"Pairing code notice", "wa", "Input the pairing code `ABCD-EFGH` on your phone to log in", "ABCD-EFGH", false},
+		{"Other notice", "wa", "Scan the QR code with the WhatsApp mobile app to log in", "", false},
+		{"Pattern not configured", "signal", "Input the pairing code `ABCD-EFGH` on your phone", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := conf.MatchPairingCode(tt.bridgeType, tt.input)
+			if (err != nil) != tt.expectError {
+				t.Errorf("MatchPairingCode() error = %v, expectError %v", err, tt.expectError)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("MatchPairingCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchSuccessPattern(t *testing.T) {
+	conf := &Conf{
+		Bridges: []map[string]BridgeConfig{
+			{
+				"wa": {
+					Cmd: map[string]string{"success": "Successfully logged in as %s"},
+				},
+				"signal": {
+					Cmd: map[string]string{"success": "Successfully logged in as %s / %s"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		bridgeType  string
+		input       string
+		wantMatched bool
+		wantPhone   string
+	}{
+		{"WhatsApp success", "wa", "Successfully logged in as +1234567890", true, "+1234567890"},
+		{"Signal success", "signal", "Successfully logged in as +1234567890 / 7b1d3c5e", true, "+1234567890"},
+		{"Other notice", "wa", "Scan the QR code with the WhatsApp mobile app to log in", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched, phone, err := conf.MatchSuccessPattern(tt.bridgeType, tt.input)
+			if err != nil {
+				t.Fatalf("MatchSuccessPattern() error = %v", err)
+			}
+			if matched != tt.wantMatched || phone != tt.wantPhone {
+				t.Errorf("MatchSuccessPattern() = %v, %q, want %v, %q", matched, phone, tt.wantMatched, tt.wantPhone)
+			}
+		})
+	}
+}
+
+func TestParseDeviceList(t *testing.T) {
+	conf := &Conf{
+		Bridges: []map[string]BridgeConfig{
+			{
+				"wa": {},
+				"signal": {
+					DeviceList: DeviceList{
+						Pattern: `^(?P<device>\+\d+) \((?P<name>[^)]+)\) is (online|offline)$`,
+						Empty:   `^No devices`,
+					},
+				},
+				"broken": {
+					DeviceList: DeviceList{Pattern: `^\* (\S+)$`},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		bridgeType  string
+		input       string
+		want        []Device
+		wantOK      bool
+		expectError bool
+	}{
+		{
+			"List logins", "wa", "\n* `1234567890` (+1234567890) - `CONNECTED`\n* `1987654321` (+1987654321) - `BAD_CREDENTIALS`",
+			[]Device{
+				{ID: "1234567890", Handle: "1234567890", Platform: "wa", State: DeviceStateConnected},
+				{ID: "1987654321", Handle: "1987654321", Platform: "wa", State: DeviceStateLoggedOut},
+			},
+			true, false,
+		},
+		{"Not logged in", "wa", "You're not logged in", []Device{}, true, false},
+		{"Other notice", "wa", "Scan the QR code with the WhatsApp mobile app to log in", []Device{}, false, false},
+		{
+			"Custom pattern", "signal", "+1234567890 (John) is online",
+			[]Device{{ID: "+1234567890", Handle: "+1234567890", Platform: "signal", DisplayName: "John", State: DeviceStateUnknown}},
+			true, false,
+		},
+		{"Custom empty reply", "signal", "No devices linked", []Device{}, true, false},
+		{"Pattern without device capture", "broken", "* 1234567890", nil, false, true},
+		{"Bridge not configured", "telegram", "You're not logged in", nil, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := conf.ParseDeviceList(tt.bridgeType, tt.input)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("ParseDeviceList() error = %v, expectError %v", err, tt.expectError)
+			}
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseDeviceList() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestLoginSteps(t *testing.T) {
+	conf := &Conf{
+		Bridges: []map[string]BridgeConfig{
+			{"telegram": {LoginSteps: []LoginStep{
+				{Prompt: "^Please enter your phone number", Input: "phone_number"},
+				{Prompt: "^Please enter the code", Input: "code", Command: "!tg code {{.}}"},
+				{Prompt: "^Please enter your password", Input: "password", Secret: true},
+			}}},
+			{"broken": {LoginSteps: []LoginStep{{Prompt: "(", Input: "code"}}}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		bridgeType  string
+		input       string
+		value       string
+		wantInput   string
+		wantCommand string
+		expectError bool
+	}{
+		{"Phone number", "telegram", "Please enter your phone number", "+1234567890", "phone_number", "+1234567890", false},
+		{"Code with command", "telegram", "Please enter the code sent to +1234567890", "12345", "code", "!tg code 12345", false},
+		{"Password", "telegram", "Please enter your password", "hunter2", "password", "hunter2", false},
+		{"Other notice", "telegram", "Successfully logged in as +1234567890", "", "", "", false},
+		{"Broken prompt", "broken", "Please enter the code", "", "", "", true},
+		{"Bridge not configured", "signal", "Please enter the code", "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := conf.MatchLoginStep(tt.bridgeType, tt.input)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("MatchLoginStep() error = %v, expectError %v", err, tt.expectError)
+			}
+			if tt.wantInput == "" {
+				if step != nil {
+					t.Errorf("MatchLoginStep() = %+v, want no step", step)
+				}
+				return
+			}
+			if step == nil || step.Input != tt.wantInput {
+				t.Fatalf("MatchLoginStep() = %+v, want the %s step", step, tt.wantInput)
+			}
+			if got, err := step.Render(tt.value); err != nil || got != tt.wantCommand {
+				t.Errorf("Render() = %q, %v, want %q", got, err, tt.wantCommand)
+			}
+		})
+	}
+}
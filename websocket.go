@@ -1,176 +1,760 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
+	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"maunium.net/go/mautrix/id"
 )
 
-// var upgrader = websocket.Upgrader{}
+// pairingCodeTimeout bounds how long ApiAddDevice waits for the bridge to send
+// the pairing code of a phone login.
+const pairingCodeTimeout = 30 * time.Second
+
+// Close codes of login websockets besides websocket.CloseNormalClosure for a
+// successful login and websocket.CloseGoingAway on shutdown.
+const (
+	CloseLoginFailed    = 4000
+	CloseLoginTimeout   = 4001
+	CloseLoginCancelled = 4002
+)
+
+// websocketFormatBinary is the format query value for clients of the older
+// protocol: QR codes as binary frames, pairing codes as text frames and an
+// empty binary frame when the login ends.
+const websocketFormatBinary = "binary"
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for development/testing.
-		// In production, you should restrict this to known origins.
-		return true
-	},
-}
-
-type Websockets struct {
-	Bridge *Bridges
+	CheckOrigin:     checkWebsocketOrigin,
 }
 
 type WebsocketController struct {
-	Registry []*WebsocketUnit
+	registryMutex sync.Mutex
+	Registry      []*WebsocketUnit
+	// rooms maps the running logins to the bridge room each runs in, a room
+	// only runs one login at a time so what the bridge sends can't mix up.
+	rooms map[*WebsocketUnit]id.RoomID
+
+	connMutex sync.Mutex
+	// connections maps every open websocket to the user it was opened for.
+	connections map[*websocket.Conn]string
 }
 
+// WebsocketUnit is a device login of a user on a platform, any number of
+// which can run at once. ApiAddDevice starts the login, every websocket
+// connected to it receives what the bridge sends until the login ends,
+// expires or the last one disconnects, which removes the unit from the
+// registry.
 type WebsocketUnit struct {
 	Url          string
 	PlatformName string
 	Username     string
-	Websocket    *Websockets
+	Bridge       *Bridges
+	Login        DeviceLogin
+
+	mutex sync.Mutex
+	// Session follows the state of the login, persisted on every transition.
+	Session LoginSession
+	// changed is closed and replaced on every transition.
+	changed chan struct{}
+	// viewers maps the websockets of the login to whether they want the
+	// binary format.
+	viewers map[*websocket.Conn]bool
+	// last is replayed to websockets joining a running login.
+	last        *LoginUpdate
+	qrCode      string
+	pairingCode string
+	// step is the login step the bridge asked for while awaiting_input.
+	step *LoginStep
+	// paired is closed once the bridge sent a pairing code.
+	paired  chan struct{}
+	started bool
+	done    chan struct{}
+}
+
+func NewWebsocketUnit(bridge *Bridges, platformName string, username string, login DeviceLogin, session LoginSession) *WebsocketUnit {
+	return &WebsocketUnit{
+		Url:          fmt.Sprintf("/ws/%s/%s/%s", platformName, username, session.ID),
+		PlatformName: platformName,
+		Username:     username,
+		Bridge:       bridge,
+		Login:        login,
+		Session:      session,
+		changed:      make(chan struct{}),
+		viewers:      make(map[*websocket.Conn]bool),
+		paired:       make(chan struct{}),
+		done:         make(chan struct{}),
+	}
 }
 
-func GetWebsocketUsernameIndex(username string) int {
-	for index, _wd := range GlobalWebsocketConnection.Registry {
-		if _wd.Username == username {
-			return index
+// Status is the state of the login along with the code it is awaiting, if
+// any.
+func (unit *WebsocketUnit) Status() LoginStatus {
+	unit.mutex.Lock()
+	defer unit.mutex.Unlock()
+
+	status := LoginStatus{LoginSession: unit.Session}
+	status.Transitions = slices.Clone(unit.Session.Transitions)
+	if unit.Session.State == LoginStateAwaitingScan {
+		status.QRCode = unit.qrCode
+		status.PairingCode = unit.pairingCode
+	}
+	if unit.Session.State == LoginStateAwaitingInput && unit.step != nil {
+		status.Input = unit.step.Input
+	}
+	return status
+}
+
+// transition moves the login to state and persists it, waking watch up to
+// follow the timeout of the new state. It must be called with the mutex held.
+func (unit *WebsocketUnit) transition(state, reason string) bool {
+	transition, ok := unit.Session.Transition(state, reason, time.Now())
+	if !ok {
+		return false
+	}
+	log.Printf("[+] Device login %s of %s on %s is %s", unit.Session.ID, unit.Username, unit.PlatformName, state)
+
+	unit.saveSession(&transition)
+	close(unit.changed)
+	unit.changed = make(chan struct{})
+	return true
+}
+
+func (unit *WebsocketUnit) saveSession(transition *LoginTransition) {
+	clientDb, err := GlobalStorage.OpenClient(unit.Username)
+	if err != nil {
+		log.Println("Error opening client db:", err)
+		return
+	}
+	defer clientDb.Close()
+
+	if err := clientDb.UpdateLoginSession(&unit.Session, transition); err != nil {
+		log.Println("Error storing login session:", err)
+	}
+}
+
+// watch expires the login once it stayed in a state past the timeout
+// configured for it.
+func (unit *WebsocketUnit) watch() {
+	for {
+		unit.mutex.Lock()
+		expiresAt := unit.Session.ExpiresAt
+		changed := unit.changed
+		unit.mutex.Unlock()
+
+		if expiresAt == nil {
+			return
 		}
+
+		timer := time.NewTimer(time.Until(*expiresAt))
+		select {
+		case <-changed:
+			timer.Stop()
+			continue
+		case <-timer.C:
+			// A transition may have won the race against the timer.
+			if !unit.expire(time.Now()) {
+				continue
+			}
+		case <-unit.done:
+			timer.Stop()
+		case <-GlobalShutdown.Context().Done():
+			timer.Stop()
+		}
+		return
 	}
-	return -1
 }
 
-func GetWebsocketIndex(username string, platformName string) int {
-	for index, _wd := range GlobalWebsocketConnection.Registry {
-		if _wd.Username == username &&
-			_wd.PlatformName == platformName {
-			return index
+// expire ends the login with a timeout if it is past the timeout of its
+// state, telling the bridge to stop it when it was started.
+func (unit *WebsocketUnit) expire(now time.Time) bool {
+	unit.mutex.Lock()
+	if !unit.Session.Expired(now) {
+		unit.mutex.Unlock()
+		return false
+	}
+	reason := expiredLoginReason(unit.Session.State)
+	started := unit.started
+	bridge := *unit.Bridge
+	unit.mutex.Unlock()
+
+	unit.broadcast(LoginUpdate{Type: LoginUpdateTimeout, Reason: reason})
+	if started {
+		if err := bridge.CancelLogin(); err != nil {
+			log.Println("Error cancelling login with the bridge:", err)
 		}
 	}
-	return -1
+	unit.finish(reason)
+	return true
 }
 
-// func (ws *Websockets) listenForDisconnection(c *websocket.Conn, ch chan []byte) {
-// 	for {
-// 		_, _, err := c.ReadMessage()
-// 		if err != nil {
-// 			log.Printf("Client connection lost for user %s: %v", ws.Bridge.Client.UserID, err)
-// 			if bridgeCfg, ok := cfg.GetBridgeConfig(ws.Bridge.Name); ok {
-// 				log.Println("Sending cancel command to:", ws.Bridge.RoomID)
-// 				_, err = ws.Bridge.Client.SendText(
-// 					context.Background(),
-// 					ws.Bridge.RoomID,
-// 					bridgeCfg.Cmd["cancel"],
-// 				)
+// Start starts the login with the bridge unless it is running already. When
+// it is over the device login rate limit, the wait is returned instead.
+func (unit *WebsocketUnit) Start() (time.Duration, bool) {
+	unit.mutex.Lock()
+	defer unit.mutex.Unlock()
 
-// 				if err != nil {
-// 					log.Printf("Error sending cancel command to %s: %v", ws.Bridge.RoomID, err)
-// 				}
-// 				ch <- nil
-// 			}
-// 		}
-// 	}
-// }
+	if unit.started {
+		return 0, true
+	}
 
-func (ws *Websockets) Handler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Websocket handler called", ws.Bridge.Client.UserID)
-	conn, err := upgrader.Upgrade(w, r, nil)
+	wait, ok := GlobalRateLimiter.Allow(RateLimitDeviceLogin, unit.Username, unit.PlatformName, "", time.Now())
+	if !ok {
+		return wait, false
+	}
 
-	if err != nil {
-		log.Println(err)
+	unit.started = true
+	GlobalShutdown.Go(unit.run)
+	return 0, true
+}
+
+// ErrUnexpectedLoginInput is returned for inputs the login is not waiting
+// for.
+var ErrUnexpectedLoginInput = errors.New("the login is not waiting for this input")
+
+// ErrInvalidLoginInput is returned for values holding newlines or other
+// control characters, which would send the bridge more than the one command
+// of the login step.
+var ErrInvalidLoginInput = errors.New("the value must not contain newlines or control characters")
+
+// Answer sends value to the bridge as the input of the login step it asked
+// for, the login going back to pending until the bridge replies. A login the
+// input can't be sent for fails.
+func (unit *WebsocketUnit) Answer(input, value string) error {
+	unit.mutex.Lock()
+	step := unit.step
+	if unit.Session.State != LoginStateAwaitingInput || step == nil || step.Input != input {
+		unit.mutex.Unlock()
+		return ErrUnexpectedLoginInput
+	}
+	if strings.ContainsFunc(value, unicode.IsControl) {
+		unit.mutex.Unlock()
+		return ErrInvalidLoginInput
+	}
+	unit.step = nil
+	unit.transition(LoginStatePending, "")
+	bridge := *unit.Bridge
+	unit.mutex.Unlock()
+
+	unit.broadcast(LoginUpdate{Type: LoginUpdateStatus, Input: input})
+	if err := bridge.SendLoginInput(step, value); err != nil {
+		reason := "could not send the " + input + " to the bridge"
+		unit.broadcast(LoginUpdate{Type: LoginUpdateFailed, Reason: reason})
+		unit.finish(reason)
+		return err
 	}
+	return nil
+}
 
-	ch := make(chan []byte)
-	// go ws.listenForDisconnection(conn, ch)
+// receive handles a frame a websocket of the login sent, rejecting it to that
+// websocket when it is not an input the login is waiting for.
+func (unit *WebsocketUnit) receive(conn *websocket.Conn, data []byte) {
+	var input LoginInput
+	err := json.Unmarshal(data, &input)
+	if err == nil && input.Type != LoginUpdateInput {
+		err = fmt.Errorf("unexpected frame type %q", input.Type)
+	}
+	if err == nil {
+		err = unit.Answer(input.Input, input.Value)
+	}
+	if err == nil {
+		return
+	}
 
-	clientDb := ClientDB{
-		username: ws.Bridge.Client.UserID.Localpart(),
-		filepath: "db/" + ws.Bridge.Client.UserID.Localpart() + ".db",
+	unit.mutex.Lock()
+	defer unit.mutex.Unlock()
+	rejected := LoginUpdate{Type: LoginUpdateRejected, State: unit.Session.State, Input: input.Input, Reason: err.Error()}
+	if binary, ok := unit.viewers[conn]; ok {
+		if err := writeLoginUpdate(conn, rejected, binary); err != nil {
+			log.Printf("Error sending message to client socket for user %s: %v", unit.Username, err)
+		}
 	}
-	if err := clientDb.Init(); err != nil {
-		log.Println("Error initializing client db:", err)
+}
+
+// WaitForPairingCode returns the pairing code of a phone login once the
+// bridge sent it, or an empty code when the login ends or ctx is done first.
+func (unit *WebsocketUnit) WaitForPairingCode(ctx context.Context) string {
+	select {
+	case <-unit.paired:
+	case <-unit.done:
+	case <-ctx.Done():
 	}
 
-	sessions, _, err := clientDb.FetchActiveSessions(ws.Bridge.Client.UserID.Localpart())
-	if err != nil {
-		log.Println("Error fetching active sessions:", err)
+	unit.mutex.Lock()
+	defer unit.mutex.Unlock()
+	return unit.pairingCode
+}
+
+func (wc *WebsocketController) Register(unit *WebsocketUnit) {
+	wc.registryMutex.Lock()
+	defer wc.registryMutex.Unlock()
+	wc.Registry = append(wc.Registry, unit)
+	log.Println("[+] Registered websocket", unit.Url)
+}
+
+// Logins returns the device logins of username on platformName in progress.
+func (wc *WebsocketController) Logins(username string, platformName string) []*WebsocketUnit {
+	wc.registryMutex.Lock()
+	defer wc.registryMutex.Unlock()
+	var units []*WebsocketUnit
+	for _, unit := range wc.Registry {
+		if unit.Username == username && unit.PlatformName == platformName {
+			units = append(units, unit)
+		}
+	}
+	return units
+}
+
+// LookupLogin returns the unit driving the device login of username with id.
+func (wc *WebsocketController) LookupLogin(username string, id string) *WebsocketUnit {
+	wc.registryMutex.Lock()
+	defer wc.registryMutex.Unlock()
+	for _, unit := range wc.Registry {
+		if unit.Username == username && unit.Session.ID == id {
+			return unit
+		}
+	}
+	return nil
+}
+
+func (wc *WebsocketController) Remove(unit *WebsocketUnit) {
+	wc.registryMutex.Lock()
+	defer wc.registryMutex.Unlock()
+	for index, registered := range wc.Registry {
+		if registered == unit {
+			wc.Registry = append(wc.Registry[:index], wc.Registry[index+1:]...)
+			delete(wc.rooms, unit)
+			log.Println("[+] Removed websocket", unit.Url)
+			return
+		}
+	}
+}
+
+// reserveRoom hands unit the first of rooms no other login of its user on
+// the platform runs in, reporting false when they are all taken.
+func (wc *WebsocketController) reserveRoom(unit *WebsocketUnit, rooms []id.RoomID) (id.RoomID, bool) {
+	wc.registryMutex.Lock()
+	defer wc.registryMutex.Unlock()
+	if wc.rooms == nil {
+		wc.rooms = make(map[*WebsocketUnit]id.RoomID)
+	}
+
+	taken := make(map[id.RoomID]bool)
+	for other, room := range wc.rooms {
+		if other != unit && other.Username == unit.Username && other.PlatformName == unit.PlatformName {
+			taken[room] = true
+		}
+	}
+	for _, room := range rooms {
+		if room != "" && !taken[room] {
+			wc.rooms[unit] = room
+			return room, true
+		}
+	}
+	return "", false
+}
+
+func (wc *WebsocketController) trackConnection(conn *websocket.Conn, username string) {
+	wc.connMutex.Lock()
+	defer wc.connMutex.Unlock()
+	if wc.connections == nil {
+		wc.connections = make(map[*websocket.Conn]string)
+	}
+	wc.connections[conn] = username
+}
+
+func (wc *WebsocketController) untrackConnection(conn *websocket.Conn) {
+	wc.connMutex.Lock()
+	defer wc.connMutex.Unlock()
+	delete(wc.connections, conn)
+}
+
+// CloseAll sends a going-away close frame to every open websocket and closes it.
+func (wc *WebsocketController) CloseAll(reason string) {
+	wc.connMutex.Lock()
+	defer wc.connMutex.Unlock()
+
+	for conn := range wc.connections {
+		err := conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, reason),
+			time.Now().Add(time.Second),
+		)
+		if err != nil {
+			log.Println("Error sending close frame:", err)
+		}
+		conn.Close()
+		delete(wc.connections, conn)
+	}
+}
+
+// CloseUser sends a normal close frame to every open websocket of username and
+// closes it.
+func (wc *WebsocketController) CloseUser(username string, reason string) {
+	wc.connMutex.Lock()
+	defer wc.connMutex.Unlock()
+
+	for conn, connUsername := range wc.connections {
+		if connUsername != username {
+			continue
+		}
+		err := conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason),
+			time.Now().Add(time.Second),
+		)
+		if err != nil {
+			log.Println("Error sending close frame:", err)
+		}
+		conn.Close()
+		delete(wc.connections, conn)
+	}
+}
+
+// ApiWebsocket upgrades to the websocket of the device login registered by
+// ApiAddDevice for the platform, user and login in the path.
+func ApiWebsocket(c *gin.Context) {
+	unit := GlobalWebsocketConnection.LookupLogin(c.Param("username"), c.Param("id"))
+	if unit == nil || unit.PlatformName != c.Param("platform") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No device login for this websocket, add the device first"})
+		return
 	}
 
-	if len(sessions) > 0 {
-		log.Println("Active sessions found, sending message to client socket")
-		conn.WriteMessage(websocket.BinaryMessage, sessions)
+	unit.Handler(c.Writer, c.Request, c.ClientIP())
+}
+
+// Handler attaches the websocket of the handshake r, from clientIP, to the
+// login.
+func (unit *WebsocketUnit) Handler(w http.ResponseWriter, r *http.Request, clientIP string) {
+	log.Println("Websocket handler called", unit.Bridge.Client.UserID)
+
+	if !authenticateWebsocket(r, clientIP, unit.Username, unit.PlatformName) {
+		http.Error(w, "Invalid or missing websocket ticket", http.StatusUnauthorized)
+		return
 	}
 
-	err = ws.Bridge.AddDevice(&ch)
+	unit.mutex.Lock()
+	select {
+	case <-unit.done:
+		unit.mutex.Unlock()
+		http.Error(w, "Device login has ended, add the device again", http.StatusGone)
+		return
+	default:
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		unit.mutex.Unlock()
+		log.Println(err)
+		return
+	}
+
+	binary := r.URL.Query().Get("format") == websocketFormatBinary
+	GlobalWebsocketConnection.trackConnection(conn, unit.Username)
+	unit.viewers[conn] = binary
+	if unit.last != nil {
+		if err := writeLoginUpdate(conn, *unit.last, binary); err != nil {
+			log.Printf("Error sending message to client socket for user %s: %v", unit.Username, err)
+		}
+	}
+	unit.mutex.Unlock()
+
+	// Clients answer the login steps the bridge asks for, reading also
+	// notices when they go away.
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		unit.receive(conn, data)
+	}
+
+	unit.removeViewer(conn)
+}
+
+// run drives the login with the bridge and hands what it sends to the
+// websockets until an update ends the login.
+func (unit *WebsocketUnit) run() {
+	defer unit.finish("the login stopped")
+
+	if err := unit.acquireRoom(); err != nil {
+		log.Printf("Failed to get a room for device login %s: %v", unit.Session.ID, err)
+		unit.broadcast(LoginUpdate{Type: LoginUpdateFailed, Reason: "could not open a room with the bridge"})
+		return
+	}
+
+	ch := make(chan LoginUpdate)
+	if err := unit.Bridge.AddDevice(ch, unit.done, unit.Session.ID, unit.Login); err != nil {
 		log.Printf("Failed to add device: %v", err)
+		unit.broadcast(LoginUpdate{Type: LoginUpdateFailed, Reason: "could not start the login with the bridge"})
 		return
 	}
 
 	for {
 		log.Println("Waiting for data from channel")
-		data := <-ch
-		if data == nil {
-			err := conn.WriteMessage(websocket.BinaryMessage, data)
-			if err != nil {
-				log.Printf("Error sending message to client socket for user %s: %v", ws.Bridge.Client.UserID, err)
+		var update LoginUpdate
+		select {
+		case <-GlobalShutdown.Context().Done():
+			log.Println("Shutting down websocket for:", unit.Bridge.Client.UserID)
+			unit.finish("the server shut down")
+			return
+		case <-unit.done:
+			return
+		case update = <-ch:
+		}
+
+		unit.broadcast(update)
+		if update.Type == LoginUpdateSuccess {
+			// The device shows up in the list without waiting for the
+			// next refresh.
+			bridge := *unit.Bridge
+			GlobalShutdown.Go(func() {
+				if _, err := bridge.RefreshDevices(GlobalShutdown.Context()); err != nil {
+					log.Println("Error refreshing devices:", err, bridge.Name)
+				}
+			})
+		}
+		if update.Ended() {
+			return
+		}
+	}
+}
+
+// acquireRoom picks the bridge room the login runs in: the management room
+// unless another login of the platform runs there, a room an earlier login
+// ran in, or else a new direct room with the bridge bot.
+func (unit *WebsocketUnit) acquireRoom() error {
+	rooms := []id.RoomID{unit.Bridge.RoomID}
+
+	clientDb, err := GlobalStorage.OpenClient(unit.Username)
+	if err != nil {
+		return err
+	}
+	loginRooms, err := clientDb.FetchLoginRooms(unit.PlatformName)
+	clientDb.Close()
+	if err != nil {
+		return err
+	}
+	for _, room := range loginRooms {
+		rooms = append(rooms, id.RoomID(room))
+	}
+
+	room, ok := GlobalWebsocketConnection.reserveRoom(unit, rooms)
+	if !ok {
+		ctx, cancel := context.WithCancel(GlobalShutdown.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-unit.done:
+				cancel()
+			case <-ctx.Done():
 			}
-			conn.Close()
-			break
+		}()
+
+		created, err := unit.Bridge.CreateLoginRoom(ctx)
+		if err != nil {
+			return err
+		}
+		room, _ = GlobalWebsocketConnection.reserveRoom(unit, []id.RoomID{created})
+	}
+
+	unit.mutex.Lock()
+	defer unit.mutex.Unlock()
+	unit.Bridge.RoomID = room
+	unit.Session.RoomID = room.String()
+	unit.saveSession(nil)
+	return nil
+}
+
+// storeCode keeps the QR or pairing code of update with the login session, so
+// it can be looked up without the server driving the login. A nil update
+// forgets it. It must be called with the mutex held.
+func (unit *WebsocketUnit) storeCode(update *LoginUpdate) {
+	clientDb, err := GlobalStorage.OpenClient(unit.Username)
+	if err != nil {
+		log.Println("Error opening client db:", err)
+		return
+	}
+	defer clientDb.Close()
+
+	if update == nil {
+		err = clientDb.RemoveActiveSessions(unit.PlatformName, unit.Session.ID)
+	} else {
+		var code []byte
+		if code, err = json.Marshal(update); err == nil {
+			err = clientDb.StoreActiveSessions(unit.PlatformName, unit.Session.ID, code)
 		}
+	}
+	if err != nil {
+		log.Println("Error storing login code:", err)
+	}
+}
 
-		fmt.Println("Websocket sending message for:", ws.Bridge.Client.UserID)
+// writeLoginUpdate sends update as a JSON frame, or in the binary format
+// which only has QR codes, pairing codes and the end of the login.
+func writeLoginUpdate(conn *websocket.Conn, update LoginUpdate, binary bool) error {
+	if !binary {
+		return conn.WriteJSON(update)
+	}
 
-		if conn == nil {
-			log.Println("Error connecting socket, client is nil")
-			break
+	switch {
+	case update.Type == LoginUpdateQR:
+		return conn.WriteMessage(websocket.BinaryMessage, update.Image)
+	case update.Type == LoginUpdatePairingCode:
+		return conn.WriteMessage(websocket.TextMessage, []byte(update.PairingCode))
+	case update.Ended():
+		return conn.WriteMessage(websocket.BinaryMessage, nil)
+	}
+	return nil
+}
+
+// loginCloseMessage is the close frame telling the websockets how the login
+// ended.
+func loginCloseMessage(last *LoginUpdate) []byte {
+	if last != nil {
+		switch last.Type {
+		case LoginUpdateSuccess:
+			return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "login succeeded")
+		case LoginUpdateFailed:
+			return websocket.FormatCloseMessage(CloseLoginFailed, "login failed")
+		case LoginUpdateTimeout:
+			return websocket.FormatCloseMessage(CloseLoginTimeout, "login timed out")
+		case LoginUpdateCancelled:
+			return websocket.FormatCloseMessage(CloseLoginCancelled, "login cancelled")
 		}
+	}
+	return websocket.FormatCloseMessage(websocket.CloseGoingAway, "login ended")
+}
 
-		err := conn.WriteMessage(websocket.BinaryMessage, data)
-		if err != nil {
-			log.Printf("Error sending message to client socket for user %s: %v", ws.Bridge.Client.UserID, err)
-			break
+// broadcast sends update to every websocket of the login, dropping the ones
+// that can no longer be written to.
+func (unit *WebsocketUnit) broadcast(update LoginUpdate) {
+	unit.mutex.Lock()
+	defer unit.mutex.Unlock()
+
+	// Nothing the bridge sends after the login ended changes how it ended.
+	if unit.Session.Ended() {
+		return
+	}
+
+	switch update.Type {
+	case LoginUpdateQR, LoginUpdatePairingCode:
+		if unit.Session.State == LoginStatePending {
+			unit.transition(LoginStateAwaitingScan, "")
 		}
+	case LoginUpdateScanned:
+		unit.transition(LoginStateScanned, "")
+	case LoginUpdateInput:
+		unit.transition(LoginStateAwaitingInput, "")
+		unit.step, _ = cfg().GetLoginStep(unit.PlatformName, update.Input)
+	case LoginUpdateSuccess:
+		unit.Session.PhoneNumber = update.PhoneNumber
+		unit.transition(LoginStateSuccess, "")
+	case LoginUpdateFailed:
+		unit.transition(LoginStateFailed, update.Reason)
+	case LoginUpdateTimeout:
+		unit.transition(LoginStateExpired, update.Reason)
+	case LoginUpdateCancelled:
+		unit.transition(LoginStateCancelled, update.Reason)
 	}
+	update.State = unit.Session.State
 
-	defer func() {
-		eventSubName := ReverseAliasForEventSubscriber(ws.Bridge.Client.UserID.Localpart(), ws.Bridge.Name, cfg.HomeServerDomain)
-		for index, subscriber := range EventSubscribers {
-			if subscriber.Name == eventSubName {
-				EventSubscribers = append(EventSubscribers[:index], EventSubscribers[index+1:]...)
-				log.Println("Removed event subscriber:", eventSubName)
-				break
-			}
+	unit.last = &update
+	if update.Type == LoginUpdateQR || update.Type == LoginUpdatePairingCode {
+		unit.storeCode(&update)
+	}
+	if update.QRCode != "" {
+		unit.qrCode = update.QRCode
+	}
+	if update.PairingCode != "" && unit.pairingCode == "" {
+		unit.pairingCode = update.PairingCode
+		close(unit.paired)
+	}
+	fmt.Println("Websocket sending message for:", unit.Bridge.Client.UserID)
+
+	for conn, binary := range unit.viewers {
+		if err := writeLoginUpdate(conn, update, binary); err != nil {
+			log.Printf("Error sending message to client socket for user %s: %v", unit.Username, err)
+			conn.Close()
 		}
-	}()
+	}
 }
 
-func (w *Websockets) RegisterWebsocket(platformName string, username string) string {
-	websocketUrl := fmt.Sprintf("/ws/%s/%s", platformName, username)
+func (unit *WebsocketUnit) removeViewer(conn *websocket.Conn) {
+	GlobalWebsocketConnection.untrackConnection(conn)
+	conn.Close()
 
-	http.HandleFunc(websocketUrl, w.Handler)
-	log.Println("[+] Registered websocket", websocketUrl)
-	GlobalWebsocketConnection.Registry = append(GlobalWebsocketConnection.Registry, &WebsocketUnit{
-		Url:          websocketUrl,
-		PlatformName: platformName,
-		Username:     username,
-		Websocket:    w,
-	})
-	return websocketUrl
+	unit.mutex.Lock()
+	delete(unit.viewers, conn)
+	empty := len(unit.viewers) == 0
+	unit.mutex.Unlock()
+
+	if empty {
+		unit.finish("the last websocket disconnected")
+	}
 }
 
-func MainWebsocket(tls bool) error {
-	port := cfg.Websocket.Port
-	host := cfg.Websocket.Host
+// finish ends the login once, cancelling it for reason unless it ended
+// already, closing its websockets and removing it from the registry so the
+// next ApiAddDevice starts over.
+func (unit *WebsocketUnit) finish(reason string) {
+	unit.mutex.Lock()
+
+	select {
+	case <-unit.done:
+		unit.mutex.Unlock()
+		return
+	default:
+	}
+	close(unit.done)
+
+	abandoned := unit.started && !unit.Session.Ended()
+	bridge := *unit.Bridge
+	if unit.transition(LoginStateCancelled, reason) {
+		update := LoginUpdate{Type: LoginUpdateCancelled, State: LoginStateCancelled, Reason: reason}
+		unit.last = &update
+		for conn, binary := range unit.viewers {
+			writeLoginUpdate(conn, update, binary)
+		}
+	}
+
+	if unit.started {
+		unit.storeCode(nil)
+	}
+
+	GlobalWebsocketConnection.Remove(unit)
+	RemoveEventSubscriber(loginSubscriberName(unit.Username, unit.PlatformName, unit.Session.ID))
+
+	closeMessage := loginCloseMessage(unit.last)
+	for conn := range unit.viewers {
+		// Fails for websockets closed already, which need no close frame.
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+		conn.Close()
+	}
+	unit.mutex.Unlock()
 
-	if tls {
-		log.Println("Starting websocket with Tls")
-		return http.ListenAndServeTLS(fmt.Sprintf("%s:%s", host, port), cfg.Websocket.Tls.Crt, cfg.Websocket.Tls.Key, nil)
+	// The bridge would keep showing codes for a login nobody follows, and
+	// logins cancelled by the user must not link the device afterwards.
+	if abandoned && GlobalShutdown.Context().Err() == nil {
+		if err := bridge.CancelLogin(); err != nil {
+			log.Println("Error cancelling login with the bridge:", err)
+		}
 	}
+}
 
-	log.Println("Starting websocket without Tls")
-	return http.ListenAndServe(fmt.Sprintf("%s:%s", host, port), nil)
+func expiredLoginReason(state string) string {
+	return "login expired while " + strings.ReplaceAll(state, "_", " ")
 }
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// newTestWebsocketUnit registers a device login of username on wa, driven
+// by hand instead of a bridge.
+func newTestWebsocketUnit(t *testing.T, username string, login DeviceLogin) *WebsocketUnit {
+	t.Helper()
+	clientDb, err := GlobalStorage.OpenClient(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientDb.Close()
+
+	session, err := NewLoginSession(username, "wa", login.Method, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clientDb.CreateLoginSession(&session); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &mautrix.Client{UserID: id.NewUserID(username, "example.org")}
+	unit := NewWebsocketUnit(&Bridges{Name: "wa", Client: client}, "wa", username, login, session)
+	unit.started = true
+	GlobalWebsocketConnection.Register(unit)
+	t.Cleanup(func() { unit.finish("the test ended") })
+	return unit
+}
+
+func useTestStorage(t *testing.T) *SQLiteStorage {
+	t.Helper()
+	storage := newTestSQLiteStorage(t)
+	useTestMasterKeys(t)
+	if err := storage.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	previous := GlobalStorage
+	GlobalStorage = storage
+	t.Cleanup(func() { GlobalStorage = previous })
+	return storage
+}
+
+func waitForTestViewers(t *testing.T, unit *WebsocketUnit, want int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		unit.mutex.Lock()
+		viewers := len(unit.viewers)
+		unit.mutex.Unlock()
+		if viewers == want {
+			return
+		}
+	}
+	t.Fatalf("websocket viewers did not reach %d", want)
+}
+
+func dialTestWebsocket(t *testing.T, server *httptest.Server, unit *WebsocketUnit, query string) *websocket.Conn {
+	t.Helper()
+	ticket, _, err := GlobalWebsocketTickets.Issue(unit.Username, unit.PlatformName, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+unit.Url+"?ticket="+ticket+query, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	return conn
+}
+
+func readTestWebsocket(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	return string(data)
+}
+
+func readTestLoginUpdate(t *testing.T, conn *websocket.Conn) LoginUpdate {
+	t.Helper()
+	var update LoginUpdate
+	if err := json.Unmarshal([]byte(readTestWebsocket(t, conn)), &update); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	return update
+}
+
+func TestWebsocketUnitViewers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/ws/:platform/:username/:id", ApiWebsocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/ws/wa/alice/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unregistered websocket status = %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+
+	useTestStorage(t)
+	unit := newTestWebsocketUnit(t, "alice", DeviceLogin{Method: LoginMethodPhone, PhoneNumber: "+1234567890"})
+
+	resp, err = http.Get(server.URL + "/ws/signal/alice/" + unit.Session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("websocket of another platform status = %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+
+	first := dialTestWebsocket(t, server, unit, "")
+	defer first.Close()
+	waitForTestViewers(t, unit, 1)
+
+	qr := LoginUpdate{Type: LoginUpdateQR, Image: []byte("qr1"), QRCode: "2@qr1"}
+	unit.broadcast(qr)
+	if got := readTestLoginUpdate(t, first); got.Type != qr.Type || string(got.Image) != "qr1" || got.QRCode != qr.QRCode || got.State != LoginStateAwaitingScan {
+		t.Errorf("first viewer got %+v, want %+v", got, qr)
+	}
+
+	second := dialTestWebsocket(t, server, unit, "&format=binary")
+	defer second.Close()
+	if got := readTestWebsocket(t, second); got != "qr1" {
+		t.Errorf("joining binary viewer got %q, want the last QR code %q", got, "qr1")
+	}
+
+	// Status notices have no binary frame.
+	unit.broadcast(LoginUpdate{Type: LoginUpdateStatus, Message: "Scan the QR code"})
+	if got := readTestLoginUpdate(t, first); got.Type != LoginUpdateStatus || got.Message != "Scan the QR code" {
+		t.Errorf("first viewer got %+v, want the status", got)
+	}
+
+	unit.broadcast(LoginUpdate{Type: LoginUpdatePairingCode, PairingCode: "ABCD-EFGH"})
+	if got := readTestLoginUpdate(t, first); got.Type != LoginUpdatePairingCode || got.PairingCode != "ABCD-EFGH" {
+		t.Errorf("first viewer got %+v, want the pairing code", got)
+	}
+	if got := readTestWebsocket(t, second); got != "ABCD-EFGH" {
+		t.Errorf("binary viewer got %q, want %q", got, "ABCD-EFGH")
+	}
+	if got := unit.WaitForPairingCode(context.Background()); got != "ABCD-EFGH" {
+		t.Errorf("WaitForPairingCode() = %q, want %q", got, "ABCD-EFGH")
+	}
+
+	first.Close()
+	second.Close()
+	select {
+	case <-unit.done:
+	case <-time.After(time.Second):
+		t.Fatalf("login did not end after the last viewer left")
+	}
+	if logins := GlobalWebsocketConnection.Logins("alice", "wa"); len(logins) != 0 {
+		t.Errorf("Logins() = %v after the last viewer left, want none", logins)
+	}
+
+	status, err := FetchDeviceLogin("alice", unit.Session.ID)
+	if err != nil {
+		t.Fatalf("FetchDeviceLogin() error = %v", err)
+	}
+	var states []string
+	for _, transition := range status.Transitions {
+		states = append(states, transition.State)
+	}
+	want := []string{LoginStatePending, LoginStateAwaitingScan, LoginStateCancelled}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("FetchDeviceLogin() transitions = %v, want %v", states, want)
+	}
+}
+
+func TestWebsocketUnitCloseCodes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/ws/:platform/:username/:id", ApiWebsocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	useTestStorage(t)
+
+	tests := []struct {
+		name   string
+		update LoginUpdate
+		state  string
+		code   int
+	}{
+		{"success", LoginUpdate{Type: LoginUpdateSuccess, PhoneNumber: "+1234567890"}, LoginStateSuccess, websocket.CloseNormalClosure},
+		{"failed", LoginUpdate{Type: LoginUpdateFailed, Reason: "Login failed"}, LoginStateFailed, CloseLoginFailed},
+		{"timeout", LoginUpdate{Type: LoginUpdateTimeout, Reason: "Login failed: timed out"}, LoginStateExpired, CloseLoginTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unit := newTestWebsocketUnit(t, "bob", DeviceLogin{Method: LoginMethodQR})
+
+			conn := dialTestWebsocket(t, server, unit, "")
+			defer conn.Close()
+			waitForTestViewers(t, unit, 1)
+
+			unit.broadcast(tt.update)
+			unit.finish("the test ended")
+
+			tt.update.State = tt.state
+			if got := readTestLoginUpdate(t, conn); !reflect.DeepEqual(got, tt.update) {
+				t.Errorf("got %+v, want %+v", got, tt.update)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err := conn.ReadMessage()
+			if !websocket.IsCloseError(err, tt.code) {
+				t.Errorf("ReadMessage() error = %v, want close code %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestWebsocketUnitExpires(t *testing.T) {
+	useTestStorage(t)
+	conf := *cfg()
+	conf.LoginTimeouts.Pending = 50 * time.Millisecond
+	useTestConfig(t, &conf)
+
+	unit := newTestWebsocketUnit(t, "carol", DeviceLogin{Method: LoginMethodQR})
+	go unit.watch()
+
+	select {
+	case <-unit.done:
+	case <-time.After(time.Second):
+		t.Fatalf("login did not expire")
+	}
+
+	status, err := FetchDeviceLogin("carol", unit.Session.ID)
+	if err != nil {
+		t.Fatalf("FetchDeviceLogin() error = %v", err)
+	}
+	if status.State != LoginStateExpired || status.Reason != "login expired while pending" || status.ExpiresAt != nil {
+		t.Errorf("FetchDeviceLogin() = %+v, want expired while pending", status.LoginSession)
+	}
+}
+
+func TestCancelDeviceLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/ws/:platform/:username/:id", ApiWebsocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	useTestStorage(t)
+
+	if statuses := CancelDeviceLogins("dave", "wa"); len(statuses) != 0 {
+		t.Errorf("CancelDeviceLogins() without a login = %v, want none", statuses)
+	}
+
+	unit := newTestWebsocketUnit(t, "dave", DeviceLogin{Method: LoginMethodQR})
+	other := newTestWebsocketUnit(t, "dave", DeviceLogin{Method: LoginMethodQR})
+	conn := dialTestWebsocket(t, server, unit, "")
+	defer conn.Close()
+	waitForTestViewers(t, unit, 1)
+
+	if _, ok := CancelDeviceLogin("dave", "signal", unit.Session.ID); ok {
+		t.Errorf("CancelDeviceLogin() on another platform = true")
+	}
+	status, ok := CancelDeviceLogin("dave", "wa", unit.Session.ID)
+	if !ok || status.State != LoginStateCancelled || status.Reason != "cancelled by the user" {
+		t.Errorf("CancelDeviceLogin() = %+v, %v, want cancelled by the user", status.LoginSession, ok)
+	}
+	if logins := GlobalWebsocketConnection.Logins("dave", "wa"); len(logins) != 1 || logins[0] != other {
+		t.Errorf("Logins() = %v after cancelling one, want the other login", logins)
+	}
+
+	want := LoginUpdate{Type: LoginUpdateCancelled, State: LoginStateCancelled, Reason: "cancelled by the user"}
+	if got := readTestLoginUpdate(t, conn); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, CloseLoginCancelled) {
+		t.Errorf("ReadMessage() error = %v, want close code %d", err, CloseLoginCancelled)
+	}
+
+	statuses := CancelDeviceLogins("dave", "wa")
+	if len(statuses) != 1 || statuses[0].ID != other.Session.ID || statuses[0].State != LoginStateCancelled {
+		t.Errorf("CancelDeviceLogins() = %+v, want the other login cancelled", statuses)
+	}
+}
+
+func TestWebsocketUnitReserveRoom(t *testing.T) {
+	useTestStorage(t)
+
+	management := id.RoomID("!management:example.org")
+	first := newTestWebsocketUnit(t, "erin", DeviceLogin{Method: LoginMethodQR})
+	second := newTestWebsocketUnit(t, "erin", DeviceLogin{Method: LoginMethodQR})
+
+	if room, ok := GlobalWebsocketConnection.reserveRoom(first, []id.RoomID{management}); !ok || room != management {
+		t.Errorf("reserveRoom() = %v, %v, want the management room", room, ok)
+	}
+	// Reserving again keeps the room of the login.
+	if room, ok := GlobalWebsocketConnection.reserveRoom(first, []id.RoomID{management}); !ok || room != management {
+		t.Errorf("reserveRoom() again = %v, %v, want the management room", room, ok)
+	}
+	if room, ok := GlobalWebsocketConnection.reserveRoom(second, []id.RoomID{management}); ok {
+		t.Errorf("reserveRoom() of a concurrent login = %v, want the management room taken", room)
+	}
+	if room, ok := GlobalWebsocketConnection.reserveRoom(second, []id.RoomID{management, "!login:example.org"}); !ok || room != "!login:example.org" {
+		t.Errorf("reserveRoom() = %v, %v, want the login room", room, ok)
+	}
+
+	// Logins of another user or platform don't share rooms.
+	client := &mautrix.Client{UserID: id.NewUserID("erin", "example.org")}
+	signal := NewWebsocketUnit(&Bridges{Name: "signal", Client: client}, "signal", "erin", DeviceLogin{Method: LoginMethodQR}, LoginSession{ID: "signal"})
+	if room, ok := GlobalWebsocketConnection.reserveRoom(signal, []id.RoomID{management}); !ok || room != management {
+		t.Errorf("reserveRoom() on another platform = %v, %v, want the management room", room, ok)
+	}
+	GlobalWebsocketConnection.Remove(signal)
+
+	first.finish("the test ended")
+	if room, ok := GlobalWebsocketConnection.reserveRoom(second, []id.RoomID{management}); !ok || room != management {
+		t.Errorf("reserveRoom() after the login ended = %v, %v, want the management room", room, ok)
+	}
+}
+
+func TestWebsocketUnitLoginSteps(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useTestStorage(t)
+
+	useTestConfig(t, &Conf{Bridges: []map[string]BridgeConfig{{"wa": {LoginSteps: []LoginStep{
+		{Prompt: "^Please enter the code", Input: "code", Command: "!wa code {{.}}"},
+	}}}}})
+
+	// The homeserver the answers are sent to.
+	sent := make(chan string, 1)
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var content struct {
+			Body string `json:"body"`
+		}
+		json.NewDecoder(r.Body).Decode(&content)
+		sent <- content.Body
+		w.Write([]byte(`{"event_id":"$sent"}`))
+	}))
+	defer homeserver.Close()
+
+	router := gin.New()
+	router.GET("/ws/:platform/:username/:id", ApiWebsocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	unit := newTestWebsocketUnit(t, "frank", DeviceLogin{Method: LoginMethodQR})
+	client, err := mautrix.NewClient(homeserver.URL, id.NewUserID("frank", "example.org"), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit.Bridge.Client = client
+	unit.Bridge.RoomID = "!login:example.org"
+
+	conn := dialTestWebsocket(t, server, unit, "")
+	defer conn.Close()
+	waitForTestViewers(t, unit, 1)
+
+	// Inputs nobody asked for are rejected to the websocket that sent them.
+	if err := conn.WriteJSON(LoginInput{Type: LoginUpdateInput, Input: "code", Value: "12345"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestLoginUpdate(t, conn); got.Type != LoginUpdateRejected || got.Reason != ErrUnexpectedLoginInput.Error() {
+		t.Errorf("got %+v, want the input rejected", got)
+	}
+
+	unit.broadcast(unit.Bridge.parseLoginNotice("Please enter the code sent to your phone", unit.Login))
+	if got := readTestLoginUpdate(t, conn); got.Type != LoginUpdateInput || got.Input != "code" || got.State != LoginStateAwaitingInput {
+		t.Errorf("got %+v, want the code asked for", got)
+	}
+	if status := unit.Status(); status.State != LoginStateAwaitingInput || status.Input != "code" {
+		t.Errorf("Status() = %+v, want awaiting the code", status)
+	}
+
+	// Values that would smuggle more commands to the bridge are rejected and
+	// the step stays open.
+	if err := conn.WriteJSON(LoginInput{Type: LoginUpdateInput, Input: "code", Value: "12345\nlogout"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestLoginUpdate(t, conn); got.Type != LoginUpdateRejected || got.Reason != ErrInvalidLoginInput.Error() {
+		t.Errorf("got %+v, want the multi-line value rejected", got)
+	}
+	if status := unit.Status(); status.State != LoginStateAwaitingInput || status.Input != "code" {
+		t.Errorf("Status() = %+v, want still awaiting the code", status)
+	}
+
+	if err := conn.WriteJSON(LoginInput{Type: LoginUpdateInput, Input: "code", Value: "12345"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestLoginUpdate(t, conn); got.Type != LoginUpdateStatus || got.Input != "code" || got.State != LoginStatePending {
+		t.Errorf("got %+v, want the code sent", got)
+	}
+	select {
+	case body := <-sent:
+		if body != "!wa code 12345" {
+			t.Errorf("sent %q to the bridge, want %q", body, "!wa code 12345")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the code was not sent to the bridge")
+	}
+}
+
+func TestApiAddDeviceWithoutWebsocket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useTestStorage(t)
+
+	management := id.RoomID("!management:example.org")
+	bot := id.UserID("@whatsappbot:example.org")
+
+	// The homeserver the login command is sent to.
+	sent := make(chan string, 4)
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var content struct {
+			Body string `json:"body"`
+		}
+		json.NewDecoder(r.Body).Decode(&content)
+		sent <- content.Body
+		w.Write([]byte(`{"event_id":"$sent"}`))
+	}))
+	defer homeserver.Close()
+
+	useTestConfig(t, &Conf{
+		HomeServer:       homeserver.URL,
+		HomeServerDomain: "example.org",
+		Bridges: []map[string]BridgeConfig{{"wa": {BotName: bot.String(), Cmd: map[string]string{
+			"login":   "login qr",
+			"success": "^Successfully logged in as %s",
+		}}}},
+	})
+
+	clientDb, err := GlobalStorage.OpenClient("grace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = clientDb.StoreRooms(management.String(), "wa", "", bot.String(), true)
+	clientDb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticated := func(c *gin.Context) {
+		c.Set(authUsernameKey, "grace")
+		c.Set(authAccessTokenKey, "syt_grace")
+	}
+	router := gin.New()
+	router.POST("/:platform/devices", authenticated, ApiAddDevice)
+	router.GET("/:platform/devices/login/:id", authenticated, ApiGetDeviceLogin)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/wa/devices", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("POST /wa/devices status = %v, want %v: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	var device DeviceResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &device); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if unit := GlobalWebsocketConnection.LookupLogin("grace", device.LoginID); unit != nil {
+			unit.finish("the test ended")
+		}
+	})
+
+	select {
+	case body := <-sent:
+		if body != "login qr" {
+			t.Errorf("sent %q to the bridge, want %q", body, "login qr")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the login was not started without a websocket")
+	}
+
+	poll := func() LoginStatus {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/wa/devices/login/"+device.LoginID, nil))
+		var status LoginStatus
+		if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	if status := poll(); status.State != LoginStatePending {
+		t.Errorf("state = %q, want %q", status.State, LoginStatePending)
+	}
+
+	(&MatrixClient{}).processIncomingEvents(&event.Event{
+		ID:        "$success",
+		Sender:    bot,
+		RoomID:    management,
+		Type:      event.EventMessage,
+		Timestamp: time.Now().UnixMilli(),
+		Content:   event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgNotice, Body: "Successfully logged in as +1234567890"}},
+	})
+
+	var status LoginStatus
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if status = poll(); status.State == LoginStateSuccess {
+			return
+		}
+	}
+	t.Errorf("state = %q, want %q", status.State, LoginStateSuccess)
+}